@@ -1,9 +1,18 @@
 # win
 $env:GOARCH = "amd64"
 $env:GOOS = "windows"
-go build -mod=vendor -o ./bin/cache_copy.exe main.go
+go build -mod=vendor -o ./bin/cache_copy.exe .
 
 # linux
 $env:GOARCH = "amd64"
 $env:GOOS = "linux"
-go build -mod=vendor -o ./bin/cache_copy main.go
\ No newline at end of file
+go build -mod=vendor -o ./bin/cache_copy .
+
+# linux 32-bit
+$env:GOARCH = "386"
+$env:GOOS = "linux"
+go build -mod=vendor -o ./bin/cache_copy_386 .
+
+$env:GOARCH = "arm"
+$env:GOOS = "linux"
+go build -mod=vendor -o ./bin/cache_copy_arm .
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"cache_copy/core"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const cacheUsage = `Usage: cache_copy cache <command> [options]
+
+Inspect and maintain cache files.
+
+COMMANDS:
+  list                      List all caches with their source -> destination pair
+  show <cache>              Print the entries of a cache (path, size, hash, source mtime, copy and verify age)
+  stats [cache]             Print entry totals and an age histogram (all caches if omitted)
+  prune                     Delete caches whose source or destination no longer exists
+  rm <cache>...             Delete caches
+  export <cache> [file]     Write a cache as JSON lines to file (default: stdout)
+  import <file>             Create a cache from an export file
+  verify <dst>              Check a destination against its manifest (see --manifest)
+  rebuild <src> <dst>       Seed the cache for src -> dst from an already populated destination
+                            by hashing both sides; no file data is written. Give it the filter and
+                            -symlinks options of the copy so it adopts the same files
+
+<cache> is a cache path or a file name inside the cache directory.
+
+OPTIONS:
+  -cache-dir string         Directory holding cache files (default: $CACHE_COPY_DIR, then the user cache directory)
+  -limit int                (show) Maximum number of entries to print (default: all)
+  -dry-run                  (prune) Only print what would be deleted
+  -workers int              (verify, rebuild) Number of files hashed concurrently (default: number of CPU cores)
+  -cache-backend string     (import, rebuild) Storage backend of the cache (default: "json")
+  -rebase OLD=NEW           (import) Replace the prefix OLD of the recorded source and destination
+                            with NEW, e.g. -rebase 'D:\captures=/mnt/captures'. May be repeated
+  -include pattern          (rebuild) Adopt only files matching this glob, as for a copy. May be repeated
+  -exclude pattern          (rebuild) Leave out paths matching this glob, as for a copy. May be repeated
+  -filter-from string       (rebuild) Read exclude patterns from this file, as for a copy
+  -symlinks string          (rebuild) Symbolic link handling, as for a copy (default: "follow")
+`
+
+// exportHeader is the first line of a cache export file. Every following
+// line is an exportRecord.
+type exportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Src     string `json:"src"`
+	Dst     string `json:"dst"`
+}
+
+type exportRecord struct {
+	Key   string           `json:"key"`
+	Entry *core.CacheEntry `json:"entry"`
+}
+
+const exportFormat = "cache_copy-export"
+
+// exportVersion 2 writes canonical keys (see core.CacheKey). Version 1
+// exports from Windows hold backslash keys, which are converted on import.
+const exportVersion = 2
+
+// rebaseFlag collects repeated -rebase OLD=NEW rules.
+type rebaseFlag [][2]string
+
+func (r *rebaseFlag) String() string {
+	return fmt.Sprint(*r)
+}
+
+func (r *rebaseFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected OLD=NEW, got %q", value)
+	}
+	*r = append(*r, [2]string{value[:i], value[i+1:]})
+	return nil
+}
+
+// rebase applies the first rule whose prefix matches path.
+func (r rebaseFlag) rebase(path string) string {
+	for _, rule := range r {
+		if rebased, ok := core.RebasePath(path, rule[0], rule[1]); ok {
+			return rebased
+		}
+	}
+	return path
+}
+
+// runCacheCommand implements the "cache" subcommand and returns the exit code.
+func runCacheCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cacheUsage)
+		return 1
+	}
+	fs := flag.NewFlagSet("cache "+args[0], flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, cacheUsage) }
+	limit := fs.Int("limit", 0, "Maximum number of entries to print")
+	dryRun := fs.Bool("dry-run", false, "Only print what would be deleted")
+	backend := fs.String("cache-backend", core.BackendJSON, "Storage backend of the imported cache")
+	cacheDirFlag := fs.String("cache-dir", "", "Directory holding cache files")
+	workers := fs.Int("workers", runtime.GOMAXPROCS(0), "Number of files hashed concurrently")
+	var rebase rebaseFlag
+	fs.Var(&rebase, "rebase", "Replace a source/destination prefix on import (OLD=NEW)")
+	var includes, excludes stringList
+	fs.Var(&includes, "include", "Adopt only files matching this glob (repeatable)")
+	fs.Var(&excludes, "exclude", "Leave out paths matching this glob (repeatable)")
+	filterFrom := fs.String("filter-from", "", "Read exclude patterns in gitignore syntax from this file")
+	symlinksFlag := fs.String("symlinks", "follow", "Symbolic link handling: preserve, follow, skip or error")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 1
+	}
+	rest := fs.Args()
+	cacheDir, err := core.ResolveCacheDir(*cacheDirFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] Invalid cache directory: %v\n", timestamp(), err)
+		return 1
+	}
+
+	switch args[0] {
+	case "list":
+		err = cacheList(cacheDir)
+	case "show":
+		if len(rest) != 1 {
+			fs.Usage()
+			return 1
+		}
+		err = cacheShow(resolveCachePath(cacheDir, rest[0]), *limit)
+	case "stats":
+		err = cacheStats(cacheDir, rest)
+	case "prune":
+		err = cachePrune(cacheDir, *dryRun)
+	case "rm":
+		if len(rest) == 0 {
+			fs.Usage()
+			return 1
+		}
+		for _, name := range rest {
+			path := resolveCachePath(cacheDir, name)
+			if rmErr := removeCache(path); rmErr != nil {
+				fmt.Fprintf(os.Stderr, "[%s] [ERROR] Failed to delete cache %s: %v\n", timestamp(), path, rmErr)
+				err = rmErr
+				continue
+			}
+			fmt.Printf("Deleted %s\n", path)
+		}
+	case "export":
+		if len(rest) < 1 || len(rest) > 2 {
+			fs.Usage()
+			return 1
+		}
+		out := ""
+		if len(rest) == 2 {
+			out = rest[1]
+		}
+		err = cacheExport(resolveCachePath(cacheDir, rest[0]), out)
+	case "import":
+		if len(rest) != 1 {
+			fs.Usage()
+			return 1
+		}
+		err = cacheImport(cacheDir, rest[0], *backend, rebase)
+	case "verify":
+		if len(rest) != 1 {
+			fs.Usage()
+			return 1
+		}
+		err = cacheVerify(rest[0], *workers)
+	case "rebuild":
+		if len(rest) != 2 {
+			fs.Usage()
+			return 1
+		}
+		var filter *core.Filter
+		var symlinks core.SymlinkMode
+		filter, err = core.NewFilter(includes, excludes)
+		if err == nil && *filterFrom != "" {
+			if err = filter.AddFile(*filterFrom); err != nil {
+				err = fmt.Errorf("failed to read filter file: %w", err)
+			}
+		}
+		if err == nil {
+			symlinks, err = core.ParseSymlinkMode(*symlinksFlag)
+		}
+		if err == nil {
+			err = cacheRebuild(cacheDir, rest[0], rest[1], *backend, *workers, filter, symlinks)
+		}
+	default:
+		fs.Usage()
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] %v\n", timestamp(), err)
+		return 1
+	}
+	return 0
+}
+
+// resolveCachePath accepts either a path to a cache or a name inside cacheDir.
+func resolveCachePath(cacheDir, name string) string {
+	if core.Exists(name) {
+		return name
+	}
+	return filepath.Join(cacheDir, filepath.Base(name))
+}
+
+// withCache locks and opens an existing cache read-only, runs fn and closes
+// it again. Nothing is written to the cache, not even a compaction.
+func withCache(path string, fn func(cache *core.GlobalCache) error) error {
+	if !core.Exists(path) {
+		return fmt.Errorf("cache not found: %s", path)
+	}
+	lock, err := core.LockCache(path)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	cache, err := core.OpenGlobalCacheReadOnly(path, core.DetectBackend(path))
+	if err != nil {
+		return err
+	}
+	err = fn(cache)
+	if closeErr := cache.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// removeCache deletes a cache unless another run holds its lock.
+func removeCache(path string) error {
+	lock, err := core.LockCache(path)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return core.RemoveCacheFiles(path)
+}
+
+// describePair formats the source -> destination pair of a cache.
+func describePair(cf core.CacheFile) string {
+	if !cf.HasInfo {
+		return "(unknown, cache predates info files)"
+	}
+	return cf.Info.Src + " -> " + cf.Info.Dst
+}
+
+// formatAge renders the time since a Unix timestamp, or "-" if unknown.
+func formatAge(now, t int64) string {
+	if t <= 0 {
+		return "-"
+	}
+	d := time.Duration(now-t) * time.Second
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+}
+
+func cacheList(cacheDir string) error {
+	caches, err := core.ListCaches(cacheDir)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CACHE\tBACKEND\tLAST USED\tSOURCE -> DESTINATION")
+	for _, cf := range caches {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", filepath.Base(cf.Path), cf.Backend, formatAge(now, cf.Info.LastUsed), describePair(cf))
+	}
+	return w.Flush()
+}
+
+func cacheShow(path string, limit int) error {
+	var keys []string
+	entries := make(map[string]*core.CacheEntry)
+	err := withCache(path, func(cache *core.GlobalCache) error {
+		cache.Range(func(key string, entry *core.CacheEntry) bool {
+			keys = append(keys, key)
+			entries[key] = entry
+			return limit <= 0 || len(keys) < limit
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+
+	now := time.Now().Unix()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tSIZE\tHASH\tSOURCE MTIME\tCOPIED\tVERIFIED")
+	for _, key := range keys {
+		e := entries[key]
+		mtime := "-"
+		if e.SourceModTime != 0 {
+			mtime = time.Unix(0, e.SourceModTime).Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%s\t%d\t%016x\t%s\t%s\t%s\n", key, e.Size, e.Hash, mtime, formatAge(now, e.LastCopied), formatAge(now, e.LastVerified))
+	}
+	return w.Flush()
+}
+
+// ageBuckets are the upper bounds of the stats age histogram.
+var ageBuckets = []struct {
+	label string
+	max   time.Duration
+}{
+	{"< 1 day", 24 * time.Hour},
+	{"< 7 days", 7 * 24 * time.Hour},
+	{"< 30 days", 30 * 24 * time.Hour},
+	{"< 90 days", 90 * 24 * time.Hour},
+	{">= 90 days", 1<<63 - 1},
+}
+
+func cacheStats(cacheDir string, names []string) error {
+	var caches []core.CacheFile
+	if len(names) == 0 {
+		all, err := core.ListCaches(cacheDir)
+		if err != nil {
+			return err
+		}
+		caches = all
+	} else {
+		for _, name := range names {
+			path := resolveCachePath(cacheDir, name)
+			cf := core.CacheFile{Path: path, Backend: core.DetectBackend(path)}
+			if info, err := core.ReadCacheInfo(path); err == nil {
+				cf.Info, cf.HasInfo = info, true
+			}
+			caches = append(caches, cf)
+		}
+	}
+
+	now := time.Now().Unix()
+	for _, cf := range caches {
+		var count, totalBytes int64
+		unknown := 0
+		hist := make([]int, len(ageBuckets))
+		err := withCache(cf.Path, func(cache *core.GlobalCache) error {
+			cache.Range(func(_ string, e *core.CacheEntry) bool {
+				count++
+				totalBytes += e.Size
+				last := e.LastConfirmed()
+				if last <= 0 {
+					unknown++
+					return true
+				}
+				age := time.Duration(now-last) * time.Second
+				for i, b := range ageBuckets {
+					if age < b.max {
+						hist[i]++
+						break
+					}
+				}
+				return true
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s (%s)\n", cf.Path, cf.Backend)
+		fmt.Printf("  Pair:    %s\n", describePair(cf))
+		fmt.Printf("  Entries: %d\n", count)
+		fmt.Printf("  Bytes:   %.2f MB (%d)\n", float64(totalBytes)/(1024*1024), totalBytes)
+		fmt.Printf("  Age (since last copied or verified):\n")
+		for i, b := range ageBuckets {
+			fmt.Printf("    %-10s %8d  %s\n", b.label, hist[i], core.RenderProgressBar(int64(hist[i]), count, 30))
+		}
+		if unknown > 0 {
+			fmt.Printf("    %-10s %8d\n", "unknown", unknown)
+		}
+	}
+	return nil
+}
+
+func cachePrune(cacheDir string, dryRun bool) error {
+	caches, err := core.ListCaches(cacheDir)
+	if err != nil {
+		return err
+	}
+	pruned := 0
+	for _, cf := range caches {
+		if !cf.HasInfo {
+			continue
+		}
+		missing := ""
+		if !core.Exists(cf.Info.Src) {
+			missing = "source " + cf.Info.Src
+		} else if !core.Exists(cf.Info.Dst) {
+			missing = "destination " + cf.Info.Dst
+		}
+		if missing == "" {
+			continue
+		}
+		pruned++
+		if dryRun {
+			fmt.Printf("Would delete %s (%s no longer exists)\n", cf.Path, missing)
+			continue
+		}
+		if err := removeCache(cf.Path); err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] [ERROR] Failed to delete cache %s: %v\n", timestamp(), cf.Path, err)
+			continue
+		}
+		fmt.Printf("Deleted %s (%s no longer exists)\n", cf.Path, missing)
+	}
+	fmt.Printf("Pruned %d orphaned cache(s)\n", pruned)
+	return nil
+}
+
+func cacheExport(path, outPath string) error {
+	info, _ := core.ReadCacheInfo(path)
+	return withCache(path, func(cache *core.GlobalCache) error {
+		var out io.Writer = os.Stdout
+		if outPath != "" {
+			f, err := os.Create(outPath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		w := bufio.NewWriter(out)
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(exportHeader{Format: exportFormat, Version: exportVersion, Src: info.Src, Dst: info.Dst}); err != nil {
+			return err
+		}
+		var err error
+		cache.Range(func(key string, entry *core.CacheEntry) bool {
+			err = enc.Encode(exportRecord{Key: core.CacheKey(key), Entry: entry})
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+}
+
+func cacheImport(cacheDir, inPath, backend string, rebase rebaseFlag) error {
+	f, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var hdr exportHeader
+	if err := dec.Decode(&hdr); err != nil || hdr.Format != exportFormat {
+		return fmt.Errorf("%s is not a cache export file", inPath)
+	}
+	if hdr.Src == "" || hdr.Dst == "" {
+		return fmt.Errorf("%s does not record its source and destination", inPath)
+	}
+	if hdr.Version > exportVersion {
+		return fmt.Errorf("%s has version %d, newer than supported version %d", inPath, hdr.Version, exportVersion)
+	}
+	src, dst := rebase.rebase(hdr.Src), rebase.rebase(hdr.Dst)
+	if src != hdr.Src || dst != hdr.Dst {
+		fmt.Printf("Rebased %s -> %s to %s -> %s\n", hdr.Src, hdr.Dst, src, dst)
+	}
+
+	path := core.StorePath(core.LocalCacheFile(cacheDir, src, dst), backend)
+	lock, err := core.LockCache(path)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	cache, err := core.OpenGlobalCache(path, backend)
+	if err != nil {
+		return err
+	}
+	if info, _ := core.ReadCacheInfo(path); info.KeyFormat < core.KeyFormatPortable {
+		cache.NormalizeKeys()
+	}
+	n := 0
+	cache.Lock()
+	for {
+		var rec exportRecord
+		if err = dec.Decode(&rec); err != nil {
+			break
+		}
+		if rec.Entry != nil {
+			if hdr.Version < 2 {
+				rec.Key = strings.ReplaceAll(rec.Key, `\`, "/")
+			}
+			cache.Put(rec.Key, rec.Entry)
+			n++
+		}
+	}
+	cache.Unlock()
+	if err != io.EOF {
+		cache.Close()
+		return fmt.Errorf("failed to read %s: %v", inPath, err)
+	}
+	if err := cache.Close(); err != nil {
+		return err
+	}
+	if err := core.WriteCacheInfo(path, core.CacheInfo{Src: src, Dst: dst, Backend: backend, LastUsed: time.Now().Unix(), KeyFormat: core.KeyFormatPortable}); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d entries into %s\n", n, path)
+	return nil
+}
+
+// cacheVerify hashes every file listed in the manifest of dstRoot and
+// reports files that are missing or differ.
+func cacheVerify(dstRoot string, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+	entries := make(chan core.ManifestEntry, workers*4)
+	var mu sync.Mutex
+	var checked, bad int
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range entries {
+				problem := ""
+				path := filepath.Join(dstRoot, core.KeyPath(e.Path))
+				want, _ := strconv.ParseUint(e.Hash, 16, 64)
+				if info, err := os.Stat(path); err != nil {
+					problem = "missing"
+				} else if info.Size() != e.Size {
+					problem = fmt.Sprintf("size %d, manifest %d", info.Size(), e.Size)
+				} else if hash, err := core.FileHashChunked(path, e.Chunk); err != nil {
+					problem = err.Error()
+				} else if hash != want {
+					problem = fmt.Sprintf("hash %016x, manifest %s", hash, e.Hash)
+				}
+				mu.Lock()
+				checked++
+				if problem != "" {
+					bad++
+					fmt.Printf("[%s] [VALIDATE] MISMATCH - %s: %s\n", timestamp(), e.Path, problem)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	err := core.ReadManifest(dstRoot, func(e core.ManifestEntry) bool {
+		entries <- e
+		return true
+	})
+	close(entries)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[%s] [VALIDATE] Checked %d files, %d mismatched\n", timestamp(), checked, bad)
+	if bad > 0 {
+		return fmt.Errorf("%d of %d files do not match the manifest", bad, checked)
+	}
+	return nil
+}
+
+// cacheRebuild adopts an existing replica: every source file whose
+// destination counterpart has the same size and hash gets a cache entry, so
+// the next copy skips it. Differences are reported, never repaired. The
+// source is walked like a copy with the same filter and symlink handling
+// walks it, except that unreadable directories are reported and skipped.
+func cacheRebuild(cacheDir, src, dst, backend string, workers int, filter *core.Filter, symlinks core.SymlinkMode) error {
+	if workers < 1 {
+		workers = 1
+	}
+	rootDst := core.DestinationRoot(src, dst)
+	if !core.Exists(rootDst) {
+		return fmt.Errorf("destination %s does not exist", rootDst)
+	}
+	path := core.StorePath(core.LocalCacheFile(cacheDir, src, rootDst), backend)
+	lock, err := core.LockCache(path)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	cache, err := core.OpenGlobalCache(path, backend)
+	if err != nil {
+		return err
+	}
+	if info, _ := core.ReadCacheInfo(path); info.KeyFormat < core.KeyFormatPortable {
+		cache.NormalizeKeys()
+	}
+	absSrc, _ := filepath.Abs(src)
+	absDst, _ := filepath.Abs(rootDst)
+	if err := core.WriteCacheInfo(path, core.CacheInfo{Src: absSrc, Dst: absDst, Backend: backend, LastUsed: time.Now().Unix(), KeyFormat: core.KeyFormatPortable}); err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [WARN] Failed to write cache info for %s: %v\n", timestamp(), path, err)
+	}
+	fmt.Printf("[%s] [INFO] Rebuilding cache %s from %s -> %s\n", timestamp(), path, src, rootDst)
+
+	engine := core.NewEngine(core.Options{Src: src, Dst: rootDst, Filter: filter, Symlinks: symlinks, OnEvent: func(ev core.Event) {
+		if ev.Kind == core.EventLog {
+			fmt.Fprint(os.Stderr, ev.Message)
+		}
+	}})
+	list, err := engine.SourceFiles(context.Background())
+	if err != nil {
+		cache.Close()
+		return err
+	}
+
+	var mu sync.Mutex
+	var identical, mismatched, missing, failed int
+	report := func(counter *int, format string, args ...interface{}) {
+		mu.Lock()
+		*counter++
+		if format != "" {
+			fmt.Printf(format, args...)
+		}
+		mu.Unlock()
+	}
+
+	files := make(chan string, workers*4)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for relPath := range files {
+				srcPath := filepath.Join(src, relPath)
+				dstPath := filepath.Join(rootDst, relPath)
+				if symlinks == core.SymlinksPreserve {
+					if srcInfo, err := os.Lstat(srcPath); err == nil && srcInfo.Mode()&os.ModeSymlink != 0 {
+						target, err := engine.LinkTarget(relPath)
+						if err != nil {
+							report(&failed, "[%s] [ERROR] Failed to read link %s: %v\n", timestamp(), srcPath, err)
+							continue
+						}
+						if existing, err := os.Readlink(dstPath); err != nil {
+							report(&missing, "[%s] [REBUILD] MISSING - %s\n", timestamp(), relPath)
+						} else if existing != target {
+							report(&mismatched, "[%s] [REBUILD] MISMATCH - Link target differs for %s (source %s, destination %s)\n", timestamp(), relPath, target, existing)
+						} else {
+							cache.Lock()
+							cache.UpdateLink(relPath, core.StatMeta(srcPath, srcInfo), target, time.Now().Unix())
+							cache.Unlock()
+							cache.SaveCache()
+							report(&identical, "")
+						}
+						continue
+					}
+				}
+				srcInfo, err := os.Stat(srcPath)
+				if err != nil {
+					report(&failed, "[%s] [ERROR] Failed to stat %s: %v\n", timestamp(), srcPath, err)
+					continue
+				}
+				dstInfo, err := os.Stat(dstPath)
+				if err != nil || !dstInfo.Mode().IsRegular() {
+					report(&missing, "[%s] [REBUILD] MISSING - %s\n", timestamp(), relPath)
+					continue
+				}
+				if srcInfo.Size() != dstInfo.Size() {
+					report(&mismatched, "[%s] [REBUILD] MISMATCH - Size differs for %s (source %d, destination %d)\n", timestamp(), relPath, srcInfo.Size(), dstInfo.Size())
+					continue
+				}
+
+				// Hash both sides concurrently
+				var dstHash uint64
+				var dstErr error
+				done := make(chan struct{})
+				go func() {
+					dstHash, dstErr = core.FileHash(dstPath)
+					close(done)
+				}()
+				srcHash, srcErr := core.FileHash(srcPath)
+				<-done
+				if srcErr != nil || dstErr != nil {
+					report(&failed, "[%s] [ERROR] Failed to hash %s: source: %v, destination: %v\n", timestamp(), relPath, srcErr, dstErr)
+					continue
+				}
+				if srcHash != dstHash {
+					report(&mismatched, "[%s] [REBUILD] MISMATCH - Hash differs for %s\n", timestamp(), relPath)
+					continue
+				}
+
+				cache.Lock()
+				cache.UpdateWithMeta(relPath, core.StatMeta(srcPath, srcInfo), srcHash, 0, 0, time.Now().Unix())
+				cache.Unlock()
+				cache.SaveCache()
+				report(&identical, "")
+			}
+		}()
+	}
+
+	for _, relPath := range list {
+		files <- relPath
+	}
+	close(files)
+	wg.Wait()
+	if err := cache.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] [INFO] Rebuild done: %d identical (cached), %d mismatched, %d missing in destination, %d errors\n",
+		timestamp(), identical, mismatched, missing, failed)
+	return nil
+}
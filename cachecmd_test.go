@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"cache_copy/core"
+)
+
+// writeCache creates a cache for the src -> dst pair in cacheDir holding
+// the given hashes and returns its path.
+func writeCache(t *testing.T, cacheDir, src, dst string, hashes map[string]uint64) string {
+	t.Helper()
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := core.LocalCacheFile(cacheDir, src, dst)
+	cache, err := core.NewGlobalCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, hash := range hashes {
+		cache.Put(key, &core.CacheEntry{Size: 1, Hash: hash, LastCopied: 100})
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := core.WriteCacheInfo(path, core.CacheInfo{Src: src, Dst: dst, Backend: core.BackendJSON, KeyFormat: core.KeyFormatPortable}); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCacheExportImport(t *testing.T) {
+	dir := t.TempDir()
+	oldSrc, oldDst := filepath.Join(dir, "old", "src"), filepath.Join(dir, "old", "dst")
+	path := writeCache(t, filepath.Join(dir, "from"), oldSrc, oldDst, map[string]uint64{"a": 1, "sub/b": 2})
+
+	export := filepath.Join(dir, "export.jsonl")
+	if code := runCacheCommand([]string{"export", path, export}); code != 0 {
+		t.Fatalf("export exited with %d", code)
+	}
+	toDir := filepath.Join(dir, "to")
+	newRoot := filepath.Join(dir, "new")
+	args := []string{"import", "-cache-dir", toDir, "-cache-backend", core.BackendLSM, "-rebase", filepath.Join(dir, "old") + "=" + newRoot, export}
+	if code := runCacheCommand(args); code != 0 {
+		t.Fatalf("import exited with %d", code)
+	}
+
+	newSrc, newDst := filepath.Join(newRoot, "src"), filepath.Join(newRoot, "dst")
+	imported := core.StorePath(core.LocalCacheFile(toDir, newSrc, newDst), core.BackendLSM)
+	info, err := core.ReadCacheInfo(imported)
+	if err != nil || info.Src != newSrc || info.Dst != newDst || info.Backend != core.BackendLSM {
+		t.Fatalf("imported cache info = %+v, %v", info, err)
+	}
+	cache, err := core.OpenGlobalCache(imported, core.BackendLSM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	for key, hash := range map[string]uint64{"a": 1, "sub/b": 2} {
+		if e, ok := cache.IsUpToDate(key); !ok || e.Hash != hash || e.LastCopied != 100 {
+			t.Errorf("imported entry %s = %+v", key, e)
+		}
+	}
+}
+
+// captureStdout returns what fn prints to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	fn()
+	os.Stdout = stdout
+	w.Close()
+	return <-out
+}
+
+// dirContents returns the content of every file below dir by relative path.
+func dirContents(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		rel, _ := filepath.Rel(dir, path)
+		files[rel] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestCacheReadOnlyCommands(t *testing.T) {
+	for _, backend := range []string{core.BackendJSON, core.BackendLSM} {
+		t.Run(backend, func(t *testing.T) {
+			cacheDir := filepath.Join(t.TempDir(), "caches")
+			os.MkdirAll(cacheDir, 0755)
+			path := core.StorePath(filepath.Join(cacheDir, "cache.json"), backend)
+			for i := 0; i < 5; i++ {
+				cache, err := core.OpenGlobalCache(path, backend)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cache.Put(fmt.Sprintf("file%d", i), &core.CacheEntry{Size: 1, Hash: uint64(i)})
+				if i < 4 {
+					cache.Close()
+				} else if err := cache.SaveCache(); err != nil {
+					// The last one only journaled, as left by an interrupted run
+					t.Fatal(err)
+				}
+			}
+			before := dirContents(t, cacheDir)
+
+			out := captureStdout(t, func() {
+				if err := cacheShow(path, 2); err != nil {
+					t.Error(err)
+				}
+			})
+			if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 3 {
+				t.Errorf("show -limit 2 printed %d lines, want a header and 2 entries:\n%s", len(lines), out)
+			}
+			captureStdout(t, func() {
+				if err := cacheStats(cacheDir, []string{path}); err != nil {
+					t.Error(err)
+				}
+			})
+			export := filepath.Join(t.TempDir(), "export.jsonl")
+			if err := cacheExport(path, export); err != nil {
+				t.Error(err)
+			}
+			if data, _ := os.ReadFile(export); strings.Count(string(data), "\n") != 6 {
+				t.Errorf("export holds %q, want a header and 5 entries", data)
+			}
+
+			after := dirContents(t, cacheDir)
+			delete(after, filepath.Base(core.LockPath(path))) // Released by now, but held while reading
+			if fmt.Sprint(after) != fmt.Sprint(before) {
+				t.Errorf("cache files changed by show, stats and export:\nbefore %v\nafter  %v", before, after)
+			}
+		})
+	}
+}
+
+func TestCachePruneAndRemove(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "caches")
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(dst, 0755)
+	live := writeCache(t, cacheDir, src, dst, map[string]uint64{"a": 1})
+	orphan := writeCache(t, cacheDir, filepath.Join(dir, "gone"), dst, map[string]uint64{"a": 1})
+
+	if code := runCacheCommand([]string{"prune", "-cache-dir", cacheDir, "-dry-run"}); code != 0 || !core.Exists(orphan) {
+		t.Fatalf("prune -dry-run exited with %d, orphan exists: %v", code, core.Exists(orphan))
+	}
+	if code := runCacheCommand([]string{"prune", "-cache-dir", cacheDir}); code != 0 {
+		t.Fatalf("prune exited with %d", code)
+	}
+	if core.Exists(orphan) || core.Exists(core.InfoPath(orphan)) || !core.Exists(live) {
+		t.Error("prune didn't remove just the cache of the missing source")
+	}
+
+	// A cache locked by a running copy is not removed
+	lock, err := core.LockCache(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := runCacheCommand([]string{"rm", "-cache-dir", cacheDir, filepath.Base(live)}); code == 0 || !core.Exists(live) {
+		t.Errorf("rm of a locked cache exited with %d", code)
+	}
+	lock.Unlock()
+	if code := runCacheCommand([]string{"rm", "-cache-dir", cacheDir, filepath.Base(live)}); code != 0 || core.Exists(live) {
+		t.Errorf("rm exited with %d, cache exists: %v", code, core.Exists(live))
+	}
+}
+
+func TestFormatAge(t *testing.T) {
+	now := int64(1_000_000)
+	tests := []struct {
+		t    int64
+		want string
+	}{
+		{0, "-"},
+		{now - 59*60, "59m"},
+		{now - 3*3600, "3h"},
+		{now - 47*3600, "47h"},
+		{now - 5*86400, "5d"},
+	}
+	for _, tt := range tests {
+		if got := formatAge(now, tt.t); got != tt.want {
+			t.Errorf("formatAge(%d) = %q, want %q", now-tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestCacheVerify(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	writeFiles(t, src, map[string]string{"a": "alpha", "sub/b": "bravo", "c": "charlie"})
+	cache, err := core.NewGlobalCache(filepath.Join(dir, "cache.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := core.NewEngine(core.Options{Src: src, Dst: dst, Cache: cache, Manifest: true})
+	if _, err := engine.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cacheVerify(dst, 2); err != nil {
+		t.Fatalf("verify of an intact destination: %v", err)
+	}
+	os.WriteFile(filepath.Join(dst, "a"), []byte("alphA"), 0644)
+	os.Remove(filepath.Join(dst, "sub", "b"))
+	err = cacheVerify(dst, 2)
+	if err == nil || !strings.Contains(err.Error(), "2 of 3 files") {
+		t.Errorf("verify of a damaged destination: %v, want 2 of 3 files reported", err)
+	}
+	if err := cacheVerify(src, 2); err == nil {
+		t.Error("verify without a manifest succeeded")
+	}
+}
+
+// writeFiles creates files with the given contents below root.
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for rel, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCacheRebuild(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "caches")
+	src, dst := filepath.Join(dir, "src")+string(filepath.Separator), filepath.Join(dir, "dst")
+	files := map[string]string{"same": "same", "sub/same": "same too", "differs": "new", "resized": "longer", "missing": "m"}
+	writeFiles(t, src, files)
+	// Copied by hand or another tool, partly outdated
+	writeFiles(t, dst, map[string]string{"same": "same", "sub/same": "same too", "differs": "old", "resized": "short"})
+	os.MkdirAll(cacheDir, 0755)
+
+	if err := cacheRebuild(cacheDir, src, dst, core.BackendJSON, 2, nil, core.SymlinksFollow); err != nil {
+		t.Fatal(err)
+	}
+	path := core.LocalCacheFile(cacheDir, src, dst)
+	if info, err := core.ReadCacheInfo(path); err != nil || info.KeyFormat != core.KeyFormatPortable {
+		t.Errorf("cache info = %+v, %v", info, err)
+	}
+	cache, err := core.OpenGlobalCache(path, core.BackendJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	cache.Range(func(key string, e *core.CacheEntry) bool {
+		keys = append(keys, key)
+		if e.LastVerified == 0 || e.LastCopied != 0 {
+			t.Errorf("entry %s = %+v, want a verification and no copy", key, e)
+		}
+		return true
+	})
+	if len(keys) != 2 {
+		t.Errorf("cache has %v, want only the identical files", keys)
+	}
+
+	// The next copy only transfers what differs
+	var copied []string
+	engine := core.NewEngine(core.Options{Src: src, Dst: dst, Cache: cache, OnEvent: func(ev core.Event) {
+		if ev.Kind == core.EventFileCopied {
+			copied = append(copied, filepath.ToSlash(ev.Path))
+		}
+	}})
+	res, err := engine.Run(context.Background())
+	cache.Close()
+	if err != nil || res.Copied != 3 || res.Skipped != 2 {
+		t.Errorf("copy after rebuild copied %v: %+v, %v", copied, res, err)
+	}
+}
+
+func TestCacheRebuildWalk(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs symbolic links and POSIX permissions")
+	}
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "caches")
+	src, dst := filepath.Join(dir, "src")+string(filepath.Separator), filepath.Join(dir, "dst")
+	files := map[string]string{"a": "a", "debug.log": "log", "locked/b": "b", "sub/c": "c"}
+	writeFiles(t, src, files)
+	writeFiles(t, dst, files)
+	os.Symlink("a", filepath.Join(src, "link"))
+	os.Symlink("a", filepath.Join(dst, "link"))
+	os.MkdirAll(cacheDir, 0755)
+	filter, err := core.NewFilter(nil, []string{"*.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "link", "locked/b", "sub/c"}
+	if os.Geteuid() != 0 {
+		// An unreadable directory is skipped, not the end of the walk
+		os.Chmod(filepath.Join(src, "locked"), 0)
+		defer os.Chmod(filepath.Join(src, "locked"), 0755)
+		want = []string{"a", "link", "sub/c"}
+	}
+
+	if err := cacheRebuild(cacheDir, src, dst, core.BackendJSON, 2, filter, core.SymlinksPreserve); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := core.OpenGlobalCache(core.LocalCacheFile(cacheDir, src, dst), core.BackendJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	var keys []string
+	cache.Range(func(key string, e *core.CacheEntry) bool {
+		keys = append(keys, key)
+		if key == "link" && e.LinkTarget != "a" {
+			t.Errorf("link entry = %+v, want the link target", e)
+		}
+		return true
+	})
+	sort.Strings(keys)
+	if strings.Join(keys, " ") != strings.Join(want, " ") {
+		t.Errorf("cache has %v, want %v", keys, want)
+	}
+}
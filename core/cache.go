@@ -4,118 +4,242 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/cespare/xxhash/v2"
 )
 
 // GlobalCache manages the file copy cache, storing file metadata to avoid unnecessary copies.
+// Entries are kept in a CacheStore; callers serialize access with the embedded RWMutex.
+// Paths passed in are stored under their canonical key (see CacheKey), and
+// Range reports keys in that form.
 type GlobalCache struct {
 	sync.RWMutex
-	data map[string]*CacheEntry
-	path string
+	store CacheStore
+	path  string
+	err   error // First store error since the last save
 }
 
 // CacheEntry holds metadata about a copied file for cache validation.
 type CacheEntry struct {
-	Size    int64  // File size in bytes
-	Hash    uint64 // xxHash64 checksum of file contents
-	ModTime int64  // Last modification time (Unix timestamp)
+	Size          int64  // File size in bytes
+	Hash          uint64 // xxHash64 checksum of file contents
+	HashChunk     int64  `json:",omitempty"` // Chunk size when Hash is a chunked digest (see FileHashChunked), 0 for a whole-file hash
+	SourceModTime int64  `json:",omitempty"` // Source mtime when the entry was recorded (UnixNano)
+	LastCopied    int64  `json:",omitempty"` // When the file was last copied (Unix timestamp)
+	LastVerified  int64  `json:",omitempty"` // When the source was last hashed and found to match (Unix timestamp)
+
+	// Remaining source metadata captured when the entry was recorded. When
+	// all of it still matches, the source is trusted to be unchanged without hashing.
+	SourceCtime int64  `json:",omitempty"` // Source ctime, or creation time on Windows (UnixNano)
+	Dev         uint64 `json:",omitempty"` // Device / volume serial number
+	Inode       uint64 `json:",omitempty"` // Inode / file index
+
+	// LinkTarget is set when the entry describes a symbolic link copied as a
+	// link. Size and Hash then describe the target string.
+	LinkTarget string `json:",omitempty"`
+
+	// HardLinkTo is the key of the first file of a hard link group when the
+	// entry's destination is a hard link to that file's destination.
+	HardLinkTo string `json:",omitempty"`
+
+	// Deprecated: older versions stored the copy time here. It is moved to
+	// LastCopied when an entry is decoded.
+	ModTime int64 `json:",omitempty"`
+}
+
+// UnmarshalJSON decodes an entry and migrates fields written by older versions.
+func (e *CacheEntry) UnmarshalJSON(data []byte) error {
+	type plain CacheEntry
+	if err := json.Unmarshal(data, (*plain)(e)); err != nil {
+		return err
+	}
+	if e.ModTime != 0 {
+		if e.LastCopied == 0 {
+			e.LastCopied = e.ModTime
+		}
+		e.ModTime = 0
+	}
+	return nil
+}
+
+// LastConfirmed returns when the entry was last known to match the source,
+// by copying or by verification, or 0 if unknown. Cache age is measured from it.
+func (e *CacheEntry) LastConfirmed() int64 {
+	if e.LastVerified > e.LastCopied {
+		return e.LastVerified
+	}
+	return e.LastCopied
 }
 
-// NewGlobalCache loads or creates a cache for the given path.
-func NewGlobalCache(path string) *GlobalCache {
-	c := &GlobalCache{
-		data: make(map[string]*CacheEntry),
-		path: path,
+// FileMeta is the stat information compared against a CacheEntry by the
+// size+mtime+inode fast path. See StatMeta.
+type FileMeta struct {
+	Size    int64
+	ModTime int64 // UnixNano
+	Ctime   int64 // UnixNano
+	Dev     uint64
+	Inode   uint64
+	Nlink   uint64 // Number of hard links, not compared by MatchesMeta
+}
+
+// MatchesMeta reports whether the entry was recorded from a source file with
+// exactly the given metadata. Entries written before metadata was tracked
+// never match, so they fall back to hashing.
+func (e *CacheEntry) MatchesMeta(m FileMeta) bool {
+	return e.SourceModTime != 0 &&
+		e.Size == m.Size &&
+		e.SourceModTime == m.ModTime &&
+		e.SourceCtime == m.Ctime &&
+		e.Dev == m.Dev &&
+		e.Inode == m.Inode
+}
+
+// NewGlobalCache loads or creates a JSON-backed cache for the given path.
+func NewGlobalCache(path string) (*GlobalCache, error) {
+	return OpenGlobalCache(path, BackendJSON)
+}
+
+// NewGlobalCacheWithStore creates a cache on top of an already opened store.
+func NewGlobalCacheWithStore(path string, store CacheStore) *GlobalCache {
+	return &GlobalCache{store: store, path: path}
+}
+
+// OpenGlobalCache opens the cache at path with the named storage backend.
+func OpenGlobalCache(path, backend string) (*GlobalCache, error) {
+	store, err := OpenCacheStore(path, backend)
+	if err != nil {
+		return nil, err
+	}
+	return NewGlobalCacheWithStore(path, store), nil
+}
+
+// OpenGlobalCacheReadOnly opens the existing cache at path for reading only,
+// see OpenCacheStoreReadOnly.
+func OpenGlobalCacheReadOnly(path, backend string) (*GlobalCache, error) {
+	store, err := OpenCacheStoreReadOnly(path, backend)
+	if err != nil {
+		return nil, err
 	}
-	c.load()
-	return c
+	return NewGlobalCacheWithStore(path, store), nil
 }
 
 func timestamp() string {
 	return time.Now().Format("2006-01-02 15:04:05.000")
 }
 
-// load reads the cache file from disk, if it exists.
-func (c *GlobalCache) load() {
-	f, err := os.Open(c.path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Fprintf(os.Stderr, "[%s] [INFO] No cache file found: %s\n", timestamp(), c.path)
-		} else {
-			fmt.Fprintf(os.Stderr, "[%s] [ERROR] Error opening cache file %s: %v\n", timestamp(), c.path, err)
-		}
-		return
+// setErr remembers the first store error so the next SaveCache reports it.
+func (c *GlobalCache) setErr(err error) {
+	if err != nil && c.err == nil {
+		c.err = err
 	}
-	defer f.Close()
-	json.NewDecoder(f).Decode(&c.data)
 }
 
-// SaveCache writes the current cache data to disk in minified JSON format.
+// SaveCache persists changes made since the last save.
 func (c *GlobalCache) SaveCache() error {
 	c.Lock()
 	defer c.Unlock()
-	data, err := json.Marshal(c.data)
-	if err != nil {
-		return err
+	err := c.store.Flush()
+	if c.err != nil {
+		err, c.err = c.err, nil
 	}
-	f, err := os.Create(c.path)
-	if err != nil {
-		return err
+	return err
+}
+
+// Close writes all pending changes and releases the store.
+// The cache must not be used afterwards.
+func (c *GlobalCache) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	err := c.store.Close()
+	if c.err != nil {
+		err, c.err = c.err, nil
 	}
-	defer f.Close()
-	_, err = f.Write(data)
 	return err
 }
 
-// Update adds or updates a cache entry for a file.
-func (c *GlobalCache) Update(relPath string, size int64, hash uint64, modTime int64) {
-	c.data[relPath] = &CacheEntry{Size: size, Hash: hash, ModTime: modTime}
+// Update adds or updates a cache entry for a file copied at lastCopied.
+func (c *GlobalCache) Update(relPath string, size int64, hash uint64, lastCopied int64) {
+	c.setErr(c.store.Put(CacheKey(relPath), &CacheEntry{Size: size, Hash: hash, LastCopied: lastCopied}))
+}
+
+// UpdateWithMeta adds or updates a cache entry for a file, recording the
+// source metadata used by the fast path along with when the file was last
+// copied and last verified (Unix timestamps, 0 if never). hashChunk is the
+// chunk size of a chunked digest, 0 for a whole-file hash.
+func (c *GlobalCache) UpdateWithMeta(relPath string, meta FileMeta, hash uint64, hashChunk, lastCopied, lastVerified int64) {
+	c.setErr(c.store.Put(CacheKey(relPath), &CacheEntry{
+		Size:          meta.Size,
+		Hash:          hash,
+		HashChunk:     hashChunk,
+		SourceModTime: meta.ModTime,
+		LastCopied:    lastCopied,
+		LastVerified:  lastVerified,
+		SourceCtime:   meta.Ctime,
+		Dev:           meta.Dev,
+		Inode:         meta.Inode,
+	}))
+}
+
+// UpdateLink adds or updates the entry of a symbolic link recreated in the
+// destination at lastCopied.
+func (c *GlobalCache) UpdateLink(relPath string, meta FileMeta, target string, lastCopied int64) {
+	c.setErr(c.store.Put(CacheKey(relPath), &CacheEntry{
+		Size:          int64(len(target)),
+		Hash:          xxhash.Sum64String(target),
+		SourceModTime: meta.ModTime,
+		LastCopied:    lastCopied,
+		SourceCtime:   meta.Ctime,
+		Dev:           meta.Dev,
+		Inode:         meta.Inode,
+		LinkTarget:    target,
+	}))
+}
+
+// Put stores a complete entry for a file, e.g. one read from an export.
+func (c *GlobalCache) Put(relPath string, entry *CacheEntry) {
+	c.setErr(c.store.Put(CacheKey(relPath), entry))
 }
 
 // Remove deletes a cache entry for a file or directory.
 func (c *GlobalCache) Remove(relPath string) {
-	delete(c.data, relPath)
+	c.setErr(c.store.Delete(CacheKey(relPath)))
 }
 
 // Keys returns a slice of all cache entry keys (relative paths).
+// Prefer Range for large caches, it does not materialize every key.
 func (c *GlobalCache) Keys() []string {
-	keys := make([]string, 0, len(c.data))
-	for k := range c.data {
-		keys = append(keys, k)
-	}
+	var keys []string
+	c.Range(func(key string, _ *CacheEntry) bool {
+		keys = append(keys, key)
+		return true
+	})
 	return keys
 }
 
-// IsUpToDate checks if a cache entry exists for the given path and returns it.
-func (c *GlobalCache) IsUpToDate(relPath string) (*CacheEntry, bool) {
-	entry, ok := c.data[relPath]
-	return entry, ok
+// Range calls fn for every cache entry until fn returns false.
+// The cache must not be modified while ranging.
+func (c *GlobalCache) Range(fn func(relPath string, entry *CacheEntry) bool) {
+	c.setErr(c.store.Iterate(fn))
 }
 
-// CleanUpMissingFiles removes cache entries for files that no longer exist in the source directory.
-func (c *GlobalCache) CleanUpMissingFiles(srcDir string) {
-	c.Lock()
-	defer c.Unlock()
-	for path := range c.data {
-		absPath := filepath.Join(srcDir, path)
-		if _, err := os.Stat(absPath); os.IsNotExist(err) {
-			delete(c.data, path)
-		}
-	}
+// IsUpToDate checks if a cache entry exists for the given path and returns it.
+func (c *GlobalCache) IsUpToDate(relPath string) (*CacheEntry, bool) {
+	return c.store.Get(CacheKey(relPath))
 }
 
 // Clear removes all cache entries.
 func (c *GlobalCache) Clear() {
 	c.Lock()
 	defer c.Unlock()
-	c.data = make(map[string]*CacheEntry)
+	c.setErr(c.store.Clear())
 }
 
-func LocalCacheFile(src, dst string) string {
+// LocalCacheFile returns the cache path inside cacheDir for a source/destination pair.
+func LocalCacheFile(cacheDir, src, dst string) string {
 	absSrc, _ := filepath.Abs(src)
 	absDst, _ := filepath.Abs(dst)
 	sum := sha256.Sum256([]byte(absSrc + "|" + absDst))
@@ -131,5 +255,5 @@ func LocalCacheFile(src, dst string) string {
 	dstBase = strings.ReplaceAll(dstBase, ":", "_")
 	dstBase = strings.ReplaceAll(dstBase, " ", "_")
 
-	return fmt.Sprintf(".cache_cache_copy/%s_to_%s_%s.json", srcBase, dstBase, hash)
+	return filepath.Join(cacheDir, fmt.Sprintf("%s_to_%s_%s.json", srcBase, dstBase, hash))
 }
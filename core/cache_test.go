@@ -0,0 +1,130 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCache opens a JSON-backed cache, failing the test on error.
+func newCache(t *testing.T, path string) *GlobalCache {
+	t.Helper()
+	cache, err := NewGlobalCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestMatchesMeta(t *testing.T) {
+	meta := FileMeta{Size: 10, ModTime: 100, Ctime: 200, Dev: 1, Inode: 2, Nlink: 1}
+	tests := []struct {
+		name   string
+		change func(e *CacheEntry)
+		want   bool
+	}{
+		{"unchanged", func(e *CacheEntry) {}, true},
+		{"size", func(e *CacheEntry) { e.Size = 11 }, false},
+		{"mtime", func(e *CacheEntry) { e.SourceModTime = 101 }, false},
+		{"ctime", func(e *CacheEntry) { e.SourceCtime = 201 }, false},
+		{"device", func(e *CacheEntry) { e.Dev = 3 }, false},
+		{"inode", func(e *CacheEntry) { e.Inode = 3 }, false},
+		{"entry without metadata", func(e *CacheEntry) { *e = CacheEntry{Size: 10} }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := CacheEntry{Size: 10, SourceModTime: 100, SourceCtime: 200, Dev: 1, Inode: 2}
+			tt.change(&e)
+			if got := e.MatchesMeta(meta); got != tt.want {
+				t.Errorf("MatchesMeta() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Nlink changes with every new hard link and is not compared
+	e := CacheEntry{Size: 10, SourceModTime: 100, SourceCtime: 200, Dev: 1, Inode: 2}
+	linked := meta
+	linked.Nlink = 2
+	if !e.MatchesMeta(linked) {
+		t.Error("MatchesMeta() compares the link count")
+	}
+}
+
+func TestUpdateWithMetaMatchesStat(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := newCache(t, filepath.Join(dir, "cache.json"))
+	cache.UpdateWithMeta("f", StatMeta(path, info), 42, 0, time.Now().Unix(), 0)
+
+	entry, ok := cache.IsUpToDate("f")
+	if !ok {
+		t.Fatal("entry not stored")
+	}
+	info, _ = os.Stat(path)
+	if !entry.MatchesMeta(StatMeta(path, info)) {
+		t.Error("entry doesn't match the unchanged file")
+	}
+
+	mtime := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, _ = os.Stat(path)
+	if entry.MatchesMeta(StatMeta(path, info)) {
+		t.Error("entry still matches after the mtime changed")
+	}
+}
+
+func TestCacheEntryMigration(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want CacheEntry
+	}{
+		{"copy time in ModTime", `{"Size":1,"Hash":2,"ModTime":100}`, CacheEntry{Size: 1, Hash: 2, LastCopied: 100}},
+		{"both set", `{"ModTime":100,"LastCopied":200}`, CacheEntry{LastCopied: 200}},
+		{"current fields", `{"SourceModTime":5,"LastCopied":6,"LastVerified":7}`, CacheEntry{SourceModTime: 5, LastCopied: 6, LastVerified: 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e CacheEntry
+			if err := json.Unmarshal([]byte(tt.json), &e); err != nil {
+				t.Fatal(err)
+			}
+			if e != tt.want {
+				t.Errorf("decoded %+v, want %+v", e, tt.want)
+			}
+			out, _ := json.Marshal(&e)
+			if strings.Contains(string(out), `"ModTime"`) {
+				t.Errorf("re-encoded entry %s still has ModTime", out)
+			}
+		})
+	}
+}
+
+func TestLastConfirmed(t *testing.T) {
+	tests := []struct {
+		copied, verified, want int64
+	}{
+		{0, 0, 0},
+		{100, 0, 100},
+		{100, 200, 200},
+		{300, 200, 300},
+	}
+	for _, tt := range tests {
+		e := CacheEntry{LastCopied: tt.copied, LastVerified: tt.verified}
+		if got := e.LastConfirmed(); got != tt.want {
+			t.Errorf("LastConfirmed() with copied %d, verified %d = %d, want %d", tt.copied, tt.verified, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// LegacyCacheDir is the cache directory used before the location became
+// configurable, relative to the working directory.
+const LegacyCacheDir = ".cache_cache_copy"
+
+// CacheDirEnv names the environment variable overriding the cache directory.
+const CacheDirEnv = "CACHE_COPY_DIR"
+
+// ResolveCacheDir picks the cache directory: the --cache-dir flag value if
+// set, then $CACHE_COPY_DIR, then the per-user cache directory
+// ($XDG_CACHE_HOME or ~/.cache on Linux, %LocalAppData% on Windows).
+// The directory is created if needed.
+func ResolveCacheDir(flagValue string) (string, error) {
+	dir := flagValue
+	if dir == "" {
+		dir = os.Getenv(CacheDirEnv)
+	}
+	if dir == "" {
+		userDir, err := os.UserCacheDir()
+		if err != nil {
+			dir = LegacyCacheDir
+		} else {
+			dir = filepath.Join(userDir, "cache_copy")
+		}
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return dir, os.MkdirAll(dir, os.ModePerm)
+}
+
+// MigrateLegacyCache moves a cache from the legacy working-directory
+// location to path, if it exists there and path does not exist yet.
+// It reports whether anything was moved.
+func MigrateLegacyCache(path string) (bool, error) {
+	legacy := filepath.Join(LegacyCacheDir, filepath.Base(path))
+	absLegacy, err := filepath.Abs(legacy)
+	if err != nil || absLegacy == path || !Exists(legacy) || Exists(path) {
+		return false, err
+	}
+	for _, suffix := range []string{"", ".prev", ".journal", ".info"} {
+		if !Exists(legacy + suffix) {
+			continue
+		}
+		if err := os.Rename(legacy+suffix, path+suffix); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveCacheDir(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(tmp, "xdg"))
+	t.Setenv("HOME", filepath.Join(tmp, "home"))
+	t.Setenv("LocalAppData", filepath.Join(tmp, "appdata"))
+	userDir, err := os.UserCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		flag string
+		env  string
+		want string
+	}{
+		{"flag over env", filepath.Join(tmp, "flag"), filepath.Join(tmp, "env"), filepath.Join(tmp, "flag")},
+		{"env", "", filepath.Join(tmp, "env"), filepath.Join(tmp, "env")},
+		{"user cache dir", "", "", filepath.Join(userDir, "cache_copy")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(CacheDirEnv, tt.env)
+			got, err := ResolveCacheDir(tt.flag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ResolveCacheDir(%q) = %q, want %q", tt.flag, got, tt.want)
+			}
+			if info, err := os.Stat(got); err != nil || !info.IsDir() {
+				t.Errorf("cache directory was not created: %v", err)
+			}
+		})
+	}
+
+	t.Run("relative flag", func(t *testing.T) {
+		t.Chdir(tmp)
+		got, err := ResolveCacheDir("rel")
+		if err != nil || !filepath.IsAbs(got) || filepath.Base(got) != "rel" {
+			t.Errorf("ResolveCacheDir(rel) = %q, %v; want an absolute path", got, err)
+		}
+	})
+}
+
+func TestMigrateLegacyCache(t *testing.T) {
+	tmp := t.TempDir()
+	t.Chdir(tmp)
+	newDir := filepath.Join(tmp, "new")
+	os.MkdirAll(newDir, 0755)
+	os.MkdirAll(LegacyCacheDir, 0755)
+	for _, suffix := range []string{"", ".prev", ".journal"} {
+		os.WriteFile(filepath.Join(LegacyCacheDir, "c.json"+suffix), []byte(suffix), 0644)
+	}
+
+	path := filepath.Join(newDir, "c.json")
+	moved, err := MigrateLegacyCache(path)
+	if err != nil || !moved {
+		t.Fatalf("MigrateLegacyCache() = %v, %v; want true", moved, err)
+	}
+	for _, suffix := range []string{"", ".prev", ".journal"} {
+		if data, err := os.ReadFile(path + suffix); err != nil || string(data) != suffix {
+			t.Errorf("%s not moved: %q, %v", "c.json"+suffix, data, err)
+		}
+	}
+
+	// An existing cache at the new location is never overwritten
+	os.WriteFile(filepath.Join(LegacyCacheDir, "c.json"), []byte("legacy"), 0644)
+	if moved, err := MigrateLegacyCache(path); moved || err != nil {
+		t.Errorf("MigrateLegacyCache() = %v, %v over an existing cache", moved, err)
+	}
+	if moved, _ := MigrateLegacyCache(filepath.Join(newDir, "missing.json")); moved {
+		t.Error("MigrateLegacyCache() moved a cache that doesn't exist")
+	}
+}
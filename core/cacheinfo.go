@@ -0,0 +1,95 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CacheInfo describes which copy job a cache file belongs to. It is stored
+// next to the cache (see InfoPath) so caches can be listed and maintained
+// without knowing the original command line.
+type CacheInfo struct {
+	Src      string // Absolute source path
+	Dst      string // Absolute destination root
+	Backend  string // Storage backend, see OpenCacheStore
+	LastUsed int64  // Last run using this cache (Unix timestamp)
+
+	// KeyFormat is KeyFormatPortable once all keys are canonical. Older
+	// caches are normalized with GlobalCache.NormalizeKeys when next opened.
+	KeyFormat int `json:",omitempty"`
+}
+
+// CacheFile is a cache found in a cache directory.
+type CacheFile struct {
+	Path    string
+	Backend string
+	Info    CacheInfo
+	HasInfo bool // False for caches written before info files existed
+}
+
+// InfoPath returns the info file belonging to a cache path.
+func InfoPath(path string) string {
+	return path + ".info"
+}
+
+// WriteCacheInfo atomically stores the info for a cache.
+func WriteCacheInfo(path string, info CacheInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(InfoPath(path), data)
+}
+
+// ReadCacheInfo loads the info stored for a cache.
+func ReadCacheInfo(path string) (CacheInfo, error) {
+	var info CacheInfo
+	data, err := os.ReadFile(InfoPath(path))
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// DetectBackend guesses the backend of an existing cache from its path.
+func DetectBackend(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return BackendLSM
+	}
+	if strings.HasSuffix(path, ".db") {
+		return BackendLSM
+	}
+	return BackendJSON
+}
+
+// ListCaches returns every cache in dir, sorted by path.
+func ListCaches(dir string) ([]CacheFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var caches []CacheFile
+	for _, e := range entries {
+		name := e.Name()
+		var backend string
+		switch {
+		case e.IsDir() && strings.HasSuffix(name, ".db"):
+			backend = BackendLSM
+		case !e.IsDir() && strings.HasSuffix(name, ".json"):
+			backend = BackendJSON
+		default:
+			continue
+		}
+		cf := CacheFile{Path: filepath.Join(dir, name), Backend: backend}
+		if info, err := ReadCacheInfo(cf.Path); err == nil {
+			cf.Info, cf.HasInfo = info, true
+		}
+		caches = append(caches, cf)
+	}
+	sort.Slice(caches, func(i, j int) bool { return caches[i].Path < caches[j].Path })
+	return caches, nil
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListCaches(t *testing.T) {
+	dir := t.TempDir()
+	json := filepath.Join(dir, "a.json")
+	c := newCache(t, json)
+	c.Put("f", &CacheEntry{Hash: 1})
+	c.Close()
+	info := CacheInfo{Src: "/src", Dst: "/dst", Backend: BackendJSON, LastUsed: 100, KeyFormat: KeyFormatPortable}
+	if err := WriteCacheInfo(json, info); err != nil {
+		t.Fatal(err)
+	}
+
+	lsm := filepath.Join(dir, "b.db")
+	s := openStore(t, lsm, BackendLSM)
+	s.Close()
+	// Companion files of a cache are not caches themselves
+	os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644)
+	os.Mkdir(filepath.Join(dir, "other"), 0755)
+
+	caches, err := ListCaches(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caches) != 2 {
+		t.Fatalf("ListCaches() = %+v, want a.json and b.db", caches)
+	}
+	if c := caches[0]; c.Path != json || c.Backend != BackendJSON || !c.HasInfo || c.Info != info {
+		t.Errorf("caches[0] = %+v", c)
+	}
+	if c := caches[1]; c.Path != lsm || c.Backend != BackendLSM || c.HasInfo {
+		t.Errorf("caches[1] = %+v", c)
+	}
+}
+
+func TestDetectBackend(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "existing"), 0755)
+	tests := []struct {
+		path string
+		want string
+	}{
+		{filepath.Join(dir, "c.json"), BackendJSON},
+		{filepath.Join(dir, "c.db"), BackendLSM},
+		{filepath.Join(dir, "existing"), BackendLSM},
+	}
+	for _, tt := range tests {
+		if got := DetectBackend(tt.path); got != tt.want {
+			t.Errorf("DetectBackend(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+	if got := StorePath(filepath.Join(dir, "c.json"), BackendLSM); got != filepath.Join(dir, "c.db") {
+		t.Errorf("StorePath() = %q", got)
+	}
+}
+
+func TestRemoveCacheFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, backend := range []string{BackendJSON, BackendLSM} {
+		path := StorePath(filepath.Join(dir, "c.json"), backend)
+		s := openStore(t, path, backend)
+		s.Put("f", &CacheEntry{Hash: 1})
+		s.Close()
+		WriteCacheInfo(path, CacheInfo{Backend: backend})
+		if err := RemoveCacheFiles(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("files left after RemoveCacheFiles(): %v", entries)
+	}
+}
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Files of at least Options.ChunkThreshold bytes are copied in ranges of
+// Options.ChunkSize by several goroutines at once, so a few huge files don't
+// leave the other workers idle. Each range is hashed on its own and the
+// file's digest is the xxHash of the range hashes in order, each as 8
+// little-endian bytes. Such a digest depends on the chunk size, which is
+// recorded with it (CacheEntry.HashChunk).
+
+// combineChunkHashes returns the digest of a file from its chunk hashes.
+func combineChunkHashes(hashes []uint64) uint64 {
+	h := xxhash.New()
+	var b [8]byte
+	for _, sum := range hashes {
+		binary.LittleEndian.PutUint64(b[:], sum)
+		h.Write(b[:])
+	}
+	return h.Sum64()
+}
+
+// FileHashChunked computes the digest of a file hashed in chunks of chunk
+// bytes, or its plain xxHash (see FileHash) when chunk is 0.
+func FileHashChunked(path string, chunk int64) (uint64, error) {
+	if chunk <= 0 {
+		return FileHash(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	buf := make([]byte, 4*1024*1024)
+	var hashes []uint64
+	for {
+		n, sum, err := CopyAndHash(io.Discard, io.LimitReader(f, chunk), buf)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 && len(hashes) > 0 {
+			break
+		}
+		hashes = append(hashes, sum)
+		if n < chunk {
+			break
+		}
+	}
+	return combineChunkHashes(hashes), nil
+}
+
+// useChunked reports whether a file of size bytes is copied in chunks.
+func (e *Engine) useChunked(size int64) bool {
+	return e.opts.ChunkThreshold > 0 && size >= e.opts.ChunkThreshold && size > e.opts.ChunkSize && e.opts.Workers > 1
+}
+
+// copyChunked copies the first size bytes of src into dst with ReadAt and
+// WriteAt (pread/pwrite), one chunk per goroutine at a time. The calling
+// worker copies chunks itself and is helped by as many goroutines as free
+// chunk slots allow, at most Workers across all files. It returns the bytes
+// copied and the chunked digest; a source that shrank while copying yields
+// fewer bytes than size.
+func (e *Engine) copyChunked(ctx context.Context, dst, src *os.File, size int64, w *worker) (int64, uint64, error) {
+	chunk := e.opts.ChunkSize
+	n := int((size + chunk - 1) / chunk)
+	hashes := make([]uint64, n)
+	lengths := make([]int64, n)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var next atomic.Int64
+	var errOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	work := func(buf []byte) {
+		for {
+			i := int(next.Add(1) - 1)
+			if i >= n {
+				return
+			}
+			start := int64(i) * chunk
+			end := min(start+chunk, size)
+			h := xxhash.New()
+			pos := start
+			for pos < end {
+				if err := ctx.Err(); err != nil {
+					fail(err)
+					return
+				}
+				part := buf[:min(int64(len(buf)), end-pos)]
+				m, rerr := src.ReadAt(part, pos)
+				if m > 0 {
+					h.Write(part[:m])
+					if _, werr := dst.WriteAt(part[:m], pos); werr != nil {
+						fail(werr)
+						return
+					}
+					pos += int64(m)
+					w.moved.Add(int64(m))
+				}
+				if rerr == io.EOF {
+					break
+				}
+				if rerr != nil {
+					fail(rerr)
+					return
+				}
+			}
+			hashes[i], lengths[i] = h.Sum64(), pos-start
+		}
+	}
+
+	var wg sync.WaitGroup
+	for helpers := 1; helpers < min(n, e.opts.Workers); helpers++ {
+		select {
+		case e.chunkSlots <- struct{}{}:
+		default:
+			helpers = n // No free slot, the remaining chunks stay with this worker
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-e.chunkSlots }()
+			work(make([]byte, len(w.buf)))
+		}()
+	}
+	work(w.buf)
+	wg.Wait()
+	if firstErr != nil {
+		return 0, 0, firstErr
+	}
+
+	var written int64
+	for _, l := range lengths {
+		written += l
+	}
+	return written, combineChunkHashes(hashes), nil
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+func TestFileHashChunked(t *testing.T) {
+	data := strings.Repeat("abcdefghij", 1000) // 10000 bytes
+	path := filepath.Join(t.TempDir(), "f")
+	os.WriteFile(path, []byte(data), 0644)
+	empty := filepath.Join(t.TempDir(), "empty")
+	os.WriteFile(empty, nil, 0644)
+
+	// chunkHashes hashes s in pieces of n bytes the way copyChunked does
+	chunkHashes := func(s string, n int) []uint64 {
+		var hashes []uint64
+		for len(s) > n {
+			hashes = append(hashes, xxhash.Sum64String(s[:n]))
+			s = s[n:]
+		}
+		return append(hashes, xxhash.Sum64String(s))
+	}
+	tests := []struct {
+		name  string
+		path  string
+		chunk int64
+		want  uint64
+	}{
+		{"whole file", path, 0, xxhash.Sum64String(data)},
+		{"uneven chunks", path, 3000, combineChunkHashes(chunkHashes(data, 3000))},
+		{"even chunks", path, 2500, combineChunkHashes(chunkHashes(data, 2500))},
+		{"one chunk", path, 10000, combineChunkHashes(chunkHashes(data, 10000))},
+		{"chunk larger than file", path, 1 << 20, combineChunkHashes(chunkHashes(data, 1<<20))},
+		{"empty file", empty, 100, combineChunkHashes([]uint64{xxhash.Sum64(nil)})},
+	}
+	for _, tt := range tests {
+		got, err := FileHashChunked(tt.path, tt.chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: FileHashChunked(%d) = %x, want %x", tt.name, tt.chunk, got, tt.want)
+		}
+	}
+	if a, _ := FileHashChunked(path, 3000); a == xxhash.Sum64String(data) {
+		t.Error("chunked digest equals the whole-file hash")
+	}
+}
+
+func TestEngineChunkedCopy(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	files := map[string]string{
+		"big":   strings.Repeat("0123456789abcdef", 70_000), // 1.12 MB, 5 chunks
+		"edge":  strings.Repeat("x", 256*1024),              // Exactly one chunk, copied whole
+		"small": "small",
+	}
+	writeTree(t, src, files)
+	cache := newCache(t, filepath.Join(dir, "cache.json"))
+	opts := Options{Src: src, Dst: dst, Cache: cache, Workers: 4, ChunkThreshold: 128 * 1024, ChunkSize: 256 * 1024, BufferSize: 32 * 1024}
+	res, _ := runEngine(t, opts)
+	if res.Failed != 0 || res.CopiedBytes != int64(len(files["big"])+len(files["edge"])+len(files["small"])) {
+		t.Errorf("chunked run: %+v", res)
+	}
+	sameTree(t, dst, files)
+
+	for rel, chunk := range map[string]int64{"big": opts.ChunkSize, "edge": 0, "small": 0} {
+		e, ok := cache.IsUpToDate(rel)
+		want, _ := FileHashChunked(filepath.Join(src, rel), chunk)
+		if !ok || e.HashChunk != chunk || e.Hash != want {
+			t.Errorf("cache entry of %s = %+v, want hash %x in chunks of %d", rel, e, want, chunk)
+		}
+	}
+
+	// Validation hashes the source the same way the entry was recorded
+	opts.Validate = true
+	if res, _ := runEngine(t, opts); res.Copied != 0 {
+		t.Errorf("validating run copied %d files", res.Copied)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"1048576", 1048576, false},
+		{"0", 0, false},
+		{"512B", 512, false},
+		{"256KB", 256 * 1024, false},
+		{"4mb", 4 * 1024 * 1024, false},
+		{"1GB", 1024 * 1024 * 1024, false},
+		{"4TB", 0, true},
+		{"MB", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// CopyMethod selects how file data is moved from source to destination.
+type CopyMethod int
+
+const (
+	CopyAuto      CopyMethod = iota // Fastest path that works for the file pair
+	CopyReflink                     // Share the source extents (FICLONE on btrfs, XFS)
+	CopyFileRange                   // copy_file_range, data stays in the kernel
+	CopySendfile                    // sendfile, data stays in the kernel
+	CopyBuffered                    // Read and write through --buffer-size
+)
+
+var copyMethodNames = []string{"auto", "reflink", "copy_file_range", "sendfile", "buffered"}
+
+// ParseCopyMethod parses a --copy-method value.
+func ParseCopyMethod(s string) (CopyMethod, error) {
+	for i, name := range copyMethodNames {
+		if strings.EqualFold(s, name) {
+			return CopyMethod(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown --copy-method %q (want auto, reflink, copy_file_range, sendfile or buffered)", s)
+}
+
+func (m CopyMethod) String() string {
+	if m >= 0 && int(m) < len(copyMethodNames) {
+		return copyMethodNames[m]
+	}
+	return fmt.Sprintf("CopyMethod(%d)", int(m))
+}
+
+// errCopyUnsupported is returned by a kernel copy path that can't be used
+// for a file pair. Nothing has been written to the destination in that case.
+var errCopyUnsupported = errors.New("not supported for this file pair")
+
+// copyData copies src into the empty temp file dst and returns the bytes
+// copied, the hash of the source and its chunk size (0 for a whole-file
+// hash). Only the buffered, sparse and chunked paths see the data, for the
+// others the source is read a second time to hash it. With CopyAuto that is
+// only worth it after a reflink, which copies nothing: copy_file_range and
+// sendfile are tried when no hash is needed (no cache and no VerifyCopy),
+// otherwise the buffered loop copies and hashes in one pass. A forced method
+// that can't be used is an error.
+func (e *Engine) copyData(ctx context.Context, dst, src *os.File, srcInfo os.FileInfo, relPath string, w *worker) (int64, uint64, int64, error) {
+	method := e.opts.CopyMethod
+	needHash := e.opts.Cache != nil || e.opts.VerifyCopy
+	kernel := []struct {
+		method CopyMethod
+		copy   func() (int64, error)
+	}{
+		{CopyReflink, func() (int64, error) { return reflinkFile(dst, src, &w.moved) }},
+		{CopyFileRange, func() (int64, error) { return copyFileRange(ctx, dst, src, &w.moved) }},
+		{CopySendfile, func() (int64, error) { return sendFile(ctx, dst, src, &w.moved) }},
+	}
+	sparse := e.opts.Sparse && isSparse(srcInfo)
+	chunked := e.useChunked(srcInfo.Size())
+	for _, k := range kernel {
+		if method != CopyAuto && method != k.method {
+			continue
+		}
+		if method == CopyAuto && (sparse || chunked || needHash) && k.method != CopyReflink {
+			// copy_file_range and sendfile may allocate the holes, can't
+			// spread a large file over several workers and would make
+			// hashing read the source twice
+			break
+		}
+		written, err := k.copy()
+		if errors.Is(err, errCopyUnsupported) && method == CopyAuto {
+			continue
+		}
+		if err != nil {
+			return written, 0, 0, fmt.Errorf("%s: %w", k.method, err)
+		}
+		if e.opts.Verbose >= 3 {
+			e.logf("[%s] [COPY] Copied with %s: %s\n", timestamp(), k.method, relPath)
+		}
+		if !needHash {
+			return written, 0, 0, nil
+		}
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return written, 0, 0, err
+		}
+		_, hash, err := CopyAndHash(io.Discard, ctxReader{ctx, src}, w.buf)
+		return written, hash, 0, err
+	}
+	buffered := method == CopyAuto || method == CopyBuffered
+
+	if sparse && buffered {
+		written, hash, ok, err := copySparse(ctx, dst, src, srcInfo.Size(), w.buf, &w.moved)
+		if ok {
+			if err == nil && e.opts.Verbose >= 3 {
+				e.logf("[%s] [SPARSE] Copied data extents only: %s\n", timestamp(), relPath)
+			}
+			return written, hash, 0, err
+		}
+	}
+	if chunked && buffered {
+		written, hash, err := e.copyChunked(ctx, dst, src, srcInfo.Size(), w)
+		if err == nil && e.opts.Verbose >= 3 {
+			e.logf("[%s] [COPY] Copied in %d byte chunks: %s\n", timestamp(), e.opts.ChunkSize, relPath)
+		}
+		return written, hash, e.opts.ChunkSize, err
+	}
+	// Hash while copying so the source is read only once
+	written, hash, err := CopyAndHash(progressWriter{dst, &w.moved}, ctxReader{ctx, src}, w.buf)
+	return written, hash, 0, err
+}
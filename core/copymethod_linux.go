@@ -0,0 +1,81 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// kernelCopySupported reports whether the kernel copy methods exist here.
+const kernelCopySupported = true
+
+// kernelChunk is how much a single copy_file_range or sendfile call moves,
+// so cancellation is noticed between calls.
+const kernelChunk = 64 * 1024 * 1024
+
+// unsupportedCopy reports whether err from a first kernel copy call means
+// the method can't be used for the file pair, e.g. across file systems.
+func unsupportedCopy(err error) bool {
+	return errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) ||
+		errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EBADF)
+}
+
+// reflinkFile makes dst share the data extents of src. It only works
+// within one file system that supports it (btrfs, XFS).
+func reflinkFile(dst, src *os.File, moved *atomic.Int64) (int64, error) {
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err != nil {
+		if unsupportedCopy(err) {
+			return 0, errCopyUnsupported
+		}
+		return 0, err
+	}
+	info, err := dst.Stat()
+	if err != nil {
+		return 0, err
+	}
+	moved.Add(info.Size())
+	return info.Size(), nil
+}
+
+// copyFileRange copies src to dst with copy_file_range until EOF.
+func copyFileRange(ctx context.Context, dst, src *os.File, moved *atomic.Int64) (int64, error) {
+	return kernelLoop(ctx, moved, func() (int, error) {
+		return unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, kernelChunk, 0)
+	})
+}
+
+// sendFile copies src to dst with sendfile until EOF.
+func sendFile(ctx context.Context, dst, src *os.File, moved *atomic.Int64) (int64, error) {
+	return kernelLoop(ctx, moved, func() (int, error) {
+		return unix.Sendfile(int(dst.Fd()), int(src.Fd()), nil, kernelChunk)
+	})
+}
+
+// kernelLoop repeats a kernel copy call until it reports EOF, adding the
+// bytes copied to moved.
+func kernelLoop(ctx context.Context, moved *atomic.Int64, call func() (int, error)) (int64, error) {
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, err := call()
+		if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		}
+		if err != nil {
+			if written == 0 && unsupportedCopy(err) {
+				return 0, errCopyUnsupported
+			}
+			return written, err
+		}
+		if n == 0 {
+			return written, nil
+		}
+		written += int64(n)
+		moved.Add(int64(n))
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package core
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+)
+
+// kernelCopySupported reports whether the kernel copy methods exist here.
+const kernelCopySupported = false
+
+func reflinkFile(dst, src *os.File, moved *atomic.Int64) (int64, error) {
+	return 0, errCopyUnsupported
+}
+
+func copyFileRange(ctx context.Context, dst, src *os.File, moved *atomic.Int64) (int64, error) {
+	return 0, errCopyUnsupported
+}
+
+func sendFile(ctx context.Context, dst, src *os.File, moved *atomic.Int64) (int64, error) {
+	return 0, errCopyUnsupported
+}
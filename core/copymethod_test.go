@@ -0,0 +1,76 @@
+package core
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCopyMethod(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    CopyMethod
+		wantErr bool
+	}{
+		{"auto", CopyAuto, false},
+		{"reflink", CopyReflink, false},
+		{"COPY_FILE_RANGE", CopyFileRange, false},
+		{"sendfile", CopySendfile, false},
+		{"buffered", CopyBuffered, false},
+		{"copy-file-range", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCopyMethod(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseCopyMethod(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestEngineCopyMethods(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	files := map[string]string{
+		"empty": "",
+		"small": "small",
+		"large": strings.Repeat("0123456789", 300_000),
+	}
+	writeTree(t, src, files)
+
+	for _, method := range []CopyMethod{CopyAuto, CopyBuffered, CopyReflink, CopyFileRange, CopySendfile} {
+		for _, withCache := range []bool{true, false} {
+			name := method.String()
+			if !withCache {
+				name += "/no cache"
+			}
+			t.Run(name, func(t *testing.T) {
+				dst := filepath.Join(t.TempDir(), "dst")
+				opts := Options{Src: src, Dst: dst, CopyMethod: method, BufferSize: 64 * 1024}
+				if withCache {
+					opts.Cache = newCache(t, filepath.Join(t.TempDir(), "cache.json"))
+				}
+				res, events := runEngine(t, opts)
+				if res.Failed > 0 {
+					if method == CopyReflink {
+						t.Skipf("file system can't reflink: %v", res.Failures[0])
+					}
+					t.Fatalf("copy failed: %v", res.Failures[0])
+				}
+				sameTree(t, dst, files)
+				for _, ev := range events {
+					if ev.Kind != EventFileCopied || !withCache {
+						continue
+					}
+					want, _ := FileHash(filepath.Join(src, ev.Path))
+					if ev.Hash != want {
+						t.Errorf("%s copied with hash %x, want %x", ev.Path, ev.Hash, want)
+					}
+					if e, ok := opts.Cache.IsUpToDate(ev.Path); !ok || e.Hash != want {
+						t.Errorf("cache entry of %s = %+v, want hash %x", ev.Path, e, want)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,944 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configures an Engine.
+type Options struct {
+	Src string // Source directory
+	Dst string // Destination root, the contents of Src are copied into it (see DestinationRoot)
+
+	Cache       *GlobalCache  // Cache consulted and updated during the run, nil to copy every file
+	Workers     int           // Number of files copied concurrently (default: GOMAXPROCS)
+	BufferSize  int           // Copy buffer per worker in bytes (default: 4 MB)
+	Validate    bool          // Compare source and destination by size and hash instead of trusting the cache
+	Strict      bool          // Hash sources even when their metadata matches the cache
+	VerifyCopy  bool          // Read back every copied file and compare its hash with the source
+	Mirror      bool          // Delete destination files that are not in the source
+	AutoClean   bool          // Remove cache entries of files that are no longer in the source
+	MaxCacheAge time.Duration // Drop cache entries not copied or verified for this long, 0 keeps them
+	Manifest    bool          // Resume from and write the destination manifest (requires Cache)
+	Preserve    PreserveFlags // Source metadata applied to copied files and directories
+	Symlinks    SymlinkMode   // Handling of symbolic links in the source (default: follow)
+	HardLinks   bool          // Recreate hard links between source files instead of copying each
+	Sparse      bool          // Keep holes of sparse source files unallocated in the destination (Linux)
+	CopyMethod  CopyMethod    // How file data is copied (default: auto)
+	Retry       RetryPolicy   // Retries of file operations (default: DefaultRetryPolicy)
+	Retries     int           // Passes over failed files after the main pass
+	FileTimeout time.Duration // Give up on a file that takes longer than this, 0 for no limit
+	StopOnError bool          // Stop the run at the first file that fails instead of continuing
+	Filter      *Filter       // Source paths left out of the copy, nil for none (ignore files still apply)
+	Verbose     int           // Detail of EventLog messages, same levels as the --verbose flag
+
+	// Files of at least ChunkThreshold bytes are copied in ChunkSize ranges
+	// by several goroutines at once. 0 disables chunked copying.
+	ChunkThreshold int64
+	ChunkSize      int64 // Default: 64 MB
+
+	// OnEvent receives the events of a run. Calls are serialized, and a slow
+	// handler slows down the copy. May be nil.
+	OnEvent func(Event)
+}
+
+// EventKind identifies the type of an Event.
+type EventKind int
+
+const (
+	EventLog         EventKind = iota // Message holds a formatted log line
+	EventFileStarted                  // Path is about to be copied
+	EventFileCopied                   // Path was copied, Hash holds its content hash (0 if it wasn't needed)
+	EventFileSkipped                  // Path is unchanged and was not copied
+	EventFileFailed                   // Path could not be processed, see Err
+	EventProgress                     // Bytes of TotalBytes have been processed, sent about every 100 ms
+)
+
+// Event reports the progress of an Engine run. Which fields are set depends on Kind.
+type Event struct {
+	Kind       EventKind
+	Path       string // Path relative to the source directory
+	Size       int64  // File size in bytes
+	Hash       uint64 // Content hash (EventFileCopied)
+	Err        error  // Failure (EventFileFailed)
+	Message    string // Log line including timestamp and level (EventLog)
+	Bytes      int64  // Bytes processed so far, skipped files and the copied part of files in progress included (EventProgress)
+	TotalBytes int64  // Total bytes of all source files (EventProgress)
+}
+
+// Result summarizes an Engine run.
+type Result struct {
+	Files       int   // Source files found
+	Copied      int   // Files copied
+	Skipped     int   // Files left untouched because they were unchanged
+	Failed      int   // Files that could not be processed, see Failures
+	CopiedBytes int64 // Bytes written to the destination
+	TotalBytes  int64 // Total size of all source files
+	Duration    time.Duration
+	Failures    []*FileError // Files that could not be processed, after retries
+}
+
+// Engine copies a source directory into a destination using the cache to
+// skip unchanged files. It is the library behind the cache_copy command.
+type Engine struct {
+	opts       Options
+	emitMu     sync.Mutex
+	chunkSlots chan struct{} // Helper goroutines of chunked copies, shared by all files
+	stop       chan struct{} // Closed by Stop
+	stopOnce   sync.Once
+	ignores    map[string][]filterRule // Rules of the source's ignore files by directory, see ignoreRules
+}
+
+// ErrStopped is returned by Run when Stop ended the run before every file
+// was processed.
+var ErrStopped = errors.New("stopped before all files were processed")
+
+// NewEngine creates an engine, filling in defaults for unset options.
+func NewEngine(opts Options) *Engine {
+	if opts.Workers < 1 {
+		opts.Workers = runtime.GOMAXPROCS(0)
+	}
+	if opts.BufferSize < 1 {
+		opts.BufferSize = 4 * 1024 * 1024
+	}
+	if opts.Retry.Attempts < 1 {
+		opts.Retry = DefaultRetryPolicy()
+	}
+	if opts.ChunkSize < 1 {
+		opts.ChunkSize = 64 * 1024 * 1024
+	}
+	if opts.Cache == nil {
+		opts.Manifest = false
+	}
+	return &Engine{opts: opts, chunkSlots: make(chan struct{}, opts.Workers), stop: make(chan struct{})}
+}
+
+// DestinationRoot returns the directory the source is copied into. If src
+// ends with a path separator its contents go directly into dst, otherwise
+// the source directory itself is copied as dst/<base of src>.
+func DestinationRoot(src, dst string) string {
+	if (runtime.GOOS == "windows" && strings.HasSuffix(src, `\`)) ||
+		(runtime.GOOS != "windows" && strings.HasSuffix(src, `/`)) {
+		return dst
+	}
+	return filepath.Join(dst, filepath.Base(filepath.Clean(src)))
+}
+
+func (e *Engine) emit(ev Event) {
+	if e.opts.OnEvent == nil {
+		return
+	}
+	e.emitMu.Lock()
+	defer e.emitMu.Unlock()
+	e.opts.OnEvent(ev)
+}
+
+// Stop ends a run gracefully, e.g. on Ctrl-C: no further files are started,
+// the files being copied are finished and Run returns ErrStopped once the
+// cache is saved. Running again copies the remaining files. Stop may be
+// called from any goroutine and more than once; cancel the context passed
+// to Run to abandon the files in progress as well.
+func (e *Engine) Stop() {
+	e.stopOnce.Do(func() { close(e.stop) })
+}
+
+// stopped reports whether Stop was called.
+func (e *Engine) stopped() bool {
+	select {
+	case <-e.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// logf emits an EventLog message.
+func (e *Engine) logf(format string, args ...interface{}) {
+	e.emit(Event{Kind: EventLog, Message: fmt.Sprintf(format, args...)})
+}
+
+// Run performs the copy: mirror deletion and cache maintenance first, then
+// the walk of the source and the parallel copy, and finally the destination
+// manifest. Files that fail are retried (Options.Retries), then reported and
+// listed in Result.Failures while the run goes on; with StopOnError, or when
+// the destination is full, the failure stops the run and its *FileError is
+// returned. Other failures stop the run and are returned. When ctx is
+// cancelled no new files are started, copies in progress are abandoned and
+// ctx.Err() is returned. See Stop for ending a run gracefully.
+// The cache is saved but not closed.
+func (e *Engine) Run(ctx context.Context) (Result, error) {
+	start := time.Now()
+	var res Result
+	err := e.run(ctx, &res)
+	if cache := e.opts.Cache; cache != nil {
+		if saveErr := cache.SaveCache(); err == nil && saveErr != nil {
+			err = fmt.Errorf("failed to save cache: %w", saveErr)
+		}
+		if e.opts.Manifest {
+			if n, mErr := WriteManifest(e.opts.Dst, cache); mErr != nil {
+				e.logf("[%s] [ERROR] Failed to write destination manifest: %v\n", timestamp(), mErr)
+			} else {
+				e.logf("[%s] [INFO] Wrote destination manifest with %d files: %s\n", timestamp(), n, ManifestPath(e.opts.Dst))
+			}
+		}
+	}
+	res.Duration = time.Since(start)
+	return res, err
+}
+
+func (e *Engine) run(ctx context.Context, res *Result) error {
+	src, rootDst, cache := e.opts.Src, e.opts.Dst, e.opts.Cache
+
+	if unsupported := e.opts.Preserve & unsupportedPreserve; unsupported != 0 {
+		e.logf("[%s] [WARN] Preserving %s is not supported on %s, ignored\n", timestamp(), unsupported, runtime.GOOS)
+		e.opts.Preserve &^= unsupported
+	}
+	if !kernelCopySupported && e.opts.CopyMethod != CopyAuto && e.opts.CopyMethod != CopyBuffered {
+		e.logf("[%s] [WARN] Copy method %s is not supported on %s, using buffered\n", timestamp(), e.opts.CopyMethod, runtime.GOOS)
+		e.opts.CopyMethod = CopyBuffered
+	}
+
+	// Stop cuts the preparation short, nothing has been copied yet
+	prepCtx, cancelPrep := context.WithCancel(ctx)
+	defer cancelPrep()
+	go func() {
+		select {
+		case <-e.stop:
+			cancelPrep()
+		case <-prepCtx.Done():
+		}
+	}()
+
+	// Optionally mirror (delete extra files in destination)
+	if e.opts.Mirror {
+		if err := os.MkdirAll(rootDst, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create root destination directory %s: %w", rootDst, err)
+		}
+		if err := e.deleteExtraFiles(); err != nil {
+			if errors.Is(err, ErrStopped) {
+				return ErrStopped
+			}
+			return err
+		}
+		if cache != nil {
+			cache.SaveCache()
+		}
+	}
+
+	if cache != nil && e.opts.MaxCacheAge > 0 {
+		e.pruneOldEntries()
+	}
+
+	// Resume from the destination manifest when this cache doesn't know the files yet
+	if e.opts.Manifest && Exists(ManifestPath(rootDst)) {
+		seeded, err := SeedFromManifest(rootDst, cache)
+		if err != nil {
+			e.logf("[%s] [WARN] Failed to read destination manifest %s: %v\n", timestamp(), ManifestPath(rootDst), err)
+		} else if seeded > 0 {
+			e.logf("[%s] [INFO] Seeded %d cache entries from destination manifest\n", timestamp(), seeded)
+		}
+		cache.SaveCache()
+	}
+
+	// Gather all directories and files (relative paths) from the source directory
+	dirs, fileList, err := e.walkSource(prepCtx, false)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if e.stopped() {
+			return ErrStopped
+		}
+		return fmt.Errorf("error gathering file list: %w", err)
+	}
+	res.Files = len(fileList)
+
+	if cache != nil && e.opts.AutoClean {
+		e.cleanStaleEntries(fileList)
+	}
+
+	var links map[string]string
+	if e.opts.HardLinks {
+		if hardLinksSupported {
+			links = e.findHardLinks(fileList)
+		} else {
+			e.logf("[%s] [WARN] Hard link detection is not supported on %s, linked files are copied\n", timestamp(), runtime.GOOS)
+		}
+	}
+
+	// Calculate total bytes to copy for progress, hard links need no copying
+	for _, relPath := range fileList {
+		if _, ok := links[relPath]; ok {
+			continue
+		}
+		if info, err := e.statSource(filepath.Join(src, relPath)); err == nil {
+			res.TotalBytes += info.Size()
+		}
+	}
+
+	// Ensure all destination directories exist. A directory made read-only by
+	// --preserve=mode on an earlier run can't take the temp files of changed
+	// files, so it is writable until the metadata pass below, or until the
+	// run ends, whichever comes first.
+	readOnly := make(map[string]os.FileMode)
+	defer func() {
+		for dstDir, mode := range readOnly {
+			os.Chmod(dstDir, mode)
+		}
+	}()
+	for _, relDir := range dirs {
+		dstDir := filepath.Join(rootDst, relDir)
+		if err := os.MkdirAll(dstDir, os.ModePerm); err != nil {
+			e.logf("[%s] [ERROR] Failed to create directory %s: %v\n", timestamp(), dstDir, err)
+			continue
+		}
+		if e.opts.Preserve&PreserveMode != 0 {
+			if info, err := os.Stat(dstDir); err == nil && info.Mode().Perm()&0200 == 0 {
+				mode := info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+				if err := os.Chmod(dstDir, mode|0200); err != nil {
+					e.logf("[%s] [WARN] Failed to make directory %s writable: %v\n", timestamp(), dstDir, err)
+				} else {
+					readOnly[dstDir] = mode
+				}
+			}
+		}
+		// Temp files of an interrupted run are never completed, drop them
+		if n, err := RemoveStaleTemps(dstDir); err != nil {
+			e.logf("[%s] [WARN] Failed to remove stale temp files in %s: %v\n", timestamp(), dstDir, err)
+		} else if n > 0 && e.opts.Verbose >= 1 {
+			e.logf("[%s] [INFO] Removed %d stale temp file(s) in %s\n", timestamp(), n, dstDir)
+		}
+	}
+
+	if e.stopped() {
+		return ErrStopped
+	}
+	if err := e.copyFiles(ctx, fileList, links, res); err != nil {
+		return err
+	}
+
+	// Directory metadata goes last: writing children changes directory
+	// mtimes, and a read-only mode would block them. Walk order is parents
+	// first, so go backwards.
+	if e.opts.Preserve != 0 {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			srcDir := filepath.Join(src, dirs[i])
+			dstDir := filepath.Join(rootDst, dirs[i])
+			info, err := os.Stat(srcDir)
+			if err != nil {
+				continue
+			}
+			if err := applyPreserved(srcDir, dstDir, info, e.opts.Preserve); err != nil {
+				e.logf("[%s] [WARN] Failed to preserve metadata of %s: %v\n", timestamp(), dstDir, err)
+			} else {
+				delete(readOnly, dstDir)
+			}
+		}
+	}
+	return nil
+}
+
+// pruneOldEntries removes entries not confirmed within MaxCacheAge, and
+// clears the cache entirely when every entry is too old.
+func (e *Engine) pruneOldEntries() {
+	cache := e.opts.Cache
+	now := time.Now().Unix()
+	maxAgeSeconds := int64(e.opts.MaxCacheAge / time.Second)
+	cache.Lock()
+	expiredKeys := []string{}
+	cache.Range(func(key string, entry *CacheEntry) bool {
+		if last := entry.LastConfirmed(); last > 0 && now-last > maxAgeSeconds {
+			expiredKeys = append(expiredKeys, key)
+		}
+		return true
+	})
+	for _, key := range expiredKeys {
+		cache.Remove(key)
+	}
+	cache.Unlock()
+	cache.SaveCache()
+
+	// If all cache entries are old, delete the cache file
+	allOld := true
+	hasEntries := false
+	cache.Lock()
+	cache.Range(func(key string, entry *CacheEntry) bool {
+		hasEntries = true
+		if last := entry.LastConfirmed(); last > 0 && now-last <= maxAgeSeconds {
+			allOld = false
+			return false
+		}
+		return true
+	})
+	cache.Unlock()
+	if allOld && hasEntries {
+		e.logf("[%s] [INFO] All cache entries older than %s, clearing cache file: %s\n", timestamp(), e.opts.MaxCacheAge, cache.path)
+		cache.Clear()
+		cache.SaveCache()
+	}
+}
+
+// cleanStaleEntries removes cache entries for files that are not in
+// fileList. Entries are matched against the walked keys rather than stat'ed,
+// so names stored decomposed on disk still find their normalized entry.
+// Only entries missing from fileList are stat'ed: those of files left out by
+// a filter are kept while the file is still in the source.
+func (e *Engine) cleanStaleEntries(fileList []string) {
+	cache := e.opts.Cache
+	present := make(map[string]struct{}, len(fileList))
+	for _, relPath := range fileList {
+		present[CacheKey(relPath)] = struct{}{}
+	}
+	cache.Lock()
+	staleCacheKeys := []string{}
+	cache.Range(func(key string, _ *CacheEntry) bool {
+		if _, ok := present[key]; !ok {
+			if _, err := os.Lstat(filepath.Join(e.opts.Src, KeyPath(key))); err != nil {
+				staleCacheKeys = append(staleCacheKeys, key)
+			}
+		}
+		return true
+	})
+	for _, staleKey := range staleCacheKeys {
+		if e.opts.Verbose >= 3 {
+			e.logf("[CACHE] Removing stale entry: %s\n", staleKey)
+		}
+		cache.Remove(staleKey)
+	}
+	cache.Unlock()
+
+	if len(staleCacheKeys) > 0 {
+		if e.opts.Verbose >= 1 {
+			e.logf("[%s] [INFO] Auto-cleaned %d stale cache entries\n", timestamp(), len(staleCacheKeys))
+		}
+		cache.SaveCache()
+	}
+}
+
+// deleteExtraFiles removes files and directories from the destination that do not exist in the source.
+// Paths excluded by Options.Filter or an ignore file are kept, as are the directories holding them.
+func (e *Engine) deleteExtraFiles() error {
+	srcDir, dstDir := e.opts.Src, e.opts.Dst
+	var deletedDirs = make(map[string]bool)
+	err := filepath.Walk(dstDir, func(dstPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.stopped() {
+			return ErrStopped
+		}
+		if !Exists(dstPath) {
+			return nil
+		}
+		relPath, _ := filepath.Rel(dstDir, dstPath)
+		if info.IsDir() && relPath == ManifestDir {
+			return filepath.SkipDir
+		}
+		// Filtered out paths are not part of the copy, leave them alone
+		if relPath != "." && (e.filtered(relPath, info.IsDir()) || e.opts.Filter.outsideLimits(info)) {
+			for dir := filepath.Dir(dstPath); dir != dstDir && dir != "."; dir = filepath.Dir(dir) {
+				if deletedDirs[dir] {
+					e.logf("[%s] [INFO] Keeping directory %s, it holds filtered out %s\n", timestamp(), dir, dstPath)
+					delete(deletedDirs, dir)
+				}
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		srcPath := filepath.Join(srcDir, relPath)
+		_, err = os.Lstat(srcPath)
+		if os.IsNotExist(err) {
+			if info.IsDir() {
+				e.logf("[%s] [INFO] Marking directory for deletion: %s\n", timestamp(), dstPath)
+				deletedDirs[dstPath] = true
+			} else {
+				e.logf("[%s] [INFO] Deleting extra file: %s\n", timestamp(), dstPath)
+				if err := os.Remove(dstPath); err != nil {
+					return fmt.Errorf("failed to delete file %s: %w", dstPath, err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting extra files: %w", err)
+	}
+	for dir := range deletedDirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("error deleting extra files: failed to delete directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// statSource stats a source file. Links are reported as links only when
+// they are preserved, otherwise they are followed.
+func (e *Engine) statSource(path string) (os.FileInfo, error) {
+	if e.opts.Symlinks == SymlinksPreserve {
+		return os.Lstat(path)
+	}
+	return os.Stat(path)
+}
+
+// ctxReader fails reads once its context is done, so a cancelled run
+// abandons large copies instead of finishing them.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// copyFiles runs the worker pool over fileList. Files in links, which maps
+// later members of a hard link group to the first one, are linked in a
+// second pass once the first members have been copied. Files that fail are
+// retried in up to Options.Retries further passes; those that still fail end
+// up in res.Failures. A failure stops the run when StopOnError is set or the
+// destination is full. After Stop the files in progress are finished and
+// ErrStopped is returned if any file was left out.
+func (e *Engine) copyFiles(parent context.Context, fileList []string, links map[string]string, res *Result) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	var mu sync.Mutex // Guards res, processedBytes, workers, retry, fatalErr and leftOut
+	var processedBytes int64
+	var workers []*worker
+	var retry []string
+	var fatalErr error
+	leftOut := false // Files were not processed because of Stop
+
+	process := func(ctx context.Context, relPath string, w *worker) (int64, bool, int64, error) {
+		if leader, ok := links[relPath]; ok {
+			return e.linkFile(ctx, relPath, leader, w)
+		}
+		return e.copyFile(ctx, relPath, w)
+	}
+	// failed records the failure of a file. Unless it is the last pass the
+	// file is retried later, except for vanished files which won't come back.
+	failed := func(relPath string, err error, last bool) {
+		fe := &FileError{Path: relPath, Kind: classifyFailure(filepath.Join(e.opts.Src, relPath), err), Err: err}
+		fatal := e.opts.StopOnError || fe.Kind == FailureNoSpace
+		mu.Lock()
+		if !fatal && !last && fe.Kind != FailureVanished {
+			retry = append(retry, relPath)
+			mu.Unlock()
+			e.logf("[%s] [WARN] %v (will retry)\n", timestamp(), err)
+			return
+		}
+		res.Failures = append(res.Failures, fe)
+		res.Failed++
+		if fatal && fatalErr == nil {
+			fatalErr = fe
+		}
+		mu.Unlock()
+		e.emit(Event{Kind: EventFileFailed, Path: relPath, Err: fe})
+		if fatal {
+			cancel()
+		}
+	}
+
+	runPool := func(list []string, last bool) {
+		var wg sync.WaitGroup
+		fileChan := make(chan string)
+		for i := 0; i < e.opts.Workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := &worker{buf: make([]byte, e.opts.BufferSize)}
+				mu.Lock()
+				workers = append(workers, w)
+				mu.Unlock()
+				for relPath := range fileChan {
+					if ctx.Err() != nil {
+						continue
+					}
+					if e.stopped() {
+						mu.Lock()
+						leftOut = true
+						mu.Unlock()
+						continue
+					}
+					fctx, fcancel := ctx, context.CancelFunc(func() {})
+					if e.opts.FileTimeout > 0 {
+						fctx, fcancel = context.WithTimeout(ctx, e.opts.FileTimeout)
+					}
+					size, copied, written, err := process(fctx, relPath, w)
+					if err != nil && ctx.Err() == nil && errors.Is(fctx.Err(), context.DeadlineExceeded) {
+						err = fmt.Errorf("gave up on %s after %s: %w", filepath.Join(e.opts.Src, relPath), e.opts.FileTimeout, fctx.Err())
+					}
+					fcancel()
+					mu.Lock()
+					w.moved.Store(0)
+					if err == nil {
+						if copied {
+							res.Copied++
+							res.CopiedBytes += written
+						} else {
+							res.Skipped++
+						}
+						processedBytes += size
+					}
+					mu.Unlock()
+					if err != nil && ctx.Err() == nil {
+						// Errors after cancellation come from abandoned copies, not from the file
+						failed(relPath, err, last)
+					}
+				}
+			}()
+		}
+
+		for _, relPath := range list {
+			if ctx.Err() != nil {
+				break
+			}
+			if e.stopped() {
+				mu.Lock()
+				leftOut = true
+				mu.Unlock()
+				break
+			}
+			fileChan <- relPath
+		}
+		close(fileChan)
+		wg.Wait()
+	}
+
+	// Report the completed files plus what the workers have copied of the
+	// files in progress, so large files advance smoothly
+	report := func() {
+		mu.Lock()
+		bytes, total := processedBytes, res.TotalBytes
+		for _, w := range workers {
+			bytes += w.moved.Load()
+		}
+		mu.Unlock()
+		e.emit(Event{Kind: EventProgress, Bytes: min(bytes, total), TotalBytes: total})
+	}
+	stopReports := make(chan struct{})
+	reportsDone := make(chan struct{})
+	go func() {
+		defer close(reportsDone)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopReports:
+				return
+			case <-ticker.C:
+				report()
+			}
+		}
+	}()
+
+	var primary, followers []string
+	for _, relPath := range fileList {
+		if _, ok := links[relPath]; ok {
+			followers = append(followers, relPath)
+		} else {
+			primary = append(primary, relPath)
+		}
+	}
+	runPool(primary, e.opts.Retries == 0)
+	if len(followers) > 0 && ctx.Err() == nil {
+		runPool(followers, e.opts.Retries == 0)
+	}
+	for attempt := 1; attempt <= e.opts.Retries && len(retry) > 0 && ctx.Err() == nil && !e.stopped(); attempt++ {
+		// Leaders first, so hard links retried in the same pass find their file
+		list := retry
+		retry = nil
+		sort.SliceStable(list, func(i, j int) bool {
+			_, iLink := links[list[i]]
+			_, jLink := links[list[j]]
+			return !iLink && jLink
+		})
+		// Give a flaky mount time to recover before going over the files again
+		wait := e.opts.Retry.Backoff(attempt)
+		e.logf("[%s] [INFO] Retrying %d failed file(s) in %s, attempt %d of %d\n", timestamp(), len(list), wait.Round(time.Millisecond), attempt, e.opts.Retries)
+		select {
+		case <-ctx.Done():
+		case <-e.stop:
+		case <-time.After(wait):
+		}
+		runPool(list, attempt == e.opts.Retries)
+	}
+	close(stopReports)
+	<-reportsDone
+	report()
+
+	if fatalErr != nil {
+		return fatalErr
+	}
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	if leftOut || len(retry) > 0 {
+		// Stopped with files not yet copied, or failed files not yet retried
+		return ErrStopped
+	}
+	return nil
+}
+
+// copyFile brings a single file up to date. It returns the source size,
+// whether the file was copied and how many bytes were written.
+func (e *Engine) copyFile(ctx context.Context, relPath string, w *worker) (int64, bool, int64, error) {
+	cache := e.opts.Cache
+	verbose := e.opts.Verbose
+	logger := e.logf
+	srcPath := filepath.Join(e.opts.Src, relPath)
+	dstPath := filepath.Join(e.opts.Dst, relPath)
+
+	srcInfo, err := e.statSource(srcPath)
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok {
+			err = pe.Err
+		}
+		return 0, false, 0, fmt.Errorf("failed to stat %s: %w", srcPath, err)
+	}
+	if srcInfo.Mode()&os.ModeSymlink != 0 {
+		return e.copyLink(relPath, dstPath, srcInfo)
+	}
+
+	shouldCopy := true
+	var hash uint64
+	srcMeta := StatMeta(srcPath, srcInfo)
+
+	// Check cache to determine if file needs to be copied
+	if cache != nil && !e.opts.Validate {
+		cache.RLock()
+		entry, ok := cache.IsUpToDate(relPath)
+		cache.RUnlock()
+		if ok && entry.Size == srcInfo.Size() {
+			unchanged := false
+			metaMatch := entry.MatchesMeta(srcMeta)
+			if metaMatch && !e.opts.Strict {
+				// Fast path: size, mtime, ctime and inode are unchanged, trust the cached hash
+				hash = entry.Hash
+				unchanged = true
+			} else {
+				hash, err = FileHashChunked(srcPath, entry.HashChunk)
+				unchanged = err == nil && entry.Hash == hash
+				if unchanged {
+					// Record the verification, and the metadata so the next run can take the fast path
+					cache.Lock()
+					cache.UpdateWithMeta(relPath, srcMeta, hash, entry.HashChunk, entry.LastCopied, time.Now().Unix())
+					cache.Unlock()
+				}
+			}
+			if unchanged {
+				if dstInfo, err := os.Stat(dstPath); err == nil && dstInfo.Mode().IsRegular() {
+					shouldCopy = false
+				}
+				if verbose >= 3 {
+					logger("Checking file: %s\n", relPath)
+					logger("Cache entry exists: %v\n", ok)
+					if ok {
+						logger("Cache size=%d, current size=%d\n", entry.Size, srcInfo.Size())
+						logger("Cache hash=%d, current hash=%d\n", entry.Hash, hash)
+						logger("Metadata match: %v (hashed: %v)\n", metaMatch, !metaMatch || e.opts.Strict)
+					}
+					_, statErr := os.Stat(dstPath)
+					logger("Destination exists: %v\n", statErr == nil)
+				}
+			}
+		}
+	} else if e.opts.Validate {
+		shouldCopy = !e.validate(relPath, srcPath, dstPath, srcInfo, srcMeta)
+	}
+
+	if !shouldCopy {
+		if e.opts.Preserve != 0 {
+			if dstInfo, err := os.Stat(dstPath); err == nil && preservedDiffers(srcInfo, dstInfo, e.opts.Preserve) {
+				if err := applyPreserved(srcPath, dstPath, srcInfo, e.opts.Preserve); err != nil {
+					logger("[%s] [WARN] Failed to preserve metadata of %s: %v\n", timestamp(), dstPath, err)
+				}
+			}
+		}
+		e.emit(Event{Kind: EventFileSkipped, Path: relPath, Size: srcInfo.Size()})
+		return srcInfo.Size(), false, 0, nil
+	}
+
+	e.emit(Event{Kind: EventFileStarted, Path: relPath, Size: srcInfo.Size()})
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return 0, false, 0, fmt.Errorf("failed to create directory %s: %w", filepath.Dir(dstPath), err)
+	}
+	in, err := e.opts.Retry.Open(ctx, srcPath)
+	if err != nil {
+		return 0, false, 0, fmt.Errorf("failed to open source file %s: %w", srcPath, err)
+	}
+	// Write to a temp file next to the destination and rename it over the
+	// target once complete, so readers see either the old or the new file
+	outFile, err := e.opts.Retry.CreateTemp(ctx, dstPath)
+	if err != nil {
+		in.Close()
+		return 0, false, 0, fmt.Errorf("failed to create destination file %s: %w", dstPath, err)
+	}
+	tmpPath := outFile.Name()
+	abandon := func() {
+		outFile.Close()
+		in.Close()
+		os.Remove(tmpPath)
+	}
+	written, copyHash, hashChunk, err := e.copyData(ctx, outFile, in, srcInfo, relPath, w)
+	if err != nil {
+		abandon()
+		if ctx.Err() != nil {
+			return 0, false, 0, ctx.Err()
+		}
+		return 0, false, 0, fmt.Errorf("failed to copy %s to %s: %w", srcPath, dstPath, err)
+	}
+
+	// A hung fsync, close or rename fails the file at --file-timeout like a
+	// stalled copy does
+	if err := e.opts.Retry.Do(ctx, func() error { return interruptible(ctx, outFile.Sync) }); err != nil {
+		abandon()
+		return 0, false, 0, fmt.Errorf("error syncing destination file %s: %w", dstPath, err)
+	}
+	if err := interruptible(ctx, outFile.Close); err != nil {
+		in.Close()
+		os.Remove(tmpPath)
+		return 0, false, 0, fmt.Errorf("error closing destination file %s: %w", dstPath, err)
+	}
+	if err := in.Close(); err != nil {
+		os.Remove(tmpPath)
+		return 0, false, 0, fmt.Errorf("error closing source file %s: %w", srcPath, err)
+	}
+
+	hash = copyHash
+	var verifiedAt int64
+	if e.opts.VerifyCopy {
+		// Read back before the rename, a bad copy never replaces the old file
+		dstHash, err := FileHashChunked(tmpPath, hashChunk)
+		if err != nil {
+			os.Remove(tmpPath)
+			return 0, false, 0, fmt.Errorf("failed to read back destination file %s: %w", dstPath, err)
+		}
+		if dstHash != hash {
+			os.Remove(tmpPath)
+			return 0, false, 0, fmt.Errorf("destination file %s does not match its source after copying (hash %d, expected %d)", dstPath, dstHash, hash)
+		}
+		verifiedAt = time.Now().Unix()
+		if verbose >= 3 {
+			logger("[%s] [VERIFY] Destination matches source: %s\n", timestamp(), relPath)
+		}
+	}
+	if e.opts.Preserve != 0 {
+		if err := applyPreserved(srcPath, tmpPath, srcInfo, e.opts.Preserve); err != nil {
+			logger("[%s] [WARN] Failed to preserve metadata of %s: %v\n", timestamp(), dstPath, err)
+		}
+	}
+	if err := interruptible(ctx, func() error { return ReplaceFile(tmpPath, dstPath) }); err != nil {
+		os.Remove(tmpPath)
+		return 0, false, 0, fmt.Errorf("failed to replace destination file %s: %w", dstPath, err)
+	}
+	// Make the rename durable before the cache records the copy
+	syncDir(filepath.Dir(dstPath))
+	if written != srcInfo.Size() {
+		// The source changed while it was copied, the next run copies it again
+		logger("[%s] [WARN] %s changed during copy (expected %d bytes, copied %d)\n", timestamp(), srcPath, srcInfo.Size(), written)
+	} else if cache != nil {
+		cache.Lock()
+		_, existed := cache.IsUpToDate(relPath)
+		cache.UpdateWithMeta(relPath, srcMeta, hash, hashChunk, time.Now().Unix(), verifiedAt)
+		cache.Unlock()
+
+		if verbose >= 3 {
+			if existed {
+				logger("[%s] [CACHE] Updated cache entry: %s (size=%d, hash=%d)\n", timestamp(), relPath, srcInfo.Size(), hash)
+			} else {
+				logger("[%s] [CACHE] Added new cache entry: %s (size=%d, hash=%d)\n", timestamp(), relPath, srcInfo.Size(), hash)
+			}
+		}
+		cache.SaveCache()
+	}
+	e.emit(Event{Kind: EventFileCopied, Path: relPath, Size: srcInfo.Size(), Hash: hash})
+	return srcInfo.Size(), true, written, nil
+}
+
+// validate compares an existing destination file with its source by size
+// and hash and reports whether they are identical. A match is recorded in
+// the cache as a verification.
+func (e *Engine) validate(relPath, srcPath, dstPath string, srcInfo os.FileInfo, srcMeta FileMeta) bool {
+	cache := e.opts.Cache
+	verbose := e.opts.Verbose
+	logger := e.logf
+
+	// VALIDATION MODE - Start validation logging
+	if verbose >= 2 {
+		logger("[%s] [VALIDATE] Starting validation for: %s\n", timestamp(), relPath)
+	}
+
+	// Check if destination file exists
+	dstInfo, err := os.Stat(dstPath)
+	if err != nil || !dstInfo.Mode().IsRegular() {
+		// Destination missing or not a regular file
+		if verbose >= 2 {
+			logger("[%s] [VALIDATE] MISMATCH - Destination file missing: %s\n", timestamp(), relPath)
+		}
+		return false
+	}
+
+	// Check size first (fast)
+	if srcInfo.Size() != dstInfo.Size() {
+		logger("[%s] [VALIDATE] MISMATCH - Size differs for %s\n", timestamp(), relPath)
+		logger("[%s] [VALIDATE]   Source size: %d bytes\n", timestamp(), srcInfo.Size())
+		logger("[%s] [VALIDATE]   Destination size: %d bytes\n", timestamp(), dstInfo.Size())
+		return false
+	}
+	if verbose >= 3 {
+		logger("[%s] [VALIDATE] Size match - calculating hashes for: %s\n", timestamp(), relPath)
+	}
+
+	// Calculate both hashes (slower)
+	srcHash, srcErr := FileHash(srcPath)
+	dstHash, dstErr := FileHash(dstPath)
+	if srcErr != nil || dstErr != nil || srcHash != dstHash {
+		if srcErr != nil {
+			logger("[%s] [VALIDATE] ERROR - Cannot calculate source hash for %s: %v\n", timestamp(), relPath, srcErr)
+		} else if dstErr != nil {
+			logger("[%s] [VALIDATE] ERROR - Cannot calculate destination hash for %s: %v\n", timestamp(), relPath, dstErr)
+		} else {
+			logger("[%s] [VALIDATE] MISMATCH - Hash differs for %s\n", timestamp(), relPath)
+			logger("[%s] [VALIDATE]   Source hash: %d\n", timestamp(), srcHash)
+			logger("[%s] [VALIDATE]   Destination hash: %d\n", timestamp(), dstHash)
+		}
+		return false
+	}
+
+	if verbose >= 2 {
+		logger("[%s] [VALIDATE] SUCCESS - File validated: %s (size: %d, hash: %d)\n", timestamp(), relPath, srcInfo.Size(), srcHash)
+	} else if verbose == 1 {
+		logger("[%s] [VALIDATE] SUCCESS - %s\n", timestamp(), relPath)
+	}
+
+	// Update cache after successful validation
+	if cache != nil {
+		cache.Lock()
+		var lastCopied int64
+		if prev, ok := cache.IsUpToDate(relPath); ok {
+			lastCopied = prev.LastCopied
+		}
+		cache.UpdateWithMeta(relPath, srcMeta, srcHash, 0, lastCopied, time.Now().Unix())
+		cache.Unlock()
+		if verbose >= 3 {
+			logger("[%s] [CACHE] Updated after validation: %s\n", timestamp(), relPath)
+		}
+	}
+	return true
+}
@@ -0,0 +1,278 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTree creates files with the given contents below root. Keys are
+// slash-separated relative paths.
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for rel, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree returns the contents of the regular files below root by
+// slash-separated relative path, leaving out the manifest directory.
+func readTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ManifestDir {
+			return filepath.SkipDir
+		}
+		if d.Type().IsRegular() {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(root, path)
+			files[filepath.ToSlash(rel)] = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// sameTree reports the differences between the files below root and want.
+func sameTree(t *testing.T, root string, want map[string]string) {
+	t.Helper()
+	got := readTree(t, root)
+	for rel, content := range want {
+		if c, ok := got[rel]; !ok {
+			t.Errorf("%s is missing", rel)
+		} else if c != content {
+			t.Errorf("%s = %q, want %q", rel, c, content)
+		}
+	}
+	for rel := range got {
+		if _, ok := want[rel]; !ok {
+			t.Errorf("unexpected file %s", rel)
+		}
+	}
+}
+
+// runEngine runs an engine with opts and returns its result and the events
+// it emitted, failing the test on a run error. Log events are dropped.
+func runEngine(t *testing.T, opts Options) (Result, []Event) {
+	t.Helper()
+	var events []Event
+	opts.OnEvent = func(ev Event) {
+		if ev.Kind != EventLog && ev.Kind != EventProgress {
+			events = append(events, ev)
+		}
+	}
+	res, err := NewEngine(opts).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	return res, events
+}
+
+// eventPaths returns the slash-separated paths of the events of one kind.
+func eventPaths(events []Event, kind EventKind) []string {
+	var paths []string
+	for _, ev := range events {
+		if ev.Kind == kind {
+			paths = append(paths, filepath.ToSlash(ev.Path))
+		}
+	}
+	return paths
+}
+
+func TestEngineIncrementalCopy(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	files := map[string]string{
+		"a.txt":         "alpha",
+		"sub/b.txt":     "bravo",
+		"sub/deep/c.go": "package c",
+		"empty":         "",
+	}
+	writeTree(t, src, files)
+	os.MkdirAll(filepath.Join(src, "emptydir"), 0755)
+	cache := newCache(t, filepath.Join(dir, "cache.json"))
+	opts := Options{Src: src, Dst: dst, Cache: cache, Workers: 2}
+
+	res, events := runEngine(t, opts)
+	if res.Files != 4 || res.Copied != 4 || res.Skipped != 0 || res.Failed != 0 {
+		t.Errorf("first run: %+v", res)
+	}
+	sameTree(t, dst, files)
+	if info, err := os.Stat(filepath.Join(dst, "emptydir")); err != nil || !info.IsDir() {
+		t.Errorf("empty source directory was not created: %v", err)
+	}
+	for _, ev := range events {
+		if ev.Kind != EventFileCopied {
+			continue
+		}
+		want, _ := FileHash(filepath.Join(src, ev.Path))
+		if ev.Hash != want {
+			t.Errorf("%s copied with hash %x, want %x", ev.Path, ev.Hash, want)
+		}
+		if e, ok := cache.IsUpToDate(ev.Path); !ok || e.Hash != want || e.LastCopied == 0 {
+			t.Errorf("cache entry of %s = %+v", ev.Path, e)
+		}
+	}
+
+	res, _ = runEngine(t, opts)
+	if res.Copied != 0 || res.Skipped != 4 {
+		t.Errorf("unchanged run: %+v", res)
+	}
+
+	files["sub/b.txt"] = "bravo, changed"
+	writeTree(t, src, map[string]string{"sub/b.txt": files["sub/b.txt"]})
+	res, events = runEngine(t, opts)
+	if copied := eventPaths(events, EventFileCopied); len(copied) != 1 || copied[0] != "sub/b.txt" || res.Skipped != 3 {
+		t.Errorf("after changing sub/b.txt copied %v, %+v", copied, res)
+	}
+	sameTree(t, dst, files)
+}
+
+func TestEngineWithoutCache(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	files := map[string]string{"a": "1", "b/c": "2"}
+	writeTree(t, src, files)
+	for run := 0; run < 2; run++ {
+		res, _ := runEngine(t, Options{Src: src, Dst: dst, Manifest: true})
+		if res.Copied != 2 {
+			t.Errorf("run %d copied %d files, want every file without a cache", run, res.Copied)
+		}
+	}
+	sameTree(t, dst, files)
+	if Exists(ManifestPath(dst)) {
+		t.Error("manifest written without a cache")
+	}
+}
+
+func TestEngineVerifyCopyAndValidate(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	files := map[string]string{"a": strings.Repeat("a", 10000), "b": "b"}
+	writeTree(t, src, files)
+	cache := newCache(t, filepath.Join(dir, "cache.json"))
+	res, _ := runEngine(t, Options{Src: src, Dst: dst, Cache: cache, VerifyCopy: true, BufferSize: 512})
+	if res.Copied != 2 || res.Failed != 0 {
+		t.Errorf("verified copy: %+v", res)
+	}
+
+	// A destination damaged behind the cache's back is only noticed by --validate
+	os.WriteFile(filepath.Join(dst, "b"), []byte("x"), 0644)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(dst, "b"), future, future)
+	if res, _ := runEngine(t, Options{Src: src, Dst: dst, Cache: cache}); res.Copied != 0 {
+		t.Errorf("cache trusted run copied %d files", res.Copied)
+	}
+	res, events := runEngine(t, Options{Src: src, Dst: dst, Cache: cache, Validate: true})
+	if copied := eventPaths(events, EventFileCopied); len(copied) != 1 || copied[0] != "b" {
+		t.Errorf("validating run copied %v, want [b]: %+v", copied, res)
+	}
+	sameTree(t, dst, files)
+}
+
+// tempFiles returns the temp files left below root.
+func tempFiles(t *testing.T, root string) []string {
+	t.Helper()
+	var temps []string
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && IsTempName(d.Name()) {
+			temps = append(temps, path)
+		}
+		return nil
+	})
+	return temps
+}
+
+func TestEngineInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	files := map[string]string{}
+	for i := 0; i < 40; i++ {
+		files[fmt.Sprintf("d%d/f%02d", i%4, i)] = strings.Repeat(fmt.Sprint(i), 50_000+i)
+	}
+	writeTree(t, src, files)
+
+	tests := []struct {
+		name string
+		stop func(e *Engine, cancel context.CancelFunc)
+		want error
+	}{
+		// Copies in progress are abandoned
+		{"cancel", func(_ *Engine, cancel context.CancelFunc) { cancel() }, context.Canceled},
+		// Copies in progress are finished
+		{"stop", func(e *Engine, _ context.CancelFunc) { e.Stop() }, ErrStopped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "dst")
+			cachePath := filepath.Join(t.TempDir(), "cache.json")
+			cache := newCache(t, cachePath)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var engine *Engine
+			started := 0
+			engine = NewEngine(Options{Src: src, Dst: dst, Cache: cache, Workers: 4, BufferSize: 4096, OnEvent: func(ev Event) {
+				if ev.Kind == EventFileStarted {
+					if started++; started == 10 {
+						tt.stop(engine, cancel)
+					}
+				}
+			}})
+			res, err := engine.Run(ctx)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Run() error = %v, want %v", err, tt.want)
+			}
+			if temps := tempFiles(t, dst); len(temps) > 0 {
+				t.Errorf("temp files left behind: %v", temps)
+			}
+			cache.Close()
+
+			// The saved cache only knows files that were completely copied
+			cache, err = OpenGlobalCache(cachePath, BackendJSON)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cache.Close()
+			entries := 0
+			cache.Range(func(key string, e *CacheEntry) bool {
+				entries++
+				dstHash, err := FileHash(filepath.Join(dst, KeyPath(key)))
+				if err != nil || dstHash != e.Hash || e.Size != int64(len(files[key])) {
+					t.Errorf("cache has %s (hash %x) but the destination doesn't match: %x, %v", key, e.Hash, dstHash, err)
+				}
+				return true
+			})
+			if entries == 0 || entries >= len(files) || entries != res.Copied {
+				t.Errorf("%d cache entries after copying %d of %d files", entries, res.Copied, len(files))
+			}
+
+			// The next run copies only what is missing
+			res, _ = runEngine(t, Options{Src: src, Dst: dst, Cache: cache, Workers: 4})
+			if res.Copied != len(files)-entries || res.Skipped != entries {
+				t.Errorf("resumed run copied %d and skipped %d, want %d and %d", res.Copied, res.Skipped, len(files)-entries, entries)
+			}
+			sameTree(t, dst, files)
+		})
+	}
+}
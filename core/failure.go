@@ -0,0 +1,63 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// FailureKind classifies why a file could not be copied.
+type FailureKind int
+
+const (
+	FailureOther      FailureKind = iota // Not one of the kinds below
+	FailureVanished                      // The source file was deleted during the run
+	FailurePermission                    // Access to the source or destination was denied
+	FailureNoSpace                       // The destination is full or over quota
+	FailureIO                            // The device reported a read or write error
+	FailureTimeout                       // Copying took longer than Options.FileTimeout
+)
+
+var failureKindNames = []string{"other errors", "vanished", "permission denied", "no space left", "I/O errors", "timed out"}
+
+func (k FailureKind) String() string {
+	if k >= 0 && int(k) < len(failureKindNames) {
+		return failureKindNames[k]
+	}
+	return fmt.Sprintf("FailureKind(%d)", int(k))
+}
+
+// FileError is the failure of a single file, see Result.Failures.
+type FileError struct {
+	Path string // Path relative to the source directory
+	Kind FailureKind
+	Err  error
+}
+
+func (e *FileError) Error() string { return e.Err.Error() }
+func (e *FileError) Unwrap() error { return e.Err }
+
+// classifyFailure returns the kind of err, which occurred while copying srcPath.
+func classifyFailure(srcPath string, err error) FailureKind {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if _, statErr := os.Lstat(srcPath); os.IsNotExist(statErr) {
+			return FailureVanished
+		}
+	case errors.Is(err, fs.ErrPermission):
+		return FailurePermission
+	case errors.Is(err, syscall.EIO):
+		return FailureIO
+	case errors.Is(err, context.DeadlineExceeded):
+		return FailureTimeout
+	}
+	for _, errno := range noSpaceErrors {
+		if errors.Is(err, errno) {
+			return FailureNoSpace
+		}
+	}
+	return FailureOther
+}
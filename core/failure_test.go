@@ -0,0 +1,82 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing")
+	os.WriteFile(existing, nil, 0644)
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		name    string
+		srcPath string
+		err     error
+		want    FailureKind
+	}{
+		{"source deleted", missing, &fs.PathError{Op: "open", Path: missing, Err: fs.ErrNotExist}, FailureVanished},
+		{"destination directory missing", existing, &fs.PathError{Op: "open", Path: "dst", Err: fs.ErrNotExist}, FailureOther},
+		{"permission", existing, fmt.Errorf("failed to open: %w", fs.ErrPermission), FailurePermission},
+		{"read error", existing, fmt.Errorf("failed to copy: %w", &fs.PathError{Op: "read", Err: syscall.EIO}), FailureIO},
+		{"timeout", existing, fmt.Errorf("gave up: %w", context.DeadlineExceeded), FailureTimeout},
+		{"no space", existing, &fs.PathError{Op: "write", Err: noSpaceErrors[0]}, FailureNoSpace},
+		{"other", existing, errors.New("something else"), FailureOther},
+	}
+	for _, tt := range tests {
+		if got := classifyFailure(tt.srcPath, tt.err); got != tt.want {
+			t.Errorf("%s: classifyFailure(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestEngineFileFailures(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeTree(t, src, map[string]string{"a": "a", "bad": "bad", "c/d": "d"})
+	quickRetry := RetryPolicy{Attempts: 2, Delay: time.Millisecond}
+
+	// A non-empty directory in the way of a file can't be replaced
+	blocked := func(t *testing.T) string {
+		dst := filepath.Join(t.TempDir(), "dst")
+		writeTree(t, dst, map[string]string{"bad/in-the-way": "x"})
+		return dst
+	}
+
+	t.Run("continue", func(t *testing.T) {
+		dst := blocked(t)
+		cache := newCache(t, filepath.Join(t.TempDir(), "cache.json"))
+		res, events := runEngine(t, Options{Src: src, Dst: dst, Cache: cache, Workers: 1, Retry: quickRetry, Retries: 2})
+		if res.Failed != 1 || res.Copied != 2 || len(res.Failures) != 1 || res.Failures[0].Path != "bad" {
+			t.Fatalf("result %+v, want bad failed and the rest copied", res)
+		}
+		if res.Failures[0].Kind != FailureOther {
+			t.Errorf("failure kind = %v", res.Failures[0].Kind)
+		}
+		if failed := eventPaths(events, EventFileFailed); len(failed) != 1 {
+			t.Errorf("failure reported %d times after retries, want once", len(failed))
+		}
+		if _, ok := cache.IsUpToDate("bad"); ok {
+			t.Error("failed file is in the cache")
+		}
+		sameTree(t, dst, map[string]string{"a": "a", "c/d": "d", "bad/in-the-way": "x"})
+	})
+
+	t.Run("stop on error", func(t *testing.T) {
+		opts := Options{Src: src, Dst: blocked(t), Workers: 1, Retry: quickRetry, StopOnError: true}
+		res, err := NewEngine(opts).Run(context.Background())
+		var fe *FileError
+		if !errors.As(err, &fe) || fe.Path != "bad" || res.Failed != 1 {
+			t.Errorf("Run() = %+v, %v; want the failure of bad", res, err)
+		}
+	})
+}
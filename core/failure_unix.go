@@ -0,0 +1,28 @@
+//go:build !windows
+
+package core
+
+import "syscall"
+
+// noSpaceErrors are the errors of a full destination.
+var noSpaceErrors = []error{syscall.ENOSPC, syscall.EDQUOT}
+
+// errorNames are the errors that can be named in --retry-errors.
+var errorNames = map[string]error{
+	"EINTR":      syscall.EINTR,
+	"EAGAIN":     syscall.EAGAIN,
+	"EIO":        syscall.EIO,
+	"EBUSY":      syscall.EBUSY,
+	"ETIMEDOUT":  syscall.ETIMEDOUT,
+	"ESTALE":     syscall.ESTALE,
+	"ECONNRESET": syscall.ECONNRESET,
+	"EHOSTDOWN":  syscall.EHOSTDOWN,
+	"ENOLCK":     syscall.ENOLCK,
+	"EACCES":     syscall.EACCES,
+	"EPERM":      syscall.EPERM,
+	"ENOENT":     syscall.ENOENT,
+	"ENOSPC":     syscall.ENOSPC,
+}
+
+// transientErrors are the errors retried by default.
+var transientErrors = []string{"EINTR", "EAGAIN", "EIO", "EBUSY", "ETIMEDOUT", "ESTALE", "ECONNRESET", "EHOSTDOWN"}
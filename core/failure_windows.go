@@ -0,0 +1,25 @@
+package core
+
+import "syscall"
+
+// noSpaceErrors are the errors of a full destination: ERROR_DISK_FULL and
+// ERROR_HANDLE_DISK_FULL.
+var noSpaceErrors = []error{syscall.Errno(112), syscall.Errno(39)}
+
+// errorNames are the errors that can be named in --retry-errors, Windows
+// system error codes without their ERROR_ prefix.
+var errorNames = map[string]error{
+	"ACCESS_DENIED":     syscall.Errno(5),
+	"FILE_NOT_FOUND":    syscall.Errno(2),
+	"SHARING_VIOLATION": syscall.Errno(32),
+	"LOCK_VIOLATION":    syscall.Errno(33),
+	"BAD_NETPATH":       syscall.Errno(53),
+	"UNEXP_NET_ERR":     syscall.Errno(59),
+	"NETNAME_DELETED":   syscall.Errno(64),
+	"DISK_FULL":         syscall.Errno(112),
+	"SEM_TIMEOUT":       syscall.Errno(121),
+	"IO_DEVICE":         syscall.Errno(1117),
+}
+
+// transientErrors are the errors retried by default.
+var transientErrors = []string{"SHARING_VIOLATION", "LOCK_VIOLATION", "BAD_NETPATH", "UNEXP_NET_ERR", "NETNAME_DELETED", "SEM_TIMEOUT", "IO_DEVICE"}
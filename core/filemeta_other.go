@@ -0,0 +1,17 @@
+//go:build !linux && !windows
+
+package core
+
+import "os"
+
+// hardLinksSupported reports whether StatMeta fills in Nlink, Dev and Inode.
+const hardLinksSupported = false
+
+// StatMeta collects the metadata used by the cache fast path for a file.
+// Platforms without a dedicated implementation only get size and mtime.
+func StatMeta(path string, info os.FileInfo) FileMeta {
+	return FileMeta{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+	}
+}
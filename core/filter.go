@@ -0,0 +1,351 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IgnoreFileName is the name of per-directory ignore files. Their patterns
+// use the --filter-from syntax and apply to the directory holding the file
+// and everything below it.
+const IgnoreFileName = ".cachecopyignore"
+
+// Filter selects the source paths that are copied. Patterns are globs in
+// gitignore syntax: "*", "?" and "[...]" match within a path component,
+// "**" matches any number of components, a pattern without a slash matches
+// a name at any depth, one with a slash is relative to the source root, a
+// trailing slash matches only directories and a leading "!" re-includes
+// what an earlier pattern excluded. The last matching exclude pattern wins,
+// and an excluded directory is not descended, so nothing below it can be
+// re-included. When include patterns are given, only files matching one of
+// them, or inside a directory matching one, are copied.
+//
+// Rules are checked from weakest to strongest: filter files, then the ignore
+// files of the source tree from the root down, then exclude patterns. A nil
+// Filter excludes nothing.
+//
+// The size and age limits apply to regular files only. With Options.Mirror,
+// destination files that are outside the limits are kept, like those
+// excluded by a pattern.
+type Filter struct {
+	MinSize   int64     // Files smaller than this are left out
+	MaxSize   int64     // Files larger than this are left out, 0 for no limit
+	NewerThan time.Time // Files last modified before this are left out, zero for no limit
+	OlderThan time.Time // Files last modified after this are left out, zero for no limit
+	MaxDepth  int       // Paths more than this many levels below the source root are left out, 0 for no limit
+
+	include []filterRule
+	files   []filterRule // Read from filter files
+	exclude []filterRule
+}
+
+type filterRule struct {
+	segs    []string // Pattern split at slashes, "**" matches any number of components
+	negate  bool     // "!pattern", re-includes matching paths
+	dirOnly bool     // "pattern/", matches directories only
+	base    string   // Directory the pattern is relative to, "" for the source root
+}
+
+// NewFilter creates a filter from --include and --exclude patterns.
+func NewFilter(include, exclude []string) (*Filter, error) {
+	f := &Filter{}
+	for _, p := range include {
+		r, ok, err := parseFilterRule(p, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern %q: %w", p, err)
+		}
+		if !ok || r.negate {
+			return nil, fmt.Errorf("invalid include pattern %q", p)
+		}
+		f.include = append(f.include, r)
+	}
+	for _, p := range exclude {
+		r, ok, err := parseFilterRule(p, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", p, err)
+		}
+		if ok {
+			f.exclude = append(f.exclude, r)
+		}
+	}
+	return f, nil
+}
+
+// AddFile reads exclude patterns from a filter file (--filter-from), one per
+// line in gitignore syntax. Blank lines and lines starting with "#" are
+// ignored.
+func (f *Filter) AddFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	rules, err := readFilterRules(file, "")
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	f.files = append(f.files, rules...)
+	return nil
+}
+
+// readFilterRules parses the lines of a filter or ignore file whose patterns
+// are relative to base. The first invalid pattern is reported with its line.
+func readFilterRules(r io.Reader, base string) ([]filterRule, error) {
+	var rules []filterRule
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		rule, ok, err := parseFilterRule(scanner.Text(), base)
+		if err != nil {
+			return rules, fmt.Errorf("line %d: invalid pattern: %w", lineNo, err)
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// parseFilterRule parses one gitignore line. ok is false for blank lines and
+// comments.
+func parseFilterRule(line, base string) (r filterRule, ok bool, err error) {
+	line = strings.TrimSuffix(line, "\r")
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " \t")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false, nil
+	}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A slash anywhere but at the end anchors the pattern to base
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return r, false, nil
+	}
+	if !anchored {
+		r.segs = []string{"**"}
+	}
+	for _, seg := range strings.Split(line, "/") {
+		if seg == "" {
+			continue
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return r, false, err
+		}
+		r.segs = append(r.segs, seg)
+	}
+	r.base = base
+	return r, true, nil
+}
+
+// match reports whether the rule matches the path with the given components,
+// relative to the source root.
+func (r *filterRule) match(segs []string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		baseSegs := strings.Split(r.base, "/")
+		if len(segs) <= len(baseSegs) {
+			return false
+		}
+		for i, s := range baseSegs {
+			if segs[i] != s {
+				return false
+			}
+		}
+		segs = segs[len(baseSegs):]
+	}
+	return matchSegs(r.segs, segs)
+}
+
+func matchSegs(pattern, segs []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return len(segs) > 0
+			}
+			for i := range segs {
+				if matchSegs(pattern, segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segs[0]); !ok {
+			return false
+		}
+		pattern, segs = pattern[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// lastMatch returns the verdict of the last rule matching the path: true if
+// it excludes the path, false if it re-includes it. found is false when no
+// rule matches.
+func lastMatch(rules []filterRule, segs []string, isDir bool) (excluded, found bool) {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].match(segs, isDir) {
+			return !rules[i].negate, true
+		}
+	}
+	return false, false
+}
+
+// excluded reports whether relPath, relative to the source root, is left out
+// by the filter. ignores are the rules of the ignore files that apply to it,
+// ordered from the root down.
+func (f *Filter) excluded(relPath string, isDir bool, ignores []filterRule) bool {
+	segs := strings.Split(filepath.ToSlash(relPath), "/")
+	if f != nil {
+		// Directories at the deepest level would be created empty
+		if f.MaxDepth > 0 && (len(segs) > f.MaxDepth || isDir && len(segs) == f.MaxDepth) {
+			return true
+		}
+		if excluded, found := lastMatch(f.exclude, segs, isDir); found {
+			return excluded
+		}
+	}
+	if excluded, found := lastMatch(ignores, segs, isDir); found {
+		return excluded
+	}
+	if f == nil {
+		return false
+	}
+	if excluded, found := lastMatch(f.files, segs, isDir); found {
+		return excluded
+	}
+	if isDir || len(f.include) == 0 {
+		return false
+	}
+	// A file is included by a pattern matching it or one of its directories
+	for n := len(segs); n > 0; n-- {
+		for i := range f.include {
+			if f.include[i].match(segs[:n], n < len(segs)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// prunesDirs reports whether directories left without files by the filter
+// should not be created: include patterns and limits select files, not
+// directories.
+func (f *Filter) prunesDirs() bool {
+	return f != nil && (len(f.include) > 0 || f.hasLimits())
+}
+
+// hasLimits reports whether the filter sets size or age limits.
+func (f *Filter) hasLimits() bool {
+	return f != nil && (f.MinSize > 0 || f.MaxSize > 0 || !f.NewerThan.IsZero() || !f.OlderThan.IsZero())
+}
+
+// outsideLimits reports whether the file described by info is left out by
+// the size and age limits. Only regular files are limited.
+func (f *Filter) outsideLimits(info os.FileInfo) bool {
+	if !f.hasLimits() || info == nil || !info.Mode().IsRegular() {
+		return false
+	}
+	size, mtime := info.Size(), info.ModTime()
+	return size < f.MinSize ||
+		f.MaxSize > 0 && size > f.MaxSize ||
+		!f.NewerThan.IsZero() && mtime.Before(f.NewerThan) ||
+		!f.OlderThan.IsZero() && mtime.After(f.OlderThan)
+}
+
+// ParseTimeLimit parses a --newer-than or --older-than value: a duration
+// before now such as "36h", "7d" or "1d12h", or a local date such as
+// "2024-05-31", "2024-05-31 18:30" or an RFC 3339 time.
+func ParseTimeLimit(s string, now time.Time) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	// time.ParseDuration has no days
+	rest := s
+	var age time.Duration
+	if i := strings.IndexByte(rest, 'd'); i >= 0 {
+		days, err := strconv.ParseFloat(rest[:i], 64)
+		if err != nil || days < 0 {
+			return time.Time{}, fmt.Errorf("invalid duration or date: %s", s)
+		}
+		age = time.Duration(days * float64(24*time.Hour))
+		rest = rest[i+1:]
+	}
+	if rest != "" {
+		d, err := time.ParseDuration(rest)
+		if err != nil || d < 0 {
+			return time.Time{}, fmt.Errorf("invalid duration or date: %s", s)
+		}
+		age += d
+	}
+	return now.Add(-age), nil
+}
+
+// ignoreRules returns the rules that apply inside the source directory
+// relDir: those of the ignore files in it and in all directories above it,
+// root first. Ignore files are read once per run; a file that can't be read
+// or holds an invalid pattern is reported and the rules before the error are
+// used.
+func (e *Engine) ignoreRules(relDir string) []filterRule {
+	relDir = path.Clean(filepath.ToSlash(relDir))
+	if rules, ok := e.ignores[relDir]; ok {
+		return rules
+	}
+	var rules, parent []filterRule
+	base := ""
+	if relDir != "." {
+		parent = e.ignoreRules(path.Dir(relDir))
+		base = relDir
+	}
+	rules = parent
+	ignorePath := filepath.Join(e.opts.Src, filepath.FromSlash(relDir), IgnoreFileName)
+	if file, err := os.Open(ignorePath); err == nil {
+		own, err := readFilterRules(file, base)
+		file.Close()
+		if err != nil {
+			e.logf("[%s] [WARN] Failed to read ignore file %s: %v\n", timestamp(), ignorePath, err)
+		}
+		if len(own) > 0 {
+			rules = append(parent[:len(parent):len(parent)], own...)
+		}
+	} else if !os.IsNotExist(err) {
+		e.logf("[%s] [WARN] Failed to read ignore file %s: %v\n", timestamp(), ignorePath, err)
+	}
+	if e.ignores == nil {
+		e.ignores = make(map[string][]filterRule)
+	}
+	e.ignores[relDir] = rules
+	return rules
+}
+
+// filtered reports whether the source path relPath is left out of the copy
+// by Options.Filter or an ignore file.
+func (e *Engine) filtered(relPath string, isDir bool) bool {
+	return e.opts.Filter.excluded(relPath, isDir, e.ignoreRules(filepath.Dir(relPath)))
+}
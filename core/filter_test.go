@@ -0,0 +1,301 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchSegs(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"a/*", "a/b", true},
+		{"a/*", "a/b/c", false},
+		{"*.go", "main.go", true},
+		{"*.go", "dir/main.go", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "a/b/main.go", true},
+		{"a/**", "a/b/c", true},
+		{"a/**", "a", false},
+		{"a/**/z", "a/z", true},
+		{"a/**/z", "a/b/c/z", true},
+		{"a/**/z", "a/b/c/y", false},
+		{"file?.[ch]", "file1.c", true},
+		{"file?.[ch]", "file10.c", false},
+	}
+	for _, tt := range tests {
+		if got := matchSegs(strings.Split(tt.pattern, "/"), strings.Split(tt.path, "/")); got != tt.want {
+			t.Errorf("matchSegs(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFilterExcluded(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		file    string // Contents of a --filter-from file
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{"nil filter", nil, nil, "", "a/b", false, false},
+		{"name at any depth", nil, []string{"*.log"}, "", "a/b/x.log", false, true},
+		{"no match", nil, []string{"*.log"}, "", "a/b/x.txt", false, false},
+		{"anchored", nil, []string{"/build"}, "", "build", true, true},
+		{"anchored, deeper", nil, []string{"/build"}, "", "src/build", true, false},
+		{"slash inside anchors", nil, []string{"src/gen"}, "", "lib/src/gen", true, false},
+		{"directory only", nil, []string{"cache/"}, "", "cache", true, true},
+		{"directory only, file", nil, []string{"cache/"}, "", "cache", false, false},
+		{"double star", nil, []string{"**/tmp/**"}, "", "a/tmp/b/c", false, true},
+		{"re-included", nil, []string{"*.log", "!keep.log"}, "", "keep.log", false, false},
+		{"last match wins", nil, []string{"!keep.log", "*.log"}, "", "keep.log", false, true},
+		{"include match", []string{"*.jpg"}, nil, "", "a/x.jpg", false, false},
+		{"include no match", []string{"*.jpg"}, nil, "", "a/x.png", false, true},
+		{"include keeps dirs", []string{"*.jpg"}, nil, "", "a", true, false},
+		{"include by directory", []string{"/photos"}, nil, "", "photos/2024/x.png", false, false},
+		{"exclude beats include", []string{"*.jpg"}, []string{"private/"}, "", "private", true, true},
+		{"filter file", nil, nil, "# comment\n\n*.bak\r\n", "x.bak", false, true},
+		{"exclude beats filter file", nil, []string{"!x.bak"}, "*.bak\n", "x.bak", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f *Filter
+			if tt.include != nil || tt.exclude != nil || tt.file != "" {
+				var err error
+				if f, err = NewFilter(tt.include, tt.exclude); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "filter")
+				os.WriteFile(path, []byte(tt.file), 0644)
+				if err := f.AddFile(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := f.excluded(filepath.FromSlash(tt.path), tt.isDir, nil); got != tt.want {
+				t.Errorf("excluded(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterIgnoreRules(t *testing.T) {
+	rules, err := readFilterRules(strings.NewReader("*.o\n!main.o\n/local\n"), "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Patterns of sub/.cachecopyignore apply below sub only
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"sub/x.o", false, true},
+		{"sub/deep/x.o", false, true},
+		{"sub/main.o", false, false},
+		{"x.o", false, false},
+		{"sub/local", true, true},
+		{"sub/deep/local", true, false},
+	}
+	for _, tt := range tests {
+		if got := (*Filter)(nil).excluded(filepath.FromSlash(tt.path), tt.isDir, rules); got != tt.want {
+			t.Errorf("excluded(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	// An exclude pattern overrides the ignore files
+	f, _ := NewFilter(nil, []string{"!x.o"})
+	if f.excluded("x.o", false, rules) || f.excluded(filepath.FromSlash("sub/x.o"), false, rules) {
+		t.Error("exclude pattern didn't override the ignore file")
+	}
+}
+
+func TestFilterPatternErrors(t *testing.T) {
+	if _, err := NewFilter(nil, []string{"[a-"}); err == nil {
+		t.Error("invalid exclude pattern accepted")
+	}
+	if _, err := NewFilter([]string{"!x"}, nil); err == nil {
+		t.Error("negated include pattern accepted")
+	}
+	_, err := readFilterRules(strings.NewReader("ok\n\n[\n"), "")
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("readFilterRules() error = %v, want line 3 reported", err)
+	}
+	if r, ok, _ := parseFilterRule(`trailing\ `, ""); !ok || r.segs[1] != `trailing\ ` {
+		t.Errorf("escaped trailing space was trimmed: %q", r.segs)
+	}
+}
+
+func TestEngineFilter(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	writeTree(t, src, map[string]string{
+		"a.jpg":                  "a",
+		"a.txt":                  "a",
+		"photos/b.jpg":           "b",
+		"photos/raw/b.cr2":       "b",
+		"docs/c.txt":             "c",
+		"build/out.jpg":          "out",
+		"sub/.cachecopyignore":   "*.jpg\n!keep.jpg\n",
+		"sub/d.jpg":              "d",
+		"sub/keep.jpg":           "keep",
+		"sub/nested/e.jpg":       "e",
+		"sub/nested/e.txt":       "e",
+		"other/.cachecopyignore": "[",
+		"other/f.jpg":            "f",
+	})
+	os.MkdirAll(filepath.Join(src, "empty"), 0755)
+
+	t.Run("exclude and ignore files", func(t *testing.T) {
+		f, _ := NewFilter(nil, []string{"build/", "*.cr2"})
+		target := filepath.Join(dst, "exclude")
+		// A destination file excluded by the filter is kept by --mirror
+		writeTree(t, target, map[string]string{"build/old.jpg": "old", "gone.txt": "gone"})
+		runEngine(t, Options{Src: src, Dst: target, Filter: f, Mirror: true})
+		sameTree(t, target, map[string]string{
+			"a.jpg": "a", "a.txt": "a", "photos/b.jpg": "b", "docs/c.txt": "c",
+			"sub/.cachecopyignore": "*.jpg\n!keep.jpg\n", "sub/keep.jpg": "keep", "sub/nested/e.txt": "e",
+			"other/.cachecopyignore": "[", "other/f.jpg": "f", "build/old.jpg": "old",
+		})
+		if !Exists(filepath.Join(target, "empty")) {
+			t.Error("empty directory was not created without include patterns")
+		}
+	})
+
+	t.Run("include", func(t *testing.T) {
+		f, _ := NewFilter([]string{"*.jpg"}, []string{"build/"})
+		target := filepath.Join(dst, "include")
+		runEngine(t, Options{Src: src, Dst: target, Filter: f})
+		sameTree(t, target, map[string]string{
+			"a.jpg": "a", "photos/b.jpg": "b", "sub/keep.jpg": "keep", "other/f.jpg": "f",
+		})
+		// Directories without included files are not recreated
+		for _, rel := range []string{"docs", "empty", "build", "photos/raw", "sub/nested"} {
+			if Exists(filepath.Join(target, rel)) {
+				t.Errorf("directory %s was created without included files", rel)
+			}
+		}
+	})
+}
+
+func TestParseTimeLimit(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{"36h", now.Add(-36 * time.Hour), false},
+		{"7d", now.Add(-7 * 24 * time.Hour), false},
+		{"1d12h", now.Add(-36 * time.Hour), false},
+		{"1.5d", now.Add(-36 * time.Hour), false},
+		{"90m", now.Add(-90 * time.Minute), false},
+		{"2024-05-31", time.Date(2024, 5, 31, 0, 0, 0, 0, time.Local), false},
+		{"2024-05-31 18:30", time.Date(2024, 5, 31, 18, 30, 0, 0, time.Local), false},
+		{"2024-05-31T18:30:05", time.Date(2024, 5, 31, 18, 30, 5, 0, time.Local), false},
+		{"2024-05-31T18:30:05Z", time.Date(2024, 5, 31, 18, 30, 5, 0, time.UTC), false},
+		{"-1d", time.Time{}, true},
+		{"-5h", time.Time{}, true},
+		{"7days", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+		{"2024-13-01", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimeLimit(tt.in, now)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("ParseTimeLimit(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestOutsideLimits(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f")
+	os.WriteFile(path, make([]byte, 1000), 0644)
+	mtime := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	os.Chtimes(path, mtime, mtime)
+	info, _ := os.Stat(path)
+	dirInfo, _ := os.Stat(dir)
+
+	tests := []struct {
+		name   string
+		filter *Filter
+		want   bool
+	}{
+		{"nil filter", nil, false},
+		{"no limits", &Filter{}, false},
+		{"min size", &Filter{MinSize: 1001}, true},
+		{"min size equal", &Filter{MinSize: 1000}, false},
+		{"max size", &Filter{MaxSize: 999}, true},
+		{"max size equal", &Filter{MaxSize: 1000}, false},
+		{"newer than", &Filter{NewerThan: mtime.Add(time.Second)}, true},
+		{"newer than, older limit", &Filter{NewerThan: mtime.Add(-time.Second)}, false},
+		{"older than", &Filter{OlderThan: mtime.Add(-time.Second)}, true},
+		{"older than, newer limit", &Filter{OlderThan: mtime.Add(time.Second)}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.outsideLimits(info); got != tt.want {
+			t.Errorf("%s: outsideLimits() = %v, want %v", tt.name, got, tt.want)
+		}
+		if tt.filter.outsideLimits(dirInfo) {
+			t.Errorf("%s: a directory is outside the limits", tt.name)
+		}
+	}
+}
+
+func TestFilterMaxDepth(t *testing.T) {
+	f := &Filter{MaxDepth: 2}
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"a", false, false},
+		{"a", true, false},
+		{"a/b", false, false},
+		{"a/b", true, true}, // Would be created empty
+		{"a/b/c", false, true},
+	}
+	for _, tt := range tests {
+		if got := f.excluded(filepath.FromSlash(tt.path), tt.isDir, nil); got != tt.want {
+			t.Errorf("excluded(%q, dir %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestEngineLimits(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	writeTree(t, src, map[string]string{
+		"small":           "s",
+		"big":             strings.Repeat("b", 100),
+		"old/big":         strings.Repeat("o", 100),
+		"new/deep/er/big": strings.Repeat("n", 100),
+		"tiny/s":          "s",
+	})
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(filepath.Join(src, "old", "big"), old, old)
+
+	f := &Filter{MinSize: 10, NewerThan: time.Now().Add(-24 * time.Hour), MaxDepth: 3}
+	cache := newCache(t, filepath.Join(dir, "cache.json"))
+	res, _ := runEngine(t, Options{Src: src, Dst: dst, Cache: cache, Filter: f})
+	if res.Files != 1 {
+		t.Errorf("%d files selected, want 1", res.Files)
+	}
+	sameTree(t, dst, map[string]string{"big": strings.Repeat("b", 100)})
+	// Directories whose files are all outside the limits are not recreated
+	for _, rel := range []string{"old", "new", "tiny"} {
+		if Exists(filepath.Join(dst, rel)) {
+			t.Errorf("directory %s was created without files", rel)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type inodeKey struct {
+	dev, ino uint64
+}
+
+// findHardLinks groups source files by device and inode. Every file that
+// shares its inode with a file earlier in fileList is mapped to that first
+// file, whose destination it will be linked to.
+func (e *Engine) findHardLinks(fileList []string) map[string]string {
+	first := make(map[inodeKey]string)
+	links := make(map[string]string)
+	for _, relPath := range fileList {
+		path := filepath.Join(e.opts.Src, relPath)
+		info, err := e.statSource(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		meta := StatMeta(path, info)
+		if meta.Nlink < 2 || meta.Inode == 0 {
+			continue
+		}
+		key := inodeKey{meta.Dev, meta.Inode}
+		if leader, ok := first[key]; ok {
+			links[relPath] = leader
+		} else {
+			first[key] = relPath
+		}
+	}
+	if len(links) > 0 && e.opts.Verbose >= 1 {
+		e.logf("[%s] [INFO] Found %d hard link(s) to files earlier in the source\n", timestamp(), len(links))
+	}
+	return links
+}
+
+// linkFile makes the destination of relPath a hard link to the destination
+// of leader, the first file of its group, which has already been copied.
+// When that is not possible the file is copied on its own.
+func (e *Engine) linkFile(ctx context.Context, relPath, leader string, w *worker) (int64, bool, int64, error) {
+	cache := e.opts.Cache
+	srcPath := filepath.Join(e.opts.Src, relPath)
+	dstPath := filepath.Join(e.opts.Dst, relPath)
+	leaderDst := filepath.Join(e.opts.Dst, leader)
+	leaderKey := CacheKey(leader)
+
+	leaderInfo, err := os.Stat(leaderDst)
+	if err != nil {
+		// The first file failed, copy this one instead
+		return e.copyFile(ctx, relPath, w)
+	}
+	srcInfo, err := e.statSource(srcPath)
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok {
+			err = pe.Err
+		}
+		return 0, false, 0, fmt.Errorf("failed to stat %s: %w", srcPath, err)
+	}
+
+	// The entry of a link is the entry of its group's first file, plus its own
+	// source metadata and the group it belongs to
+	record := func(lastCopied int64) uint64 {
+		if cache == nil {
+			return 0
+		}
+		cache.Lock()
+		defer cache.Unlock()
+		entry := &CacheEntry{}
+		if le, ok := cache.IsUpToDate(leader); ok {
+			*entry = *le
+		}
+		if lastCopied != 0 {
+			entry.LastCopied = lastCopied
+		}
+		meta := StatMeta(srcPath, srcInfo)
+		entry.SourceModTime, entry.SourceCtime, entry.Dev, entry.Inode = meta.ModTime, meta.Ctime, meta.Dev, meta.Inode
+		entry.HardLinkTo = leaderKey
+		cache.Put(relPath, entry)
+		return entry.Hash
+	}
+
+	if dstInfo, err := os.Lstat(dstPath); err == nil && os.SameFile(dstInfo, leaderInfo) {
+		if cache != nil {
+			cache.RLock()
+			entry, ok := cache.IsUpToDate(relPath)
+			cache.RUnlock()
+			if !ok || entry.HardLinkTo != leaderKey {
+				record(0)
+			}
+		}
+		e.emit(Event{Kind: EventFileSkipped, Path: relPath, Size: srcInfo.Size()})
+		return 0, false, 0, nil
+	}
+
+	e.emit(Event{Kind: EventFileStarted, Path: relPath, Size: srcInfo.Size()})
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return e.copyFile(ctx, relPath, w)
+	}
+	tmpPath := tempName(dstPath)
+	if err := os.Link(leaderDst, tmpPath); err != nil {
+		e.logf("[%s] [WARN] Failed to hard link %s to %s, copying instead: %v\n", timestamp(), dstPath, leaderDst, err)
+		return e.copyFile(ctx, relPath, w)
+	}
+	if err := ReplaceFile(tmpPath, dstPath); err != nil {
+		os.Remove(tmpPath)
+		return 0, false, 0, fmt.Errorf("failed to replace destination file %s: %w", dstPath, err)
+	}
+	hash := record(time.Now().Unix())
+	if e.opts.Verbose >= 3 {
+		e.logf("[%s] [VERBOSE] Hard linked %s to %s\n", timestamp(), relPath, leader)
+	}
+	e.emit(Event{Kind: EventFileCopied, Path: relPath, Size: srcInfo.Size(), Hash: hash})
+	return 0, true, 0, nil
+}
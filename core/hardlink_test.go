@@ -0,0 +1,61 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEngineHardLinks(t *testing.T) {
+	if !hardLinksSupported {
+		t.Skip("hard links are not detected on this platform")
+	}
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	writeTree(t, src, map[string]string{"a": "shared", "single": "single"})
+	os.Mkdir(filepath.Join(src, "sub"), 0755)
+	if err := os.Link(filepath.Join(src, "a"), filepath.Join(src, "sub", "b")); err != nil {
+		t.Skip(err)
+	}
+	cache := newCache(t, filepath.Join(dir, "cache.json"))
+	opts := Options{Src: src, Dst: dst, Cache: cache, HardLinks: true}
+
+	linked := func() bool {
+		a, errA := os.Stat(filepath.Join(dst, "a"))
+		b, errB := os.Stat(filepath.Join(dst, "sub", "b"))
+		return errA == nil && errB == nil && os.SameFile(a, b)
+	}
+	res, _ := runEngine(t, opts)
+	sameTree(t, dst, map[string]string{"a": "shared", "sub/b": "shared", "single": "single"})
+	if !linked() {
+		t.Error("destinations of the linked sources are not linked")
+	}
+	if res.CopiedBytes != int64(len("shared")+len("single")) {
+		t.Errorf("copied %d bytes, the link's data was copied twice", res.CopiedBytes)
+	}
+	a, _ := cache.IsUpToDate("a")
+	if b, ok := cache.IsUpToDate("sub/b"); !ok || b.HardLinkTo != "a" || b.Hash != a.Hash {
+		t.Errorf("cache entry of sub/b = %+v, want a link to a", b)
+	}
+
+	if res, _ := runEngine(t, opts); res.Copied != 0 {
+		t.Errorf("unchanged run copied %d files", res.Copied)
+	}
+
+	// A destination that lost its link is linked again
+	os.Remove(filepath.Join(dst, "sub", "b"))
+	os.WriteFile(filepath.Join(dst, "sub", "b"), []byte("shared"), 0644)
+	runEngine(t, opts)
+	if !linked() {
+		t.Error("broken destination link was not restored")
+	}
+
+	// Without --hard-links every file is copied on its own
+	plain := filepath.Join(dir, "plain")
+	runEngine(t, Options{Src: src, Dst: plain})
+	x, _ := os.Stat(filepath.Join(plain, "a"))
+	y, _ := os.Stat(filepath.Join(plain, "sub", "b"))
+	if os.SameFile(x, y) {
+		t.Error("files linked without --hard-links")
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"os"
 	"runtime"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/cespare/xxhash/v2"
@@ -14,54 +13,12 @@ import (
 	"github.com/shirou/gopsutil/v3/mem"
 )
 
-// OpenWithRetry wraps os.Open with retry logic.
-func OpenWithRetry(path string, maxRetries int) (*os.File, error) {
-	var f *os.File
-	var err error
-	for i := 0; i < maxRetries; i++ {
-		f, err = os.Open(path)
-		if err == nil {
-			return f, nil
-		}
-		if errno, ok := err.(*os.PathError); ok {
-			switch errno.Err {
-			case syscall.EINTR, syscall.EAGAIN, syscall.EIO, syscall.EBUSY:
-				time.Sleep(200 * time.Millisecond)
-				continue
-			}
-		}
-		break
-	}
-	return f, err
-}
-
-// CreateWithRetry wraps os.Create with retry logic.
-func CreateWithRetry(path string, maxRetries int) (*os.File, error) {
-	var f *os.File
-	var err error
-	for i := 0; i < maxRetries; i++ {
-		f, err = os.Create(path)
-		if err == nil {
-			return f, nil
-		}
-		if errno, ok := err.(*os.PathError); ok {
-			switch errno.Err {
-			case syscall.EINTR, syscall.EAGAIN, syscall.EIO, syscall.EBUSY:
-				time.Sleep(200 * time.Millisecond)
-				continue
-			}
-		}
-		break
-	}
-	return f, err
-}
-
 // ParseSize parses a string like "4MB", "256KB", or "1048576" into bytes.
 func ParseSize(s string) (int, error) {
 	var size int
 	var unit string
 	n, err := fmt.Sscanf(s, "%d%s", &size, &unit)
-	if n == 1 && err == nil {
+	if n == 1 && (err == nil || err == io.EOF) {
 		return size, nil // No unit, just bytes
 	}
 	if n == 2 && err == nil {
@@ -70,6 +27,8 @@ func ParseSize(s string) (int, error) {
 			return size * 1024, nil
 		case "MB":
 			return size * 1024 * 1024, nil
+		case "GB":
+			return size * 1024 * 1024 * 1024, nil
 		case "B":
 			return size, nil
 		default:
@@ -125,6 +84,33 @@ func FileHash(path string) (uint64, error) {
 	return h.Sum64(), nil
 }
 
+// CopyAndHash copies src to dst through buf and hashes the bytes on the way,
+// so the source is read only once. The hash equals FileHash of the copied data.
+func CopyAndHash(dst io.Writer, src io.Reader, buf []byte) (int64, uint64, error) {
+	h := xxhash.New()
+	var written int64
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			w, werr := dst.Write(buf[:n])
+			written += int64(w)
+			if werr != nil {
+				return written, 0, werr
+			}
+			if w != n {
+				return written, 0, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, h.Sum64(), nil
+		}
+		if rerr != nil {
+			return written, 0, rerr
+		}
+	}
+}
+
 // PrintCPUMonitor prints CPU and memory usage to stdout.
 func PrintCPUMonitor() {
 	for {
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+func TestCopyAndHash(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		buf  int
+	}{
+		{"empty", 0, 16},
+		{"smaller than buffer", 10, 16},
+		{"buffer size", 16, 16},
+		{"several buffers", 1000, 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte("0123456789abcdefg"), tt.size/17+1)[:tt.size]
+			path := filepath.Join(t.TempDir(), "f")
+			os.WriteFile(path, data, 0644)
+			want, err := FileHash(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var dst bytes.Buffer
+			// OneByteReader returns short reads, as pipes and network files do
+			n, sum, err := CopyAndHash(&dst, iotest.OneByteReader(bytes.NewReader(data)), make([]byte, tt.buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(tt.size) || !bytes.Equal(dst.Bytes(), data) {
+				t.Errorf("copied %d bytes, want %d", n, tt.size)
+			}
+			if sum != want || sum != xxhash.Sum64(data) {
+				t.Errorf("hash %x differs from FileHash %x", sum, want)
+			}
+		})
+	}
+}
+
+type failingWriter struct{ after int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.after {
+		n := w.after
+		w.after = 0
+		return n, errors.New("disk full")
+	}
+	w.after -= len(p)
+	return len(p), nil
+}
+
+func TestCopyAndHashErrors(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100)
+
+	n, _, err := CopyAndHash(&failingWriter{after: 40}, bytes.NewReader(data), make([]byte, 16))
+	if err == nil || err.Error() != "disk full" || n != 40 {
+		t.Errorf("CopyAndHash() = %d, %v; want 40 bytes and the write error", n, err)
+	}
+
+	readErr := errors.New("read failed")
+	n, _, err = CopyAndHash(&bytes.Buffer{}, iotest.TimeoutReader(bytes.NewReader(data)), make([]byte, 16))
+	if !errors.Is(err, iotest.ErrTimeout) || n != 16 {
+		t.Errorf("CopyAndHash() = %d, %v; want 16 bytes and the read error", n, err)
+	}
+	if _, _, err := CopyAndHash(&bytes.Buffer{}, iotest.ErrReader(readErr), make([]byte, 16)); err != readErr {
+		t.Errorf("CopyAndHash() error = %v, want %v", err, readErr)
+	}
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// KeyFormatPortable is the CacheInfo.KeyFormat of caches whose keys are in
+// the canonical form produced by CacheKey.
+const KeyFormatPortable = 1
+
+// CacheKey returns the canonical cache key for a path relative to the copy
+// root: forward slashes and Unicode NFC. Keys therefore match between the
+// Windows and Linux builds and between file systems that store names
+// decomposed (macOS) or composed. Backslashes become slashes on every
+// platform, filepath.ToSlash would leave the keys of older Windows versions
+// alone on Linux.
+func CacheKey(relPath string) string {
+	key := strings.ReplaceAll(relPath, `\`, "/")
+	if !norm.NFC.IsNormalString(key) {
+		key = norm.NFC.String(key)
+	}
+	return key
+}
+
+// KeyPath converts a cache key back to a relative path for this platform.
+func KeyPath(key string) string {
+	return filepath.FromSlash(key)
+}
+
+// RebasePath replaces the prefix from of path with to. Separators are
+// compared and replaced independent of the platform, so a Windows path can be
+// rebased onto a Linux mount point and vice versa. It reports whether path
+// started with from.
+func RebasePath(path, from, to string) (string, bool) {
+	p := strings.ReplaceAll(path, `\`, "/")
+	f := strings.TrimRight(strings.ReplaceAll(from, `\`, "/"), "/")
+	if p != f && !strings.HasPrefix(p, f+"/") {
+		return path, false
+	}
+	rebased := strings.TrimRight(strings.ReplaceAll(to, `\`, "/"), "/") + p[len(f):]
+	return filepath.FromSlash(rebased), true
+}
+
+// NormalizeKeys rewrites every entry whose key is not in canonical form,
+// e.g. backslash keys written by older Windows versions. It returns the
+// number of entries moved.
+func (c *GlobalCache) NormalizeKeys() int {
+	c.Lock()
+	defer c.Unlock()
+	type move struct {
+		from, to string
+		entry    *CacheEntry
+	}
+	var moves []move
+	c.Range(func(key string, entry *CacheEntry) bool {
+		if canon := CacheKey(key); canon != key {
+			moves = append(moves, move{key, canon, entry})
+		}
+		return true
+	})
+	for _, m := range moves {
+		c.setErr(c.store.Delete(m.from))
+		// A key already present in canonical form is newer, keep it
+		if _, ok := c.store.Get(m.to); !ok {
+			c.setErr(c.store.Put(m.to, m.entry))
+		}
+	}
+	return len(moves)
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+const (
+	composed   = "caf\u00e9"  // é as one code point
+	decomposed = "cafe\u0301" // e followed by a combining acute accent
+)
+
+func TestCacheKey(t *testing.T) {
+	tests := []struct {
+		relPath string
+		want    string
+	}{
+		{"a.txt", "a.txt"},
+		{filepath.Join("dir", "sub", "a.txt"), "dir/sub/a.txt"},
+		{`dir\sub\a.txt`, "dir/sub/a.txt"},
+		{composed, composed},
+		{filepath.Join(decomposed, decomposed+".txt"), composed + "/" + composed + ".txt"},
+	}
+	for _, tt := range tests {
+		got := CacheKey(tt.relPath)
+		if got != tt.want {
+			t.Errorf("CacheKey(%q) = %q, want %q", tt.relPath, got, tt.want)
+		}
+		if KeyPath(got) != filepath.FromSlash(tt.want) {
+			t.Errorf("KeyPath(%q) = %q", got, KeyPath(got))
+		}
+	}
+}
+
+func TestRebasePath(t *testing.T) {
+	tests := []struct {
+		path, from, to string
+		want           string
+		ok             bool
+	}{
+		{"/mnt/src/a/b", "/mnt/src", "/data", "/data/a/b", true},
+		{"/mnt/src/a/b", "/mnt/src/", "/data/", "/data/a/b", true},
+		{"/mnt/src", "/mnt/src", "/data", "/data", true},
+		{`C:\src\a\b`, `C:\src`, "/mnt/c/src", "/mnt/c/src/a/b", true},
+		{"/mnt/src/a", "/mnt/src", `D:\src`, "D:/src/a", true},
+		{"/mnt/srcother/a", "/mnt/src", "/data", "/mnt/srcother/a", false},
+		{"/other/a", "/mnt/src", "/data", "/other/a", false},
+	}
+	for _, tt := range tests {
+		got, ok := RebasePath(tt.path, tt.from, tt.to)
+		if got != filepath.FromSlash(tt.want) || ok != tt.ok {
+			t.Errorf("RebasePath(%q, %q, %q) = %q, %v; want %q, %v",
+				tt.path, tt.from, tt.to, got, ok, filepath.FromSlash(tt.want), tt.ok)
+		}
+	}
+}
+
+func TestNormalizeKeys(t *testing.T) {
+	cache := newCache(t, filepath.Join(t.TempDir(), "cache.json"))
+	// Written the way older versions stored keys, bypassing CacheKey
+	cache.store.Put(decomposed+"/old", &CacheEntry{Hash: 1})
+	cache.store.Put(decomposed+"/both", &CacheEntry{Hash: 2})
+	cache.store.Put(composed+"/both", &CacheEntry{Hash: 3})
+	cache.store.Put("plain", &CacheEntry{Hash: 4})
+	cache.store.Put(`win\dir\file`, &CacheEntry{Hash: 5})
+
+	if moved := cache.NormalizeKeys(); moved != 3 {
+		t.Errorf("NormalizeKeys() moved %d entries, want 3", moved)
+	}
+	got := map[string]uint64{}
+	cache.Range(func(key string, e *CacheEntry) bool {
+		got[key] = e.Hash
+		return true
+	})
+	want := map[string]uint64{composed + "/old": 1, composed + "/both": 3, "plain": 4, "win/dir/file": 5}
+	if len(got) != len(want) {
+		t.Errorf("keys after NormalizeKeys() = %v, want %v", got, want)
+	}
+	for key, hash := range want {
+		if got[key] != hash {
+			t.Errorf("entry %q has hash %d, want %d", key, got[key], hash)
+		}
+	}
+}
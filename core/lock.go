@@ -0,0 +1,92 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// CacheLock is an exclusive lock on a cache, held as an OS file lock on a
+// lock file next to it so runs sharing a cache directory can't write the
+// same cache at once. The OS drops the lock when its process ends, so a
+// lock file left behind by a crashed run never blocks the next one.
+type CacheLock struct {
+	f *os.File
+}
+
+// lockOwner is the content of a lock file, only used to report who holds it.
+type lockOwner struct {
+	PID      int
+	Host     string
+	Acquired int64 // Unix timestamp
+}
+
+// errLocked is returned by lockFile when another process holds the lock.
+var errLocked = errors.New("locked")
+
+// LockPath returns the lock file belonging to a cache path.
+func LockPath(path string) string {
+	return path + ".lock"
+}
+
+// LockCache acquires the lock for the cache at path. A lock held by another
+// process is reported as an error naming its owner.
+func LockCache(path string) (*CacheLock, error) {
+	host, _ := os.Hostname()
+	owner, err := json.Marshal(lockOwner{PID: os.Getpid(), Host: host, Acquired: time.Now().Unix()})
+	if err != nil {
+		return nil, err
+	}
+	lockPath := LockPath(path)
+	for attempt := 0; attempt < 10; attempt++ {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(f); err != nil {
+			f.Close()
+			if err == errLocked {
+				return nil, lockedError(lockPath, host)
+			}
+			return nil, err
+		}
+		// The previous holder may have removed the file on Unlock after
+		// it was opened here, a lock on that file excludes nobody.
+		if fi, err := f.Stat(); err == nil {
+			if cur, err := os.Stat(lockPath); err != nil || !os.SameFile(fi, cur) {
+				f.Close()
+				continue
+			}
+		}
+		if err := f.Truncate(0); err == nil {
+			_, err = f.WriteAt(owner, 0)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &CacheLock{f: f}, nil
+	}
+	return nil, fmt.Errorf("could not acquire cache lock %s", lockPath)
+}
+
+// lockedError describes the owner of a held lock from its lock file.
+func lockedError(lockPath, host string) error {
+	var held lockOwner
+	data, err := os.ReadFile(lockPath)
+	if err != nil || json.Unmarshal(data, &held) != nil {
+		return fmt.Errorf("cache is locked by another process (%s)", lockPath)
+	}
+	since := time.Unix(held.Acquired, 0).Format("2006-01-02 15:04:05")
+	if held.Host != host {
+		return fmt.Errorf("cache is locked by process %d on host %s since %s", held.PID, held.Host, since)
+	}
+	return fmt.Errorf("cache is locked by running process %d since %s", held.PID, since)
+}
+
+// Unlock releases the lock and removes the lock file.
+func (l *CacheLock) Unlock() error {
+	return unlockFile(l.f)
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	lock, err := LockCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockCache(path); err == nil || !strings.Contains(err.Error(), "running process") {
+		t.Errorf("second LockCache() error = %v, want the lock to be held", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if Exists(LockPath(path)) {
+		t.Error("Unlock left the lock file behind")
+	}
+	lock, err = LockCache(path)
+	if err != nil {
+		t.Fatalf("LockCache() after Unlock: %v", err)
+	}
+	lock.Unlock()
+}
+
+func lockContent(pid int, host string) string {
+	data, _ := json.Marshal(lockOwner{PID: pid, Host: host, Acquired: time.Now().Unix()})
+	return string(data)
+}
+
+func TestLockCacheLeftBehind(t *testing.T) {
+	host, _ := os.Hostname()
+	// Nobody holds the OS lock on these files, whatever they say
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"dead process", lockContent(0, host)},
+		{"live process", lockContent(os.Getpid(), host)},
+		{"other host", lockContent(1, host+"-other")},
+		{"unreadable", "{"},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.json")
+			if err := os.WriteFile(LockPath(path), []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			lock, err := LockCache(path)
+			if err != nil {
+				t.Fatalf("LockCache() error = %v, want the lock taken over", err)
+			}
+			defer lock.Unlock()
+			var held lockOwner
+			data, _ := os.ReadFile(LockPath(path))
+			if json.Unmarshal(data, &held) != nil || held.PID != os.Getpid() {
+				t.Errorf("lock file = %q, want this process as owner", data)
+			}
+		})
+	}
+}
+
+func TestLockCacheHeld(t *testing.T) {
+	host, _ := os.Hostname()
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"this host", lockContent(12345, host), "running process 12345"},
+		{"other host", lockContent(12345, host+"-other"), "on host " + host + "-other"},
+		// Locked but not yet written, or written by something else
+		{"unreadable", "{", "another process"},
+		{"empty", "", "another process"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.json")
+			f, err := os.OpenFile(LockPath(path), os.O_CREATE|os.O_RDWR, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if err := lockFile(f); err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString(tt.content)
+
+			if _, err := LockCache(path); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LockCache() error = %v, want %q", err, tt.want)
+			}
+			if data, _ := os.ReadFile(LockPath(path)); string(data) != tt.content {
+				t.Errorf("held lock file changed to %q", data)
+			}
+		})
+	}
+}
+
+func TestLockCacheExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	var holders, acquired atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				lock, err := LockCache(path)
+				if err != nil {
+					continue
+				}
+				if holders.Add(1) != 1 {
+					t.Error("two holders of the cache lock at once")
+				}
+				acquired.Add(1)
+				holders.Add(-1)
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired.Load() == 0 {
+		t.Error("the lock was never acquired")
+	}
+}
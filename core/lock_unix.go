@@ -0,0 +1,28 @@
+//go:build !windows
+
+package core
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes an exclusive flock on f without waiting.
+func lockFile(f *os.File) error {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
+
+// unlockFile removes the lock file while the lock is still held, so no
+// other run can lock the file about to disappear, then releases it.
+func unlockFile(f *os.File) error {
+	err := os.Remove(f.Name())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+//go:build windows
+
+package core
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockOffset is where the locked byte lies, past the owner written at the
+// start of the file: Windows locks are mandatory, and other runs must still
+// be able to read who holds the lock.
+const lockOffset = 1 << 32
+
+// lockFile takes an exclusive LockFileEx lock on f without waiting.
+func lockFile(f *os.File) error {
+	ol := windows.Overlapped{OffsetHigh: lockOffset >> 32}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &ol)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return errLocked
+	}
+	return err
+}
+
+// unlockFile releases the lock and removes the lock file. A file opened
+// without FILE_SHARE_DELETE can't be removed, so while another run has just
+// opened it the removal fails harmlessly and the file stays.
+func unlockFile(f *os.File) error {
+	err := f.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// A destination manifest records what was copied into a destination root,
+// using paths relative to that root, so any machine can resume incremental
+// copies into it or verify it without the original cache file. It lives in
+// ManifestDir inside the destination and is written as one checksummed JSON
+// line per file after a header line.
+
+// ManifestDir is the directory inside the destination root holding the manifest.
+const ManifestDir = ".cache_copy"
+
+const (
+	manifestName    = "manifest"
+	manifestFormat  = "cache_copy-manifest"
+	manifestVersion = 1
+)
+
+// ManifestEntry describes one file in a destination manifest.
+type ManifestEntry struct {
+	Path    string `json:"path"`            // Relative path as a cache key, see CacheKey
+	Size    int64  `json:"size"`            // File size in bytes
+	Hash    string `json:"hash"`            // xxHash64 of the content, hex
+	Chunk   int64  `json:"chunk,omitempty"` // Chunk size when Hash is a chunked digest, see FileHashChunked
+	ModTime int64  `json:"mtime,omitempty"` // Source mtime (UnixNano)
+}
+
+type manifestHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Created int64  `json:"created"`
+}
+
+// ManifestPath returns the manifest location for a destination root.
+func ManifestPath(dstRoot string) string {
+	return filepath.Join(dstRoot, ManifestDir, manifestName)
+}
+
+// WriteManifest atomically writes the manifest of dstRoot from the cache
+// entries and returns the number of files recorded.
+func WriteManifest(dstRoot string, cache *GlobalCache) (int, error) {
+	path := ManifestPath(dstRoot)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return 0, err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriterSize(f, 1<<20)
+	writeLine := func(v interface{}) error {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		checksumLine(w, line)
+		return nil
+	}
+
+	n := 0
+	err = writeLine(manifestHeader{Format: manifestFormat, Version: manifestVersion, Created: time.Now().Unix()})
+	if err == nil {
+		cache.RLock()
+		cache.Range(func(key string, e *CacheEntry) bool {
+			if e.LinkTarget != "" {
+				return true // Links can't be verified by content
+			}
+			err = writeLine(ManifestEntry{
+				Path:    key,
+				Size:    e.Size,
+				Hash:    fmt.Sprintf("%016x", e.Hash),
+				Chunk:   e.HashChunk,
+				ModTime: e.SourceModTime,
+			})
+			n++
+			return err == nil
+		})
+		cache.RUnlock()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return n, nil
+}
+
+// ReadManifest calls fn for every entry in the manifest of dstRoot until fn
+// returns false. A damaged line is reported as an error.
+func ReadManifest(dstRoot string, fn func(ManifestEntry) bool) error {
+	path := ManifestPath(dstRoot)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line, ok := verifyLine(scanner.Bytes())
+		if !ok {
+			return fmt.Errorf("%w: %s line %d fails its checksum", ErrCacheCorrupt, path, lineNo)
+		}
+		if lineNo == 1 {
+			var hdr manifestHeader
+			if err := json.Unmarshal(line, &hdr); err != nil || hdr.Format != manifestFormat {
+				return fmt.Errorf("%s is not a cache_copy manifest", path)
+			}
+			if hdr.Version > manifestVersion {
+				return fmt.Errorf("%s has version %d, newer than supported version %d", path, hdr.Version, manifestVersion)
+			}
+			continue
+		}
+		var e ManifestEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("%w: %s line %d: %v", ErrCacheCorrupt, path, lineNo, err)
+		}
+		if !fn(e) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// SeedFromManifest adds cache entries for manifest files the cache doesn't
+// know yet. Seeded entries carry no inode or ctime, so their sources are
+// hashed once and compared against the manifest hash instead of recopied.
+// It returns the number of entries added.
+func SeedFromManifest(dstRoot string, cache *GlobalCache) (int, error) {
+	added := 0
+	cache.Lock()
+	defer cache.Unlock()
+	err := ReadManifest(dstRoot, func(e ManifestEntry) bool {
+		if _, ok := cache.IsUpToDate(e.Path); ok {
+			return true
+		}
+		hash, err := strconv.ParseUint(e.Hash, 16, 64)
+		if err != nil {
+			return true
+		}
+		cache.Put(e.Path, &CacheEntry{Size: e.Size, Hash: hash, HashChunk: e.Chunk, SourceModTime: e.ModTime})
+		added++
+		return true
+	})
+	return added, err
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	cache := newCache(t, filepath.Join(dir, "cache.json"))
+	cache.Put("a.txt", &CacheEntry{Size: 1, Hash: 0xabc, SourceModTime: 5})
+	cache.Put("sub/big.bin", &CacheEntry{Size: 2, Hash: 0xdef, HashChunk: 1 << 20})
+	cache.Put("link", &CacheEntry{Size: 3, LinkTarget: "a.txt"})
+
+	dst := filepath.Join(dir, "dst")
+	n, err := WriteManifest(dst, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("WriteManifest() recorded %d files, want 2 without the link", n)
+	}
+	got := map[string]ManifestEntry{}
+	if err := ReadManifest(dst, func(e ManifestEntry) bool {
+		got[e.Path] = e
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]ManifestEntry{
+		"a.txt":       {Path: "a.txt", Size: 1, Hash: "0000000000000abc", ModTime: 5},
+		"sub/big.bin": {Path: "sub/big.bin", Size: 2, Hash: "0000000000000def", Chunk: 1 << 20},
+	}
+	if len(got) != len(want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+	for path, e := range want {
+		if got[path] != e {
+			t.Errorf("entry %q = %+v, want %+v", path, got[path], e)
+		}
+	}
+	if _, err := os.Stat(ManifestPath(dst) + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary manifest left behind: %v", err)
+	}
+}
+
+func TestReadManifestDamage(t *testing.T) {
+	dir := t.TempDir()
+	cache := newCache(t, filepath.Join(dir, "cache.json"))
+	cache.Put("a", &CacheEntry{Size: 1, Hash: 1})
+	if _, err := WriteManifest(dir, cache); err != nil {
+		t.Fatal(err)
+	}
+	good, _ := os.ReadFile(ManifestPath(dir))
+	lines := strings.SplitAfter(string(good), "\n")
+
+	tests := []struct {
+		name    string
+		content string
+		corrupt bool // Reported as ErrCacheCorrupt
+		errText string
+	}{
+		{"changed entry", lines[0] + strings.Replace(lines[1], `"size":1`, `"size":2`, 1), true, "checksum"},
+		{"not a manifest", checksummed(`{"format":"other","version":1}`), false, "not a cache_copy manifest"},
+		{"newer version", checksummed(`{"format":"cache_copy-manifest","version":99}`), false, "newer than supported"},
+		{"bad entry", lines[0] + checksummed(`{"path":1}`), true, "line 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.WriteFile(ManifestPath(dir), []byte(tt.content), 0644)
+			err := ReadManifest(dir, func(ManifestEntry) bool { return true })
+			if err == nil || !strings.Contains(err.Error(), tt.errText) {
+				t.Fatalf("ReadManifest() error = %v, want %q", err, tt.errText)
+			}
+			if errors.Is(err, ErrCacheCorrupt) != tt.corrupt {
+				t.Errorf("ReadManifest() error %v: ErrCacheCorrupt = %v, want %v", err, !tt.corrupt, tt.corrupt)
+			}
+		})
+	}
+}
+
+// checksummed returns line as it is written to a manifest or journal.
+func checksummed(line string) string {
+	var b strings.Builder
+	checksumLine(&b, []byte(line))
+	return b.String()
+}
+
+func TestSeedFromManifest(t *testing.T) {
+	dir := t.TempDir()
+	from := newCache(t, filepath.Join(dir, "from.json"))
+	from.Put("known", &CacheEntry{Size: 1, Hash: 1})
+	from.Put("new", &CacheEntry{Size: 2, Hash: 2, HashChunk: 64, SourceModTime: 7})
+	if _, err := WriteManifest(dir, from); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := newCache(t, filepath.Join(dir, "cache.json"))
+	cache.Put("known", &CacheEntry{Size: 1, Hash: 100, Inode: 9})
+	added, err := SeedFromManifest(dir, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 {
+		t.Errorf("SeedFromManifest() added %d entries, want 1", added)
+	}
+	if e, _ := cache.IsUpToDate("known"); e.Hash != 100 || e.Inode != 9 {
+		t.Errorf("existing entry was replaced: %+v", e)
+	}
+	e, ok := cache.IsUpToDate("new")
+	if !ok || e.Size != 2 || e.Hash != 2 || e.HashChunk != 64 || e.SourceModTime != 7 {
+		t.Errorf("seeded entry = %+v", e)
+	}
+	if e.MatchesMeta(FileMeta{Size: 2, ModTime: 7, Ctime: 8, Dev: 1, Inode: 3}) {
+		t.Error("seeded entry passes the metadata fast path without hashing")
+	}
+}
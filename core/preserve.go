@@ -0,0 +1,145 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// PreserveFlags selects which source metadata is applied to copied files and
+// directories, see ParsePreserve.
+type PreserveFlags uint8
+
+const (
+	PreserveTimes PreserveFlags = 1 << iota // Access and modification times
+	PreserveMode                            // Permission bits, setuid, setgid and sticky
+	PreserveOwner                           // User and group (only effective when running as root)
+	PreserveXattr                           // Extended attributes (Linux)
+	PreserveACL                             // POSIX ACLs (Linux)
+
+	PreserveAll = PreserveTimes | PreserveMode | PreserveOwner | PreserveXattr | PreserveACL
+)
+
+var preserveNames = []struct {
+	name string
+	flag PreserveFlags
+}{
+	{"times", PreserveTimes},
+	{"mode", PreserveMode},
+	{"owner", PreserveOwner},
+	{"xattr", PreserveXattr},
+	{"acl", PreserveACL},
+}
+
+// ParsePreserve parses a comma separated list such as "times,mode". "all"
+// selects everything and an empty string nothing.
+func ParsePreserve(s string) (PreserveFlags, error) {
+	var flags PreserveFlags
+	for _, part := range strings.Split(s, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		if part == "all" {
+			flags |= PreserveAll
+			continue
+		}
+		found := false
+		for _, p := range preserveNames {
+			if p.name == part {
+				flags |= p.flag
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown --preserve attribute %q (want times, mode, owner, xattr, acl or all)", part)
+		}
+	}
+	return flags, nil
+}
+
+func (f PreserveFlags) String() string {
+	var names []string
+	for _, p := range preserveNames {
+		if f&p.flag != 0 {
+			names = append(names, p.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// applyPreserved copies the selected metadata of the source file or
+// directory srcPath to dstPath. Times are set last, after everything that
+// could modify them. Failing to change the owner without privileges is not
+// an error, like cp -p.
+func applyPreserved(srcPath, dstPath string, srcInfo os.FileInfo, flags PreserveFlags) error {
+	var errs []error
+	if flags&PreserveOwner != 0 {
+		if uid, gid, ok := fileOwner(srcInfo); ok {
+			if err := os.Lchown(dstPath, uid, gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if flags&(PreserveXattr|PreserveACL) != 0 {
+		if err := copyXattrs(srcPath, dstPath, flags); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if flags&PreserveMode != 0 {
+		mode := srcInfo.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+		if err := os.Chmod(dstPath, mode); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if flags&PreserveTimes != 0 {
+		if err := os.Chtimes(dstPath, fileAtime(srcInfo), srcInfo.ModTime()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// preservedDiffers reports whether the selected times, mode or owner of an
+// existing destination differ from its source, so skipped files pick up
+// metadata changes and a first run with --preserve fixes older copies.
+// Extended attributes and ACLs are not compared.
+func preservedDiffers(srcInfo, dstInfo os.FileInfo, flags PreserveFlags) bool {
+	if flags&PreserveTimes != 0 && !sameModTime(srcInfo.ModTime(), dstInfo.ModTime()) {
+		return true
+	}
+	if flags&PreserveMode != 0 && dstInfo.Mode() != srcInfo.Mode() {
+		return true
+	}
+	if flags&PreserveOwner != 0 {
+		srcUID, srcGID, ok1 := fileOwner(srcInfo)
+		dstUID, dstGID, ok2 := fileOwner(dstInfo)
+		if ok1 && ok2 && (srcUID != dstUID || srcGID != dstGID) {
+			return true
+		}
+	}
+	return false
+}
+
+// coarseTimeStep is the largest timestamp granularity of the destination file
+// systems we meet: FAT stores modification times in 2 second steps, ext3,
+// HFS+ and some SMB servers in whole seconds.
+const coarseTimeStep = 2 * time.Second
+
+// sameModTime reports whether a destination mtime is the source mtime as the
+// destination file system can store it. A destination time without a
+// fraction of a second may have been rounded by a coarse file system, so it
+// only has to be within coarseTimeStep.
+func sameModTime(src, dst time.Time) bool {
+	if src.Equal(dst) {
+		return true
+	}
+	if dst.Nanosecond() != 0 {
+		return false
+	}
+	diff := src.Sub(dst)
+	return diff > -coarseTimeStep && diff < coarseTimeStep
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// unsupportedPreserve lists the --preserve attributes this platform ignores.
+const unsupportedPreserve PreserveFlags = 0
+
+// fileAtime returns the last access time of a file.
+func fileAtime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return info.ModTime()
+}
+
+// copyXattrs copies extended attributes from src to dst. Attributes in the
+// system namespace (POSIX ACLs such as system.posix_acl_access) are copied
+// with PreserveACL, all others with PreserveXattr.
+func copyXattrs(src, dst string, flags PreserveFlags) error {
+	names, err := listXattrs(src)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		return &os.PathError{Op: "listxattr", Path: src, Err: err}
+	}
+	var errs []error
+	for _, name := range names {
+		isACL := strings.HasPrefix(name, "system.")
+		if (isACL && flags&PreserveACL == 0) || (!isACL && flags&PreserveXattr == 0) {
+			continue
+		}
+		value, err := getXattr(src, name)
+		if err != nil {
+			errs = append(errs, &os.PathError{Op: "getxattr " + name, Path: src, Err: err})
+			continue
+		}
+		if err := unix.Lsetxattr(dst, name, value, 0); err != nil {
+			errs = append(errs, &os.PathError{Op: "setxattr " + name, Path: dst, Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func listXattrs(path string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := unix.Llistxattr(path, buf)
+		if err == unix.ERANGE {
+			continue // Grew in between
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range strings.Split(string(buf[:n]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := unix.Lgetxattr(path, name, buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package core
+
+import (
+	"os"
+	"runtime"
+	"time"
+)
+
+// unsupportedPreserve lists the --preserve attributes this platform ignores.
+var unsupportedPreserve = func() PreserveFlags {
+	if runtime.GOOS == "windows" {
+		return PreserveOwner | PreserveXattr | PreserveACL
+	}
+	return PreserveXattr | PreserveACL
+}()
+
+// fileAtime falls back to the modification time where the access time is
+// not portable.
+func fileAtime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// copyXattrs is only implemented on Linux.
+func copyXattrs(src, dst string, flags PreserveFlags) error {
+	return nil
+}
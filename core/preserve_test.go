@@ -0,0 +1,106 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParsePreserve(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PreserveFlags
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"times", PreserveTimes, false},
+		{"times,mode", PreserveTimes | PreserveMode, false},
+		{" Mode , OWNER,", PreserveMode | PreserveOwner, false},
+		{"all", PreserveAll, false},
+		{"xattr,all", PreserveAll, false},
+		{"times,perms", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePreserve(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParsePreserve(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if s := (PreserveTimes | PreserveACL).String(); s != "times,acl" {
+		t.Errorf("String() = %q, want times,acl", s)
+	}
+}
+
+func TestSameModTime(t *testing.T) {
+	src := time.Date(2024, 5, 1, 12, 0, 1, 500_000_000, time.UTC)
+	tests := []struct {
+		name string
+		dst  time.Time
+		want bool
+	}{
+		{"equal", src, true},
+		{"other nanoseconds", src.Add(time.Millisecond), false},
+		{"truncated to seconds", src.Truncate(time.Second), true},
+		{"rounded to 2 seconds", time.Date(2024, 5, 1, 12, 0, 2, 0, time.UTC), true},
+		{"FAT, rounded down", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), true},
+		{"whole seconds, too far", src.Truncate(time.Second).Add(-2 * time.Second), false},
+		{"older copy", src.Add(-time.Hour).Truncate(time.Second), false},
+	}
+	for _, tt := range tests {
+		if got := sameModTime(src, tt.dst); got != tt.want {
+			t.Errorf("%s: sameModTime(%v, %v) = %v, want %v", tt.name, src, tt.dst, got, tt.want)
+		}
+	}
+}
+
+func TestEnginePreserve(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("modes are not preserved on Windows")
+	}
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	writeTree(t, src, map[string]string{"ro/a": "a", "b": "b"})
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chmod(filepath.Join(src, "b"), 0600)
+	os.Chtimes(filepath.Join(src, "b"), mtime, mtime)
+	os.Chmod(filepath.Join(src, "ro"), 0555)
+	defer os.Chmod(filepath.Join(src, "ro"), 0755)
+	defer os.Chmod(filepath.Join(dst, "ro"), 0755)
+	cache := newCache(t, filepath.Join(dir, "cache.json"))
+	opts := Options{Src: src, Dst: dst, Cache: cache, Preserve: PreserveTimes | PreserveMode}
+
+	check := func() {
+		t.Helper()
+		for _, rel := range []string{"b", "ro", "ro/a"} {
+			srcInfo, _ := os.Stat(filepath.Join(src, rel))
+			dstInfo, err := os.Stat(filepath.Join(dst, rel))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if preservedDiffers(srcInfo, dstInfo, opts.Preserve) {
+				t.Errorf("%s: destination %v %v, source %v %v", rel, dstInfo.Mode(), dstInfo.ModTime(), srcInfo.Mode(), srcInfo.ModTime())
+			}
+		}
+	}
+	runEngine(t, opts)
+	check()
+
+	// A changed file in a directory made read-only by the first run
+	os.Chmod(filepath.Join(src, "ro"), 0755)
+	writeTree(t, src, map[string]string{"ro/a": "changed"})
+	os.Chmod(filepath.Join(src, "ro"), 0555)
+	res, _ := runEngine(t, opts)
+	if res.Copied != 1 || res.Failed != 0 {
+		t.Errorf("copy into read-only directory: %+v", res)
+	}
+	check()
+
+	// Metadata changes alone are applied to skipped files
+	os.Chmod(filepath.Join(src, "b"), 0640)
+	if res, _ := runEngine(t, opts); res.Copied != 0 {
+		t.Errorf("mode change copied %d files", res.Copied)
+	}
+	check()
+}
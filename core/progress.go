@@ -0,0 +1,26 @@
+package core
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// worker is the state of one copy goroutine: its buffer and how many bytes
+// of the file it is working on have been copied so far. The progress events
+// add those bytes to the completed files, so progress moves inside large files.
+type worker struct {
+	buf   []byte
+	moved atomic.Int64
+}
+
+// progressWriter counts the bytes written through it into moved.
+type progressWriter struct {
+	w     io.Writer
+	moved *atomic.Int64
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.moved.Add(int64(n))
+	return n, err
+}
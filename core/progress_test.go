@@ -0,0 +1,58 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProgressWriter(t *testing.T) {
+	var buf bytes.Buffer
+	var moved atomic.Int64
+	moved.Store(5)
+	pw := progressWriter{&buf, &moved}
+	pw.Write([]byte("hello"))
+	pw.Write([]byte(" world"))
+	if moved.Load() != 16 || buf.String() != "hello world" {
+		t.Errorf("moved = %d, written %q", moved.Load(), buf.String())
+	}
+}
+
+func TestEngineProgress(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	files := map[string]string{"a": strings.Repeat("a", 300_000), "b": "bb", "c/d": strings.Repeat("d", 1000)}
+	writeTree(t, src, files)
+	cache := newCache(t, filepath.Join(dir, "cache.json"))
+
+	for run := 0; run < 2; run++ {
+		var progress []Event
+		opts := Options{Src: src, Dst: dst, Cache: cache, BufferSize: 4096, OnEvent: func(ev Event) {
+			if ev.Kind == EventProgress {
+				progress = append(progress, ev)
+			}
+		}}
+		res, err := NewEngine(opts).Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.TotalBytes != 301_002 {
+			t.Errorf("TotalBytes = %d, want 301002", res.TotalBytes)
+		}
+		if len(progress) == 0 {
+			t.Fatal("no progress events")
+		}
+		for _, ev := range progress {
+			if ev.TotalBytes != res.TotalBytes || ev.Bytes > ev.TotalBytes {
+				t.Errorf("progress %d of %d, total %d", ev.Bytes, ev.TotalBytes, res.TotalBytes)
+			}
+		}
+		// Skipped files count as processed, so an unchanged run ends at 100% as well
+		if last := progress[len(progress)-1]; last.Bytes != res.TotalBytes {
+			t.Errorf("run %d: last progress %d of %d", run, last.Bytes, last.TotalBytes)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"time"
+)
+
+// RetryPolicy controls how file operations that fail with a transient error,
+// as seen on flaky SMB and NFS mounts, are retried before the file counts as
+// failed. Files that still fail are retried once more in the deferred passes
+// at the end of a run, see Options.Retries.
+type RetryPolicy struct {
+	Attempts  int              // Tries of each operation, 1 disables retries
+	Delay     time.Duration    // Wait before the first retry, doubled for each further one
+	MaxDelay  time.Duration    // Upper bound of the wait, 0 for none
+	Jitter    float64          // Random fraction (0-1) added to or taken from each wait
+	Retryable func(error) bool // Errors worth retrying (default: IsTransient)
+}
+
+// DefaultRetryPolicy returns the policy used when Options.Retry is not set:
+// 3 tries, waiting 200 ms and then 400 ms, with 20% jitter.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{Attempts: 3, Delay: 200 * time.Millisecond, MaxDelay: 5 * time.Second, Jitter: 0.2}
+}
+
+// Backoff returns the wait before retry n (1 for the first retry).
+func (p RetryPolicy) Backoff(n int) time.Duration {
+	d := p.Delay
+	for i := 1; i < n && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return d
+}
+
+// Do runs op until it succeeds, fails with an error that isn't retryable or
+// has been tried Attempts times, and returns its last error. Waiting for
+// the next try ends early when ctx is done.
+func (p RetryPolicy) Do(ctx context.Context, op func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsTransient
+	}
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.Attempts || !retryable(err) {
+			return err
+		}
+		timer := time.NewTimer(p.Backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// Open opens path for reading, retrying as the policy allows. An open that
+// hangs past the deadline of ctx is abandoned, see interruptibleOpen.
+func (p RetryPolicy) Open(ctx context.Context, path string) (*os.File, error) {
+	var f *os.File
+	err := p.Do(ctx, func() (err error) {
+		f, err = interruptibleOpen(ctx, func() (*os.File, error) { return os.Open(path) }, nil)
+		return err
+	})
+	return f, err
+}
+
+// interruptible runs a blocking file system call such as fsync or rename.
+// When ctx has a deadline (Options.FileTimeout) the call runs on its own
+// goroutine and is abandoned once ctx is done, so a call hung on a stalled
+// network mount fails the file instead of blocking its worker forever.
+func interruptible(ctx context.Context, call func() error) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return call()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- call() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// interruptibleOpen is interruptible for a call that opens a file. When the
+// open is abandoned and completes later, the file is closed and passed to
+// release, if set, to undo the rest.
+func interruptibleOpen(ctx context.Context, open func() (*os.File, error), release func(*os.File)) (*os.File, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return open()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type result struct {
+		f   *os.File
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		f, err := open()
+		done <- result{f, err}
+	}()
+	select {
+	case r := <-done:
+		return r.f, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.err == nil {
+				r.f.Close()
+				if release != nil {
+					release(r.f)
+				}
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// IsTransient reports whether err is one of the errors of a busy or briefly
+// unreachable file system (see transientErrors) that may succeed when retried.
+func IsTransient(err error) bool {
+	for _, name := range transientErrors {
+		if errors.Is(err, errorNames[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRetryErrors parses a --retry-errors value: "transient" for
+// IsTransient, "all", "none", or a comma separated list of error names
+// (see errorNames), e.g. "EIO,ESTALE".
+func ParseRetryErrors(s string) (func(error) bool, error) {
+	switch strings.ToLower(s) {
+	case "", "transient":
+		return IsTransient, nil
+	case "all":
+		return func(error) bool { return true }, nil
+	case "none":
+		return func(error) bool { return false }, nil
+	}
+	var errs []error
+	for _, name := range strings.Split(s, ",") {
+		err, ok := errorNames[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown error name %q in --retry-errors", name)
+		}
+		errs = append(errs, err)
+	}
+	return func(err error) bool {
+		for _, e := range errs {
+			if errors.Is(err, e) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
@@ -0,0 +1,163 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{Delay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for n, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if got := p.Backoff(n + 1); got != want*time.Millisecond {
+			t.Errorf("Backoff(%d) = %v, want %v", n+1, got, want*time.Millisecond)
+		}
+	}
+	if got := (RetryPolicy{Delay: time.Millisecond}).Backoff(40); got != time.Millisecond<<39 {
+		t.Errorf("Backoff(40) without MaxDelay = %v", got)
+	}
+
+	p.Jitter = 0.2
+	for i := 0; i < 1000; i++ {
+		if d := p.Backoff(2); d < 160*time.Millisecond || d > 240*time.Millisecond {
+			t.Fatalf("Backoff(2) with 20%% jitter = %v, want 160-240ms", d)
+		}
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	transient := fmt.Errorf("read: %w", errorNames[transientErrors[0]])
+	permanent := errors.New("permanent")
+	tests := []struct {
+		name     string
+		errs     []error // Returned by the tries in order, nil after the last
+		attempts int
+		want     error
+		tries    int
+	}{
+		{"success", nil, 3, nil, 1},
+		{"recovers", []error{transient, transient}, 3, nil, 3},
+		{"gives up", []error{transient, transient, transient, transient}, 3, transient, 3},
+		{"not retryable", []error{permanent}, 3, permanent, 1},
+		{"retries disabled", []error{transient}, 1, transient, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := RetryPolicy{Attempts: tt.attempts, Delay: time.Millisecond}
+			tries := 0
+			err := p.Do(context.Background(), func() error {
+				tries++
+				if tries <= len(tt.errs) {
+					return tt.errs[tries-1]
+				}
+				return nil
+			})
+			if err != tt.want || tries != tt.tries {
+				t.Errorf("Do() = %v after %d tries, want %v after %d", err, tries, tt.want, tt.tries)
+			}
+		})
+	}
+
+	t.Run("cancelled while waiting", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		p := RetryPolicy{Attempts: 5, Delay: time.Hour, Retryable: func(error) bool { return true }}
+		start := time.Now()
+		if err := p.Do(ctx, func() error { return permanent }); err != permanent || time.Since(start) > time.Second {
+			t.Errorf("Do() = %v after %v, want the op error once ctx is done", err, time.Since(start))
+		}
+	})
+}
+
+func TestParseRetryErrors(t *testing.T) {
+	// A transient error and a named error that isn't transient
+	transientName, otherName := transientErrors[0], ""
+	for _, name := range slices.Sorted(maps.Keys(errorNames)) {
+		if !IsTransient(errorNames[name]) {
+			otherName = name
+			break
+		}
+	}
+	transient, other := errorNames[transientName], errorNames[otherName]
+
+	retryable, err := ParseRetryErrors(" " + strings.ToLower(otherName) + " ," + transientName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !retryable(fmt.Errorf("wrapped: %w", other)) || !retryable(transient) || retryable(errors.New("x")) {
+		t.Errorf("named errors %s and %s are not matched exactly", otherName, transientName)
+	}
+
+	tests := []struct {
+		in        string
+		transient bool
+		other     bool
+	}{
+		{"", true, false},
+		{"transient", true, false},
+		{"ALL", true, true},
+		{"none", false, false},
+	}
+	for _, tt := range tests {
+		retryable, err := ParseRetryErrors(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retryable(transient) != tt.transient || retryable(other) != tt.other {
+			t.Errorf("ParseRetryErrors(%q) retries transient %v, other %v; want %v, %v",
+				tt.in, retryable(transient), retryable(other), tt.transient, tt.other)
+		}
+	}
+	if _, err := ParseRetryErrors("EIO,EWHAT"); err == nil {
+		t.Error("unknown error name accepted")
+	}
+}
+
+func TestInterruptible(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := interruptible(ctx, func() error { <-hang; return nil })
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Errorf("hung call returned %v after %v, want the deadline", err, time.Since(start))
+	}
+	if err := interruptible(context.Background(), func() error { return os.ErrClosed }); err != os.ErrClosed {
+		t.Errorf("call without deadline returned %v", err)
+	}
+
+	// An open that completes after it was abandoned is undone
+	path := filepath.Join(t.TempDir(), "f")
+	opened := make(chan struct{})
+	released := make(chan *os.File, 1)
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	f, err := interruptibleOpen(ctx, func() (*os.File, error) {
+		<-opened
+		return os.Create(path)
+	}, func(f *os.File) {
+		os.Remove(f.Name())
+		released <- f
+	})
+	if f != nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("interruptibleOpen() = %v, %v; want the deadline", f, err)
+	}
+	close(opened)
+	select {
+	case <-released:
+		if Exists(path) {
+			t.Error("abandoned file was not removed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("abandoned file was not released")
+	}
+}
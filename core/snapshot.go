@@ -0,0 +1,197 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Snapshot files start with a one-line JSON header followed by the JSON body:
+//
+//	{"format":"cache_copy","version":3,"generation":7,"entries":1234,"checksum":"..."}
+//	{"a/b.txt":{...},...}
+//
+// The checksum is the xxHash64 of the body, so a truncated or damaged file is
+// detected on load. Files without a header are the original headerless format
+// and are read as a bare JSON object.
+
+const (
+	snapshotFormat  = "cache_copy"
+	snapshotVersion = 3 // 3: LastCopied/LastVerified replace ModTime
+)
+
+// ErrCacheCorrupt is returned when a cache file fails its header or checksum validation.
+var ErrCacheCorrupt = errors.New("cache file is corrupted")
+
+// ErrCacheVersion is returned for a cache file written by a newer version,
+// which this one must neither read nor replace.
+var ErrCacheVersion = errors.New("cache file is from a newer version")
+
+// snapshotHeader is the first line of a snapshot file.
+type snapshotHeader struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	Generation uint64 `json:"generation"`
+	Entries    int    `json:"entries"`
+	Checksum   string `json:"checksum"`
+}
+
+// PrevSnapshotPath returns the path holding the previous good generation of a snapshot.
+func PrevSnapshotPath(path string) string {
+	return path + ".prev"
+}
+
+// readSnapshot loads and validates a snapshot file.
+func readSnapshot(path string) (map[string]*CacheEntry, snapshotHeader, error) {
+	var hdr snapshotHeader
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, hdr, err
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, hdr, fmt.Errorf("%w: %s is empty", ErrCacheCorrupt, path)
+	}
+
+	body := raw
+	if line, rest, found := bytes.Cut(raw, []byte("\n")); found && json.Unmarshal(line, &hdr) == nil && hdr.Format == snapshotFormat {
+		if hdr.Version > snapshotVersion {
+			return nil, hdr, fmt.Errorf("%w: %s has schema version %d, newer than supported version %d", ErrCacheVersion, path, hdr.Version, snapshotVersion)
+		}
+		if sum := fmt.Sprintf("%016x", xxhash.Sum64(rest)); sum != hdr.Checksum {
+			return nil, hdr, fmt.Errorf("%w: %s checksum mismatch (header %s, content %s)", ErrCacheCorrupt, path, hdr.Checksum, sum)
+		}
+		body = rest
+	} else {
+		hdr = snapshotHeader{Format: snapshotFormat, Version: 1}
+	}
+
+	data := make(map[string]*CacheEntry)
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, hdr, fmt.Errorf("%w: %s: %v", ErrCacheCorrupt, path, err)
+	}
+	if hdr.Version >= 2 && len(data) != hdr.Entries {
+		return nil, hdr, fmt.Errorf("%w: %s has %d entries, header says %d", ErrCacheCorrupt, path, len(data), hdr.Entries)
+	}
+	return data, hdr, nil
+}
+
+// writeSnapshotFile atomically replaces path with a snapshot of data. The
+// new content is written to a temporary file and fsynced before the current
+// file is moved aside as the previous generation and the new one renamed
+// into place, so a crash at any point leaves at least one good generation.
+// keepCurrent is false when the file at path is known to be bad and must not
+// replace the previous generation.
+func writeSnapshotFile(path string, data map[string]*CacheEntry, generation uint64, keepCurrent bool) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	hdr, err := json.Marshal(snapshotHeader{
+		Format:     snapshotFormat,
+		Version:    snapshotVersion,
+		Generation: generation,
+		Entries:    len(data),
+		Checksum:   fmt.Sprintf("%016x", xxhash.Sum64(body)),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.Write(hdr)
+	w.WriteByte('\n')
+	w.Write(body)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if keepCurrent {
+		if err := os.Rename(path, PrevSnapshotPath(path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir flushes directory metadata so renames survive a power cut.
+// Errors are ignored: not every platform supports syncing a directory.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// checksumLine prefixes a journal record with the xxHash64 of its content.
+func checksumLine(w io.Writer, rec []byte) {
+	fmt.Fprintf(w, "%016x %s\n", xxhash.Sum64(rec), rec)
+}
+
+// verifyLine checks a journal line written by checksumLine and returns the
+// record. Lines starting with '{' predate journal checksums and are accepted
+// as they are.
+func verifyLine(line []byte) ([]byte, bool) {
+	if len(line) > 0 && line[0] == '{' {
+		return line, true
+	}
+	sum, rec, found := bytes.Cut(line, []byte(" "))
+	if !found || string(sum) != fmt.Sprintf("%016x", xxhash.Sum64(rec)) {
+		return nil, false
+	}
+	return rec, true
+}
+
+// readJournal passes the intact records of a journal to apply and returns
+// the offset after the last one, and whether anything unusable follows it.
+// A record only counts once its newline is written, a line without one is
+// the torn end of an append.
+func readJournal(f *os.File, apply func(rec journalRecord)) (int64, bool) {
+	r := bufio.NewReaderSize(f, 64*1024)
+	var good int64
+	for {
+		raw, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			fmt.Fprintf(os.Stderr, "[%s] [ERROR] Error reading cache journal %s: %v\n", timestamp(), f.Name(), err)
+			return good, true
+		}
+		if len(raw) == 0 {
+			return good, false
+		}
+		var rec journalRecord
+		line, ok := verifyLine(bytes.TrimSuffix(raw, []byte("\n")))
+		if err == io.EOF || !ok || json.Unmarshal(line, &rec) != nil {
+			return good, true
+		}
+		apply(rec)
+		good += int64(len(raw))
+	}
+}
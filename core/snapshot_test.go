@@ -0,0 +1,176 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	data := map[string]*CacheEntry{
+		"a":     {Size: 1, Hash: 11, LastCopied: 100},
+		"b/c.d": {Size: 2, Hash: 22, SourceModTime: 200},
+	}
+	if err := writeSnapshotFile(path, data, 7, false); err != nil {
+		t.Fatal(err)
+	}
+	got, hdr, err := readSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Generation != 7 || hdr.Version != snapshotVersion || hdr.Entries != 2 {
+		t.Errorf("header = %+v", hdr)
+	}
+	if len(got) != 2 || got["a"].Hash != 11 || got["b/c.d"].SourceModTime != 200 {
+		t.Errorf("entries = %v", got)
+	}
+}
+
+func TestSnapshotDamage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	if err := writeSnapshotFile(path, map[string]*CacheEntry{"a": {Size: 1, Hash: 11}}, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	good, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, body, _ := bytes.Cut(good, []byte("\n"))
+
+	tests := []struct {
+		name    string
+		content []byte
+		corrupt bool // Reported as ErrCacheCorrupt
+	}{
+		{"empty", nil, true},
+		{"truncated", good[:len(good)-3], true},
+		{"changed body", append(append(append([]byte{}, hdr...), '\n'), bytes.Replace(body, []byte("11"), []byte("12"), 1)...), true},
+		{"entry count", []byte(string(bytes.Replace(hdr, []byte(`"entries":1`), []byte(`"entries":2`), 1)) + "\n" + string(body)), false},
+		{"newer version", []byte(string(bytes.Replace(hdr, []byte(`"version":3`), []byte(`"version":99`), 1)) + "\n" + string(body)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(path, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, _, err := readSnapshot(path)
+			if err == nil {
+				t.Fatal("damaged snapshot was accepted")
+			}
+			if tt.corrupt && !errors.Is(err, ErrCacheCorrupt) {
+				t.Errorf("error %v is not ErrCacheCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestSnapshotHeaderless(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	if err := os.WriteFile(path, []byte(`{"a":{"Size":1,"Hash":11,"ModTime":5}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, hdr, err := readSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Version != 1 {
+		t.Errorf("version = %d, want 1", hdr.Version)
+	}
+	if e := data["a"]; e == nil || e.Hash != 11 || e.LastCopied != 5 {
+		t.Errorf("entry = %+v", e)
+	}
+}
+
+func TestSnapshotKeepsPreviousGeneration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	writeSnapshotFile(path, map[string]*CacheEntry{"a": {Hash: 1}}, 1, false)
+	writeSnapshotFile(path, map[string]*CacheEntry{"a": {Hash: 2}}, 2, true)
+
+	prev, hdr, err := readSnapshot(PrevSnapshotPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Generation != 1 || prev["a"].Hash != 1 {
+		t.Errorf("previous generation %d has hash %d, want generation 1 with hash 1", hdr.Generation, prev["a"].Hash)
+	}
+
+	// A current file known to be bad must not replace the good previous one
+	os.WriteFile(path, []byte("junk"), 0644)
+	writeSnapshotFile(path, map[string]*CacheEntry{"a": {Hash: 3}}, 3, false)
+	if _, hdr, err := readSnapshot(PrevSnapshotPath(path)); err != nil || hdr.Generation != 1 {
+		t.Errorf("previous generation = %d, %v; want 1", hdr.Generation, err)
+	}
+}
+
+func TestFallbackToPreviousGeneration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	s := openStore(t, path, BackendJSON)
+	s.Put("old", &CacheEntry{Hash: 1})
+	s.Close()
+	s = openStore(t, path, BackendJSON)
+	s.Put("new", &CacheEntry{Hash: 2})
+	s.Close()
+
+	// The newer generation is damaged and has a journal of its own
+	s = openStore(t, path, BackendJSON)
+	s.Delete("old")
+	s.Put("journaled", &CacheEntry{Hash: 3})
+	crash(t, s)
+	os.WriteFile(path, []byte("junk"), 0644)
+
+	s = openStore(t, path, BackendJSON)
+	defer s.Close()
+	if _, ok := s.Get("old"); !ok {
+		t.Error("entry of the previous generation is missing")
+	}
+	if _, ok := s.Get("new"); ok {
+		t.Error("entry of the damaged generation was loaded")
+	}
+	if _, ok := s.Get("journaled"); ok {
+		t.Error("journal of the damaged generation was replayed onto the previous one")
+	}
+	if _, err := os.Stat(JournalPath(path)); !os.IsNotExist(err) {
+		t.Errorf("journal of the damaged generation was kept: %v", err)
+	}
+}
+
+func TestNewerSnapshotVersion(t *testing.T) {
+	for _, damaged := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "cache.json")
+		s := openStore(t, path, BackendJSON)
+		s.Put("a", &CacheEntry{Hash: 1})
+		s.Close()
+		s = openStore(t, path, BackendJSON)
+		s.Put("b", &CacheEntry{Hash: 2})
+		crash(t, s)
+
+		// A newer version wrote the current generation, or the previous one
+		// that a damaged current generation would fall back to
+		newer := path
+		if damaged {
+			newer = PrevSnapshotPath(path)
+			os.Rename(path, newer)
+			os.WriteFile(path, []byte("junk"), 0644)
+		}
+		data, _ := os.ReadFile(newer)
+		data = bytes.Replace(data, []byte(`"version":3`), []byte(`"version":99`), 1)
+		os.WriteFile(newer, data, 0644)
+		journal, _ := os.ReadFile(JournalPath(path))
+
+		if _, err := OpenJSONStore(path); !errors.Is(err, ErrCacheVersion) {
+			t.Fatalf("OpenJSONStore() error = %v, want ErrCacheVersion", err)
+		}
+		if _, err := OpenCacheStore(path, BackendJSON); !errors.Is(err, ErrCacheVersion) {
+			t.Errorf("OpenCacheStore() error = %v, want ErrCacheVersion", err)
+		}
+		if got, _ := os.ReadFile(newer); !bytes.Equal(got, data) {
+			t.Error("snapshot of the newer version was changed")
+		}
+		if got, _ := os.ReadFile(JournalPath(path)); len(journal) == 0 || !bytes.Equal(got, journal) {
+			t.Error("journal was discarded or changed")
+		}
+	}
+}
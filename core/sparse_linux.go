@@ -0,0 +1,103 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/sys/unix"
+)
+
+// isSparse reports whether a file has fewer blocks allocated than its size
+// needs, i.e. it probably contains holes.
+func isSparse(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Blocks*512 < st.Size
+}
+
+// copySparse copies the first size bytes of src to the empty file dst
+// extent by extent, using SEEK_DATA and SEEK_HOLE to skip holes, which stay
+// unallocated in dst. Holes are fed to the hash as zeros so the result equals
+// FileHash of the file. ok is false, with nothing written, when the file
+// system can't report holes.
+func copySparse(ctx context.Context, dst, src *os.File, size int64, buf []byte, moved *atomic.Int64) (written int64, hash uint64, ok bool, err error) {
+	h := xxhash.New()
+	var pos int64
+	for pos < size {
+		if err := ctx.Err(); err != nil {
+			return pos, 0, true, err
+		}
+		data, err := src.Seek(pos, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break // Only a hole is left
+		}
+		if err != nil {
+			if pos == 0 && errors.Is(err, unix.EINVAL) {
+				return 0, 0, false, nil
+			}
+			return pos, 0, true, err
+		}
+		if data > size {
+			data = size
+		}
+		hashZeros(h, data-pos)
+		moved.Add(data - pos)
+		hole, err := src.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return pos, 0, true, err
+		}
+		if hole > size {
+			hole = size
+		}
+		for pos = data; pos < hole; {
+			if err := ctx.Err(); err != nil {
+				return pos, 0, true, err
+			}
+			chunk := buf
+			if rest := hole - pos; rest < int64(len(chunk)) {
+				chunk = chunk[:rest]
+			}
+			n, rerr := src.ReadAt(chunk, pos)
+			if n > 0 {
+				h.Write(chunk[:n])
+				if _, werr := dst.WriteAt(chunk[:n], pos); werr != nil {
+					return pos, 0, true, werr
+				}
+				pos += int64(n)
+				moved.Add(int64(n))
+			}
+			if rerr == io.EOF {
+				// Truncated while copying, the caller sees the short count
+				return pos, h.Sum64(), true, nil
+			}
+			if rerr != nil {
+				return pos, 0, true, rerr
+			}
+		}
+	}
+	hashZeros(h, size-pos)
+	moved.Add(size - pos)
+	// A trailing hole is only created by extending the file
+	if err := dst.Truncate(size); err != nil {
+		return pos, 0, true, err
+	}
+	return size, h.Sum64(), true, nil
+}
+
+var zeros [64 * 1024]byte
+
+// hashZeros adds n zero bytes to h.
+func hashZeros(h *xxhash.Digest, n int64) {
+	for n > 0 {
+		chunk := zeros[:]
+		if n < int64(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		h.Write(chunk)
+		n -= int64(len(chunk))
+	}
+}
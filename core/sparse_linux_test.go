@@ -0,0 +1,99 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// makeSparse creates a file of size bytes holding data at the given offsets
+// and holes everywhere else.
+func makeSparse(t *testing.T, path string, size int64, data map[int64]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for off, s := range data {
+		if _, err := f.WriteAt([]byte(s), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCopySparse(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		name string
+		size int64
+		data map[int64]string
+	}{
+		{"hole in the middle", 4 * mb, map[int64]string{0: "head", 4*mb - 4: "tail"}},
+		{"leading hole", 4 * mb, map[int64]string{3 * mb: "data"}},
+		{"trailing hole", 4 * mb, map[int64]string{0: "data"}},
+		{"only a hole", 4 * mb, nil},
+		{"several extents", 8 * mb, map[int64]string{mb: "one", 3 * mb: "two", 6 * mb: "three"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			srcPath, dstPath := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+			makeSparse(t, srcPath, tt.size, tt.data)
+			src, _ := os.Open(srcPath)
+			defer src.Close()
+			dst, _ := os.Create(dstPath)
+			defer dst.Close()
+
+			var moved atomic.Int64
+			written, hash, ok, err := copySparse(context.Background(), dst, src, tt.size, make([]byte, 64*1024), &moved)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Skip("file system doesn't report holes")
+			}
+			if written != tt.size || moved.Load() != tt.size {
+				t.Errorf("copied %d bytes, moved %d, want %d", written, moved.Load(), tt.size)
+			}
+			if want, _ := FileHash(srcPath); hash != want {
+				t.Errorf("hash %x differs from FileHash %x", hash, want)
+			}
+			srcData, _ := os.ReadFile(srcPath)
+			dstData, _ := os.ReadFile(dstPath)
+			if !bytes.Equal(srcData, dstData) {
+				t.Error("destination content differs")
+			}
+			if info, _ := os.Stat(dstPath); !isSparse(info) {
+				t.Error("destination has no holes")
+			}
+		})
+	}
+}
+
+func TestEngineSparse(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	os.Mkdir(src, 0755)
+	makeSparse(t, filepath.Join(src, "disk.img"), 16<<20, map[int64]string{8 << 20: "data"})
+	if info, _ := os.Stat(filepath.Join(src, "disk.img")); !isSparse(info) {
+		t.Skip("file system doesn't create holes")
+	}
+	cache := newCache(t, filepath.Join(dir, "cache.json"))
+	runEngine(t, Options{Src: src, Dst: dst, Cache: cache, Sparse: true})
+
+	info, err := os.Stat(filepath.Join(dst, "disk.img"))
+	if err != nil || info.Size() != 16<<20 || !isSparse(info) {
+		t.Errorf("destination %v, %v is not a sparse copy", info, err)
+	}
+	want, _ := FileHash(filepath.Join(src, "disk.img"))
+	if e, _ := cache.IsUpToDate("disk.img"); e == nil || e.Hash != want {
+		t.Errorf("cache entry %+v, want hash %x", e, want)
+	}
+}
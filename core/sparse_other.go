@@ -0,0 +1,19 @@
+//go:build !linux
+
+package core
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+)
+
+// isSparse is only implemented on Linux, elsewhere files are copied in full.
+func isSparse(info os.FileInfo) bool {
+	return false
+}
+
+// copySparse is only implemented on Linux.
+func copySparse(ctx context.Context, dst, src *os.File, size int64, buf []byte, moved *atomic.Int64) (written int64, hash uint64, ok bool, err error) {
+	return 0, 0, false, nil
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CacheStore persists cache entries keyed by relative path. Implementations
+// are not safe for concurrent writers: GlobalCache serializes Put, Delete,
+// Clear and Flush under its write lock, while Get and Iterate may run
+// concurrently with each other under its read lock.
+type CacheStore interface {
+	// Get returns the entry stored for key.
+	Get(key string) (*CacheEntry, bool)
+	// Put adds or replaces the entry for key. Entries must not be modified after Put.
+	Put(key string, entry *CacheEntry) error
+	// Delete removes the entry for key, if any.
+	Delete(key string) error
+	// Iterate calls fn for every entry until fn returns false.
+	Iterate(fn func(key string, entry *CacheEntry) bool) error
+	// Clear removes every entry.
+	Clear() error
+	// Flush makes all changes so far durable.
+	Flush() error
+	// Close flushes and releases the store's resources.
+	Close() error
+}
+
+// Cache storage backends selectable with OpenCacheStore.
+const (
+	BackendJSON = "json" // In-memory map persisted as a JSON snapshot plus journal
+	BackendLSM  = "lsm"  // On-disk log-structured store, entries are not kept in RAM
+)
+
+// StorePath returns the on-disk location of a cache for a backend, derived
+// from the .json path returned by LocalCacheFile.
+func StorePath(cachePath, backend string) string {
+	if backend == BackendLSM {
+		return strings.TrimSuffix(cachePath, ".json") + ".db"
+	}
+	return cachePath
+}
+
+// ErrReadOnly is returned by the writes to a store opened read-only.
+var ErrReadOnly = errors.New("cache is open read-only")
+
+// OpenCacheStore opens or creates the store at path with the named backend.
+func OpenCacheStore(path, backend string) (CacheStore, error) {
+	return openCacheStore(path, backend, false)
+}
+
+// OpenCacheStoreReadOnly opens the existing store at path for reading only.
+// Nothing on disk is changed: a damaged journal is left as it is, writes
+// fail with ErrReadOnly and Close saves nothing.
+func OpenCacheStoreReadOnly(path, backend string) (CacheStore, error) {
+	return openCacheStore(path, backend, true)
+}
+
+func openCacheStore(path, backend string, readOnly bool) (CacheStore, error) {
+	switch backend {
+	case BackendJSON, "":
+		return openJSONStore(path, readOnly)
+	case BackendLSM:
+		return openLSMStore(path, readOnly)
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %s", backend)
+	}
+}
+
+// RemoveCacheFiles deletes everything stored for a cache: the JSON snapshot,
+// its previous generation and journal, or an LSM store directory, plus the
+// cache's info file.
+// It returns an error satisfying os.IsNotExist when nothing existed.
+func RemoveCacheFiles(path string) error {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		os.Remove(InfoPath(path))
+		return os.RemoveAll(path)
+	}
+	removed := false
+	for _, p := range []string{path, PrevSnapshotPath(path), JournalPath(path), path + ".tmp", InfoPath(path)} {
+		err := os.Remove(p)
+		if err == nil {
+			removed = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !removed {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	return nil
+}
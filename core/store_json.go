@@ -0,0 +1,285 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// jsonStore keeps every entry in memory and persists them as a JSON snapshot
+// plus an append-only journal of the Put/Delete calls made since the snapshot
+// was written. Flushing only appends the pending records, and the journal is
+// folded back into the snapshot once it grows larger than the cache itself.
+type jsonStore struct {
+	data map[string]*CacheEntry
+	path string
+
+	generation uint64 // Generation of the snapshot on disk
+	snapshotOK bool   // The snapshot at path is valid and may become the previous generation
+	readOnly   bool   // Opened with OpenCacheStoreReadOnly
+
+	journal      *os.File        // Open journal file, nil until the first flush
+	journalCount int             // Records in the journal file on disk
+	journalSync  time.Time       // Last time the journal was fsynced
+	pending      []journalRecord // Records not yet written to the journal
+}
+
+// journalCompactMin is the number of journal records below which the
+// journal is never compacted, so small caches don't rewrite the snapshot.
+const journalCompactMin = 10000
+
+// journalSyncInterval bounds how often appended journal records are fsynced.
+const journalSyncInterval = time.Second
+
+const (
+	journalPut   = "put"
+	journalDel   = "del"
+	journalClear = "clear"
+)
+
+// journalRecord is one line of the cache journal.
+type journalRecord struct {
+	Op    string      `json:"op"`
+	Key   string      `json:"key,omitempty"`
+	Entry *CacheEntry `json:"entry,omitempty"`
+}
+
+// JournalPath returns the journal file belonging to a cache snapshot path.
+func JournalPath(path string) string {
+	return path + ".journal"
+}
+
+// OpenJSONStore loads the snapshot at path, if it exists, and replays its journal.
+// A corrupted snapshot is reported and replaced by the previous good generation,
+// and its journal is discarded. A snapshot from a newer version is an error,
+// and nothing on disk is touched.
+func OpenJSONStore(path string) (CacheStore, error) {
+	return openJSONStore(path, false)
+}
+
+func openJSONStore(path string, readOnly bool) (CacheStore, error) {
+	s := &jsonStore{
+		data:     make(map[string]*CacheEntry),
+		path:     path,
+		readOnly: readOnly,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *jsonStore) load() error {
+	data, hdr, err := readSnapshot(s.path)
+	if errors.Is(err, ErrCacheVersion) {
+		return err
+	}
+	if err == nil {
+		s.data, s.generation, s.snapshotOK = data, hdr.Generation, true
+	} else {
+		if os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "[%s] [INFO] No cache file found: %s\n", timestamp(), s.path)
+		} else {
+			fmt.Fprintf(os.Stderr, "[%s] [ERROR] Error loading cache file %s: %v\n", timestamp(), s.path, err)
+		}
+		prev := PrevSnapshotPath(s.path)
+		data, hdr, prevErr := readSnapshot(prev)
+		if errors.Is(prevErr, ErrCacheVersion) {
+			return prevErr
+		}
+		if prevErr == nil {
+			fmt.Fprintf(os.Stderr, "[%s] [WARN] Falling back to previous cache generation %d: %s\n", timestamp(), hdr.Generation, prev)
+			s.data, s.generation = data, hdr.Generation
+		} else if !os.IsNotExist(prevErr) {
+			fmt.Fprintf(os.Stderr, "[%s] [ERROR] Error loading previous cache file %s: %v\n", timestamp(), prev, prevErr)
+		}
+		// The journal continues the damaged snapshot, replaying it onto an
+		// older generation would mix the two. Without a snapshot it
+		// continues the previous one, or is all there is of a new cache.
+		if !os.IsNotExist(err) {
+			if s.readOnly {
+				return nil
+			}
+			if rmErr := os.Remove(JournalPath(s.path)); rmErr == nil {
+				fmt.Fprintf(os.Stderr, "[%s] [WARN] Discarded the cache journal of the damaged cache file: %s\n", timestamp(), JournalPath(s.path))
+			} else if !os.IsNotExist(rmErr) {
+				fmt.Fprintf(os.Stderr, "[%s] [ERROR] Failed to discard cache journal %s: %v\n", timestamp(), JournalPath(s.path), rmErr)
+			}
+			return nil
+		}
+	}
+	s.replayJournal()
+	return nil
+}
+
+func (s *jsonStore) Get(key string) (*CacheEntry, bool) {
+	entry, ok := s.data[key]
+	return entry, ok
+}
+
+func (s *jsonStore) Put(key string, entry *CacheEntry) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.data[key] = entry
+	s.pending = append(s.pending, journalRecord{Op: journalPut, Key: key, Entry: entry})
+	return nil
+}
+
+func (s *jsonStore) Delete(key string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	delete(s.data, key)
+	s.pending = append(s.pending, journalRecord{Op: journalDel, Key: key})
+	return nil
+}
+
+func (s *jsonStore) Iterate(fn func(key string, entry *CacheEntry) bool) error {
+	for k, e := range s.data {
+		if !fn(k, e) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *jsonStore) Clear() error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.data = make(map[string]*CacheEntry)
+	s.pending = append(s.pending, journalRecord{Op: journalClear})
+	return nil
+}
+
+// Flush appends pending changes to the journal and compacts it once it has
+// outgrown the snapshot.
+func (s *jsonStore) Flush() error {
+	if s.readOnly {
+		return nil
+	}
+	if err := s.flushJournal(); err != nil {
+		return err
+	}
+	if s.journalCount > journalCompactMin && s.journalCount > len(s.data) {
+		return s.compact()
+	}
+	return nil
+}
+
+// Close folds the journal into the snapshot and releases the journal file.
+func (s *jsonStore) Close() error {
+	if s.readOnly || (len(s.pending) == 0 && s.journalCount == 0) {
+		return nil
+	}
+	return s.compact()
+}
+
+// apply replays a single journal record onto the in-memory data.
+func (s *jsonStore) apply(rec journalRecord) {
+	switch rec.Op {
+	case journalPut:
+		if rec.Entry != nil {
+			s.data[rec.Key] = rec.Entry
+		}
+	case journalDel:
+		delete(s.data, rec.Key)
+	case journalClear:
+		s.data = make(map[string]*CacheEntry)
+	}
+}
+
+// replayJournal applies the journal on top of the loaded snapshot. A line
+// that fails its checksum, doesn't decode or lacks its newline is treated as
+// a torn write from a crash and ends the replay; everything before it is
+// kept and the journal is truncated there, so records appended later are
+// not hidden behind the damage.
+func (s *jsonStore) replayJournal() {
+	path := JournalPath(s.path)
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "[%s] [ERROR] Error opening cache journal %s: %v\n", timestamp(), path, err)
+		}
+		return
+	}
+	good, damaged := readJournal(f, func(rec journalRecord) {
+		s.apply(rec)
+		s.journalCount++
+	})
+	f.Close()
+	if !damaged {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[%s] [WARN] Ignoring damaged cache journal from record %d in %s\n", timestamp(), s.journalCount+1, path)
+	if s.readOnly {
+		return
+	}
+	if err := os.Truncate(path, good); err != nil {
+		// Appending after the damage would lose the new records on the
+		// next load, fold everything into a new snapshot instead.
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] Failed to truncate damaged cache journal %s: %v\n", timestamp(), path, err)
+		if err := s.compact(); err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] [ERROR] Failed to compact cache %s: %v\n", timestamp(), s.path, err)
+		}
+	}
+}
+
+// flushJournal appends all pending records to the journal file.
+func (s *jsonStore) flushJournal() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	if s.journal == nil {
+		f, err := os.OpenFile(JournalPath(s.path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.journal = f
+	}
+	var buf bytes.Buffer
+	for _, rec := range s.pending {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		checksumLine(&buf, line)
+	}
+	if _, err := s.journal.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	s.journalCount += len(s.pending)
+	s.pending = s.pending[:0]
+
+	// Group fsyncs so saving after every file doesn't cost a disk flush each time.
+	if time.Since(s.journalSync) >= journalSyncInterval {
+		s.journalSync = time.Now()
+		return s.journal.Sync()
+	}
+	return nil
+}
+
+// compact atomically writes the in-memory data as a new snapshot generation
+// and empties the journal. The snapshot is written first, so a crash in
+// between only leaves records that are already contained in the snapshot.
+func (s *jsonStore) compact() error {
+	if err := writeSnapshotFile(s.path, s.data, s.generation+1, s.snapshotOK); err != nil {
+		return err
+	}
+	s.generation++
+	s.snapshotOK = true
+	if s.journal != nil {
+		s.journal.Close()
+		s.journal = nil
+	}
+	if err := os.Remove(JournalPath(s.path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.journalCount = 0
+	s.pending = s.pending[:0]
+	return nil
+}
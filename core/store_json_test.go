@@ -0,0 +1,146 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crash drops a JSON store without folding its journal into the snapshot,
+// as a killed process would.
+func crash(t *testing.T, s CacheStore) {
+	t.Helper()
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if j := s.(*jsonStore).journal; j != nil {
+		j.Close()
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	s := openStore(t, path, BackendJSON)
+	s.Put("a", &CacheEntry{Size: 1, Hash: 11})
+	s.Put("b", &CacheEntry{Size: 2, Hash: 22})
+	s.Put("c", &CacheEntry{Size: 3, Hash: 33})
+	s.Delete("b")
+	s.Put("a", &CacheEntry{Size: 4, Hash: 44})
+	crash(t, s)
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Flush wrote a snapshot for a small journal: %v", err)
+	}
+	s = openStore(t, path, BackendJSON)
+	defer s.Close()
+	want := map[string]uint64{"a": 44, "c": 33}
+	got := map[string]uint64{}
+	s.Iterate(func(key string, e *CacheEntry) bool {
+		got[key] = e.Hash
+		return true
+	})
+	if len(got) != len(want) || got["a"] != want["a"] || got["c"] != want["c"] {
+		t.Errorf("replayed entries = %v, want %v", got, want)
+	}
+}
+
+func TestJournalReplayOnSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	s := openStore(t, path, BackendJSON)
+	s.Put("a", &CacheEntry{Hash: 1})
+	s.Put("b", &CacheEntry{Hash: 2})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(JournalPath(path)); !os.IsNotExist(err) {
+		t.Errorf("Close left the journal behind: %v", err)
+	}
+
+	s = openStore(t, path, BackendJSON)
+	s.Clear()
+	s.Put("c", &CacheEntry{Hash: 3})
+	crash(t, s)
+
+	s = openStore(t, path, BackendJSON)
+	defer s.Close()
+	if _, ok := s.Get("a"); ok {
+		t.Error("entry a survived a journaled Clear")
+	}
+	if e, ok := s.Get("c"); !ok || e.Hash != 3 {
+		t.Errorf("Get(c) = %v, %v; want hash 3", e, ok)
+	}
+}
+
+func TestJournalTornWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		tail string
+	}{
+		{"truncated line", "0123"},
+		{"bad checksum", `0000000000000000 {"op":"put","key":"x","entry":{"Size":9}}` + "\n"},
+		{"not json", "garbage\n"},
+		{"missing newline", `{"op":"put","key":"x","entry":{"Size":9}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.json")
+			s := openStore(t, path, BackendJSON)
+			s.Put("a", &CacheEntry{Hash: 1})
+			crash(t, s)
+
+			f, err := os.OpenFile(JournalPath(path), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString(tt.tail)
+			f.Close()
+
+			// Records after the damage are dropped, earlier ones kept
+			s = openStore(t, path, BackendJSON)
+			defer s.Close()
+			if _, ok := s.Get("a"); !ok {
+				t.Error("record before the damage was lost")
+			}
+			if _, ok := s.Get("x"); ok {
+				t.Error("damaged record was applied")
+			}
+
+			// Records appended after the damage survive the next load
+			s.Put("b", &CacheEntry{Hash: 2})
+			crash(t, s)
+			s = openStore(t, path, BackendJSON)
+			defer s.Close()
+			for _, key := range []string{"a", "b"} {
+				if _, ok := s.Get(key); !ok {
+					t.Errorf("record %s appended after the damage was lost", key)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyLine(t *testing.T) {
+	var buf bytes.Buffer
+	checksumLine(&buf, []byte(`{"op":"del","key":"k"}`))
+	line := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+
+	tests := []struct {
+		name string
+		line string
+		ok   bool
+	}{
+		{"checksummed", string(line), true},
+		{"legacy without checksum", `{"op":"del","key":"k"}`, true},
+		{"changed record", string(line[:len(line)-2]) + `x"}`, false},
+		{"no separator", "0011223344556677", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := verifyLine([]byte(tt.line)); ok != tt.ok {
+				t.Errorf("verifyLine(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			}
+		})
+	}
+}
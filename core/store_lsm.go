@@ -0,0 +1,754 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// lsmStore is an embedded log-structured merge store for caches too large to
+// keep in memory. Writes go to an in-memory memtable backed by a write-ahead
+// log; once the memtable is full it is written out as an immutable sorted
+// table. Lookups check the memtable and then the tables from newest to
+// oldest, reading a single index block from disk per table. Only a sparse
+// index (every lsmIndexInterval-th key) of each table stays in RAM.
+//
+// Directory layout:
+//
+//	MANIFEST     JSON list of live tables, oldest first
+//	wal.log      checksummed journal records not yet in a table
+//	000001.sst   sorted tables
+type lsmStore struct {
+	dir      string
+	mem      map[string]*CacheEntry // nil entry is a tombstone
+	wal      *os.File
+	walBuf   bytes.Buffer
+	walSync  time.Time
+	tables   []*sstable // Oldest first
+	nextID   uint64
+	readOnly bool // Opened with OpenCacheStoreReadOnly
+}
+
+const (
+	lsmMemtableLimit = 50000 // Entries buffered before the memtable is written as a table
+	lsmMaxTables     = 8     // Tables allowed before they are merged into one
+	lsmIndexInterval = 64    // Records per sparse index entry
+	lsmMagic         = 0x316d736c63636863
+	lsmFooterSize    = 32
+	lsmManifestName  = "MANIFEST"
+	lsmWALName       = "wal.log"
+)
+
+// lsmManifest lists the live tables of a store.
+type lsmManifest struct {
+	Version int      `json:"version"`
+	NextID  uint64   `json:"next_id"`
+	Tables  []string `json:"tables"`
+}
+
+// OpenLSMStore opens or creates an LSM store in the directory at path.
+func OpenLSMStore(path string) (CacheStore, error) {
+	return openLSMStore(path, false)
+}
+
+func openLSMStore(path string, readOnly bool) (CacheStore, error) {
+	if readOnly {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return nil, err
+	}
+	s := &lsmStore{dir: path, mem: make(map[string]*CacheEntry), nextID: 1, readOnly: readOnly}
+
+	var m lsmManifest
+	raw, err := os.ReadFile(filepath.Join(path, lsmManifestName))
+	if err == nil {
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrCacheCorrupt, filepath.Join(path, lsmManifestName), err)
+		}
+		s.nextID = m.NextID
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	live := make(map[string]bool)
+	for _, name := range m.Tables {
+		t, err := openTable(filepath.Join(path, name))
+		if err != nil {
+			s.closeTables()
+			return nil, err
+		}
+		s.tables = append(s.tables, t)
+		live[name] = true
+	}
+
+	// Drop tables left behind by an interrupted flush or compaction.
+	if entries, err := os.ReadDir(path); err == nil && !readOnly {
+		for _, e := range entries {
+			name := e.Name()
+			if (strings.HasSuffix(name, ".sst") && !live[name]) || strings.HasSuffix(name, ".tmp") {
+				os.Remove(filepath.Join(path, name))
+			}
+		}
+	}
+
+	if err := s.replayWAL(); err != nil {
+		s.closeTables()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *lsmStore) Get(key string) (*CacheEntry, bool) {
+	if entry, ok := s.mem[key]; ok {
+		return entry, entry != nil
+	}
+	for i := len(s.tables) - 1; i >= 0; i-- {
+		entry, found, err := s.tables[i].get(key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] [ERROR] Error reading cache table %s: %v\n", timestamp(), s.tables[i].path, err)
+			return nil, false
+		}
+		if found {
+			return entry, entry != nil
+		}
+	}
+	return nil, false
+}
+
+func (s *lsmStore) Put(key string, entry *CacheEntry) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.mem[key] = entry
+	return s.log(journalRecord{Op: journalPut, Key: key, Entry: entry})
+}
+
+func (s *lsmStore) Delete(key string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.mem[key] = nil
+	return s.log(journalRecord{Op: journalDel, Key: key})
+}
+
+func (s *lsmStore) Iterate(fn func(key string, entry *CacheEntry) bool) error {
+	return s.merge(s.sources(true), false, func(key string, entry *CacheEntry) bool {
+		if entry == nil {
+			return true
+		}
+		return fn(key, entry)
+	})
+}
+
+func (s *lsmStore) Clear() error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	old := s.tables
+	s.closeTables()
+	s.tables = nil
+	s.mem = make(map[string]*CacheEntry)
+	s.walBuf.Reset()
+	if err := s.writeManifest(); err != nil {
+		return err
+	}
+	for _, t := range old {
+		os.Remove(t.path)
+	}
+	return s.resetWAL()
+}
+
+// Flush appends buffered records to the write-ahead log and writes the
+// memtable out as a table once it is full.
+func (s *lsmStore) Flush() error {
+	if s.readOnly {
+		return nil
+	}
+	if err := s.flushWAL(); err != nil {
+		return err
+	}
+	if len(s.mem) >= lsmMemtableLimit {
+		return s.flushMemtable()
+	}
+	return nil
+}
+
+// Close writes the memtable out as a table and releases all files.
+func (s *lsmStore) Close() error {
+	if s.readOnly {
+		s.closeTables()
+		return nil
+	}
+	err := s.flushWAL()
+	if err == nil && len(s.mem) > 0 {
+		err = s.flushMemtable()
+	}
+	if s.wal != nil {
+		s.wal.Close()
+		s.wal = nil
+	}
+	s.closeTables()
+	return err
+}
+
+func (s *lsmStore) closeTables() {
+	for _, t := range s.tables {
+		t.f.Close()
+	}
+}
+
+// log buffers a write-ahead log record until the next Flush.
+func (s *lsmStore) log(rec journalRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	checksumLine(&s.walBuf, line)
+	return nil
+}
+
+func (s *lsmStore) flushWAL() error {
+	if s.walBuf.Len() == 0 {
+		return nil
+	}
+	if s.wal == nil {
+		f, err := os.OpenFile(filepath.Join(s.dir, lsmWALName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.wal = f
+	}
+	if _, err := s.wal.Write(s.walBuf.Bytes()); err != nil {
+		return err
+	}
+	s.walBuf.Reset()
+	if time.Since(s.walSync) >= journalSyncInterval {
+		s.walSync = time.Now()
+		return s.wal.Sync()
+	}
+	return nil
+}
+
+// resetWAL empties the write-ahead log once its records are in a table.
+func (s *lsmStore) resetWAL() error {
+	if s.wal != nil {
+		s.wal.Close()
+		s.wal = nil
+	}
+	if err := os.Remove(filepath.Join(s.dir, lsmWALName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// replayWAL loads records that were logged but not yet written to a table.
+// As with the JSON journal, a damaged line ends the replay and the log is
+// truncated after the last intact record before anything is appended.
+func (s *lsmStore) replayWAL() error {
+	path := filepath.Join(s.dir, lsmWALName)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	n := 0
+	good, damaged := readJournal(f, func(rec journalRecord) {
+		switch rec.Op {
+		case journalPut:
+			s.mem[rec.Key] = rec.Entry
+		case journalDel:
+			s.mem[rec.Key] = nil
+		}
+		n++
+	})
+	f.Close()
+	if !damaged {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "[%s] [WARN] Ignoring damaged cache log from record %d in %s\n", timestamp(), n+1, path)
+	if s.readOnly {
+		return nil
+	}
+	if err := os.Truncate(path, good); err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] Failed to truncate damaged cache log %s: %v\n", timestamp(), path, err)
+		return s.flushMemtable()
+	}
+	return nil
+}
+
+// flushMemtable writes the memtable as a new table, newest of all. The
+// table only becomes live once the manifest naming it has been written.
+func (s *lsmStore) flushMemtable() error {
+	keys := make([]string, 0, len(s.mem))
+	for k := range s.mem {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	it := &memIterator{keys: keys, mem: s.mem, pos: -1}
+
+	t, err := s.writeTable(func(w *tableWriter) error {
+		for it.next() {
+			if err := w.add(it.key(), it.entry()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.tables = append(s.tables, t)
+	if err := s.writeManifest(); err != nil {
+		return err
+	}
+	s.mem = make(map[string]*CacheEntry)
+	if err := s.resetWAL(); err != nil {
+		return err
+	}
+	if len(s.tables) > lsmMaxTables {
+		return s.compactTables()
+	}
+	return nil
+}
+
+// compactTables merges every table into one. Because nothing older remains,
+// tombstones are dropped.
+func (s *lsmStore) compactTables() error {
+	old := s.tables
+	t, err := s.writeTable(func(w *tableWriter) error {
+		var werr error
+		err := s.merge(s.sources(false), true, func(key string, entry *CacheEntry) bool {
+			werr = w.add(key, entry)
+			return werr == nil
+		})
+		if werr != nil {
+			return werr
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.tables = []*sstable{t}
+	if err := s.writeManifest(); err != nil {
+		s.tables = old
+		return err
+	}
+	for _, o := range old {
+		o.f.Close()
+		os.Remove(o.path)
+	}
+	return nil
+}
+
+func (s *lsmStore) writeManifest() error {
+	m := lsmManifest{Version: 1, NextID: s.nextID}
+	for _, t := range s.tables {
+		m.Tables = append(m.Tables, filepath.Base(t.path))
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, lsmManifestName), data)
+}
+
+// writeTable creates the next table file from the records produced by fill.
+func (s *lsmStore) writeTable(fill func(w *tableWriter) error) (*sstable, error) {
+	path := filepath.Join(s.dir, fmt.Sprintf("%06d.sst", s.nextID))
+	s.nextID++
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	w := &tableWriter{w: bufio.NewWriterSize(f, 1<<20)}
+	err = fill(w)
+	if err == nil {
+		err = w.finish()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	syncDir(s.dir)
+	return openTable(path)
+}
+
+// sources returns iterators over the store's contents, newest first.
+func (s *lsmStore) sources(withMem bool) []lsmIterator {
+	var its []lsmIterator
+	if withMem && len(s.mem) > 0 {
+		keys := make([]string, 0, len(s.mem))
+		for k := range s.mem {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		its = append(its, &memIterator{keys: keys, mem: s.mem, pos: -1})
+	}
+	for i := len(s.tables) - 1; i >= 0; i-- {
+		its = append(its, s.tables[i].iterator())
+	}
+	return its
+}
+
+// merge walks several sorted sources in key order. When a key appears in
+// more than one source, the earliest (newest) source wins. Tombstones are
+// passed to fn as nil entries unless dropTombstones is set.
+func (s *lsmStore) merge(its []lsmIterator, dropTombstones bool, fn func(key string, entry *CacheEntry) bool) error {
+	live := make([]bool, len(its))
+	for i, it := range its {
+		live[i] = it.next()
+	}
+	for {
+		min := -1
+		for i, it := range its {
+			if live[i] && (min < 0 || it.key() < its[min].key()) {
+				min = i
+			}
+		}
+		if min < 0 {
+			break
+		}
+		key, entry := its[min].key(), its[min].entry()
+		for i, it := range its {
+			for live[i] && it.key() == key {
+				live[i] = it.next()
+			}
+		}
+		if entry == nil && dropTombstones {
+			continue
+		}
+		if !fn(key, entry) {
+			break
+		}
+	}
+	for _, it := range its {
+		if err := it.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data via a fsynced temporary file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// Table format: a sequence of records, then the sparse index, then a footer.
+//
+//	record: uvarint keyLen | key | flag (0 put, 1 tombstone) | [uvarint valLen | JSON entry]
+//	index:  uvarint count | count × (uvarint keyLen | key | uvarint offset)
+//	footer: u64 index offset | u64 record count | u64 xxHash64 of index | u64 magic
+
+type indexEntry struct {
+	key    string
+	offset int64
+}
+
+type sstable struct {
+	path    string
+	f       *os.File
+	dataEnd int64
+	count   uint64
+	index   []indexEntry
+}
+
+type tableWriter struct {
+	w       *bufio.Writer
+	offset  int64
+	count   uint64
+	index   []indexEntry
+	lastKey string
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (w *tableWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.scratch[:], v)
+	w.w.Write(w.scratch[:n])
+	w.offset += int64(n)
+}
+
+func (w *tableWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.w.Write(b)
+	w.offset += int64(len(b))
+}
+
+func (w *tableWriter) add(key string, entry *CacheEntry) error {
+	if w.count > 0 && key <= w.lastKey {
+		return fmt.Errorf("cache table keys out of order: %q after %q", key, w.lastKey)
+	}
+	if w.count%lsmIndexInterval == 0 {
+		w.index = append(w.index, indexEntry{key: key, offset: w.offset})
+	}
+	w.bytes([]byte(key))
+	if entry == nil {
+		w.w.WriteByte(1)
+		w.offset++
+	} else {
+		val, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		w.w.WriteByte(0)
+		w.offset++
+		w.bytes(val)
+	}
+	w.lastKey = key
+	w.count++
+	return nil
+}
+
+func (w *tableWriter) finish() error {
+	dataEnd := w.offset
+	var idx bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	put := func(v uint64) { idx.Write(scratch[:binary.PutUvarint(scratch[:], v)]) }
+	put(uint64(len(w.index)))
+	for _, e := range w.index {
+		put(uint64(len(e.key)))
+		idx.WriteString(e.key)
+		put(uint64(e.offset))
+	}
+	w.w.Write(idx.Bytes())
+	var footer [lsmFooterSize]byte
+	binary.LittleEndian.PutUint64(footer[0:], uint64(dataEnd))
+	binary.LittleEndian.PutUint64(footer[8:], w.count)
+	binary.LittleEndian.PutUint64(footer[16:], xxhash.Sum64(idx.Bytes()))
+	binary.LittleEndian.PutUint64(footer[24:], lsmMagic)
+	w.w.Write(footer[:])
+	return w.w.Flush()
+}
+
+// openTable opens a table and loads its sparse index.
+func openTable(path string) (*sstable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := loadTable(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s: %v", ErrCacheCorrupt, path, err)
+	}
+	t.path = path
+	return t, nil
+}
+
+func loadTable(f *os.File) (*sstable, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < lsmFooterSize {
+		return nil, errors.New("table too short")
+	}
+	var footer [lsmFooterSize]byte
+	if _, err := f.ReadAt(footer[:], size-lsmFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(footer[24:]) != lsmMagic {
+		return nil, errors.New("bad table magic")
+	}
+	dataEnd := int64(binary.LittleEndian.Uint64(footer[0:]))
+	if dataEnd < 0 || dataEnd > size-lsmFooterSize {
+		return nil, errors.New("bad index offset")
+	}
+	idx := make([]byte, size-lsmFooterSize-dataEnd)
+	if _, err := f.ReadAt(idx, dataEnd); err != nil {
+		return nil, err
+	}
+	if xxhash.Sum64(idx) != binary.LittleEndian.Uint64(footer[16:]) {
+		return nil, errors.New("index checksum mismatch")
+	}
+
+	t := &sstable{f: f, dataEnd: dataEnd, count: binary.LittleEndian.Uint64(footer[8:])}
+	r := bytes.NewReader(idx)
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		key, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		off, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		t.index = append(t.index, indexEntry{key: string(key), offset: int64(off)})
+	}
+	return t, nil
+}
+
+// get looks key up in the one index block that may contain it. found is
+// true for tombstones too, with a nil entry.
+func (t *sstable) get(key string) (entry *CacheEntry, found bool, err error) {
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].key > key }) - 1
+	if i < 0 {
+		return nil, false, nil
+	}
+	end := t.dataEnd
+	if i+1 < len(t.index) {
+		end = t.index[i+1].offset
+	}
+	block := make([]byte, end-t.index[i].offset)
+	if _, err := t.f.ReadAt(block, t.index[i].offset); err != nil {
+		return nil, false, err
+	}
+	r := bytes.NewReader(block)
+	for r.Len() > 0 {
+		k, val, err := readRawRecord(r)
+		if err != nil {
+			return nil, false, err
+		}
+		if string(k) == key {
+			e, err := decodeValue(val)
+			return e, err == nil, err
+		}
+		if string(k) > key {
+			break
+		}
+	}
+	return nil, false, nil
+}
+
+func (t *sstable) iterator() lsmIterator {
+	return &tableIterator{r: bufio.NewReaderSize(io.NewSectionReader(t.f, 0, t.dataEnd), 256*1024)}
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readBytes(r byteReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// readRawRecord reads one record without decoding its value. val is nil for tombstones.
+func readRawRecord(r byteReader) (key, val []byte, err error) {
+	key, err = readBytes(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	flag, err := r.ReadByte()
+	if err != nil {
+		return nil, nil, err
+	}
+	if flag == 1 {
+		return key, nil, nil
+	}
+	val, err = readBytes(r)
+	return key, val, err
+}
+
+func decodeValue(val []byte) (*CacheEntry, error) {
+	if val == nil {
+		return nil, nil
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(val, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// lsmIterator walks one sorted source. A nil entry is a tombstone.
+type lsmIterator interface {
+	next() bool
+	key() string
+	entry() *CacheEntry
+	err() error
+}
+
+type memIterator struct {
+	keys []string
+	mem  map[string]*CacheEntry
+	pos  int
+}
+
+func (it *memIterator) next() bool         { it.pos++; return it.pos < len(it.keys) }
+func (it *memIterator) key() string        { return it.keys[it.pos] }
+func (it *memIterator) entry() *CacheEntry { return it.mem[it.keys[it.pos]] }
+func (it *memIterator) err() error         { return nil }
+
+type tableIterator struct {
+	r   *bufio.Reader
+	k   string
+	e   *CacheEntry
+	bad error
+}
+
+func (it *tableIterator) next() bool {
+	k, val, err := readRawRecord(it.r)
+	if err == nil {
+		it.e, err = decodeValue(val)
+	}
+	if err != nil {
+		if err != io.EOF {
+			it.bad = err
+		}
+		return false
+	}
+	it.k = string(k)
+	return true
+}
+
+func (it *tableIterator) key() string        { return it.k }
+func (it *tableIterator) entry() *CacheEntry { return it.e }
+func (it *tableIterator) err() error         { return it.bad }
@@ -0,0 +1,338 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func openStore(t *testing.T, path, backend string) CacheStore {
+	t.Helper()
+	s, err := OpenCacheStore(path, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// storeContents returns the hashes of all entries of a store by key.
+func storeContents(t *testing.T, s CacheStore) map[string]uint64 {
+	t.Helper()
+	got := map[string]uint64{}
+	err := s.Iterate(func(key string, e *CacheEntry) bool {
+		got[key] = e.Hash
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestStoreBackends(t *testing.T) {
+	for _, backend := range []string{BackendJSON, BackendLSM} {
+		t.Run(backend, func(t *testing.T) {
+			path := StorePath(filepath.Join(t.TempDir(), "cache.json"), backend)
+			want := map[string]uint64{}
+			s := openStore(t, path, backend)
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("dir%d/file%03d", i%7, i)
+				s.Put(key, &CacheEntry{Size: int64(i), Hash: uint64(i)})
+				want[key] = uint64(i)
+			}
+			for i := 0; i < 500; i += 5 {
+				key := fmt.Sprintf("dir%d/file%03d", i%7, i)
+				s.Delete(key)
+				delete(want, key)
+			}
+			s.Put("dir1/file001", &CacheEntry{Hash: 1001})
+			want["dir1/file001"] = 1001
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			s = openStore(t, path, backend)
+			got := storeContents(t, s)
+			if len(got) != len(want) {
+				t.Errorf("%d entries after reopening, want %d", len(got), len(want))
+			}
+			for key, hash := range want {
+				if e, ok := s.Get(key); !ok || e.Hash != hash {
+					t.Errorf("Get(%q) = %v, %v; want hash %d", key, e, ok, hash)
+				}
+				if got[key] != hash {
+					t.Errorf("Iterate gave hash %d for %q, want %d", got[key], key, hash)
+				}
+			}
+			if _, ok := s.Get("dir0/file000"); ok {
+				t.Error("deleted entry is still there")
+			}
+
+			n := 0
+			s.Iterate(func(string, *CacheEntry) bool {
+				n++
+				return n < 3
+			})
+			if n != 3 {
+				t.Errorf("Iterate went on after fn returned false, %d calls", n)
+			}
+
+			s.Clear()
+			s.Put("after-clear", &CacheEntry{Hash: 7})
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			s = openStore(t, path, backend)
+			defer s.Close()
+			if got := storeContents(t, s); len(got) != 1 || got["after-clear"] != 7 {
+				t.Errorf("entries after Clear = %v", got)
+			}
+		})
+	}
+}
+
+func TestStoreReadOnly(t *testing.T) {
+	for _, backend := range []string{BackendJSON, BackendLSM} {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			path := StorePath(filepath.Join(dir, "cache.json"), backend)
+			s := openStore(t, path, backend)
+			s.Put("a", &CacheEntry{Hash: 1})
+			s.Close()
+
+			// Journaled only, then a torn record
+			s = openStore(t, path, backend)
+			s.Put("b", &CacheEntry{Hash: 2})
+			journal := JournalPath(path)
+			if st, ok := s.(*lsmStore); ok {
+				st.Flush()
+				st.wal.Close()
+				st.closeTables()
+				journal = filepath.Join(path, lsmWALName)
+			} else {
+				crash(t, s)
+			}
+			f, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString("0123")
+			f.Close()
+			before := readTree(t, dir)
+
+			s, err = OpenCacheStoreReadOnly(path, backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]uint64{"a": 1, "b": 2}
+			if got := storeContents(t, s); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("entries = %v, want %v", got, want)
+			}
+			for _, err := range []error{s.Put("c", &CacheEntry{}), s.Delete("a"), s.Clear()} {
+				if !errors.Is(err, ErrReadOnly) {
+					t.Errorf("write error = %v, want ErrReadOnly", err)
+				}
+			}
+			if err := s.Flush(); err != nil {
+				t.Error(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Error(err)
+			}
+			if after := readTree(t, dir); fmt.Sprint(after) != fmt.Sprint(before) {
+				t.Errorf("read-only store changed files:\nbefore %v\nafter  %v", before, after)
+			}
+		})
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.db")
+	if _, err := OpenCacheStoreReadOnly(missing, BackendLSM); !os.IsNotExist(err) {
+		t.Errorf("OpenCacheStoreReadOnly() of a missing store: %v", err)
+	}
+	if Exists(missing) {
+		t.Error("read-only open created the store")
+	}
+}
+
+func TestLSMWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	s := openStore(t, path, BackendLSM)
+	s.Put("in-table", &CacheEntry{Hash: 1})
+	s.Put("deleted", &CacheEntry{Hash: 2})
+	s.Close()
+
+	// Logged but never written to a table: only the WAL has these
+	s = openStore(t, path, BackendLSM)
+	s.Put("logged", &CacheEntry{Hash: 3})
+	s.Delete("deleted")
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s.(*lsmStore).wal.Close()
+	s.(*lsmStore).closeTables()
+
+	s = openStore(t, path, BackendLSM)
+	defer s.Close()
+	want := map[string]uint64{"in-table": 1, "logged": 3}
+	if got := storeContents(t, s); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+	if _, ok := s.Get("deleted"); ok {
+		t.Error("tombstone from the WAL didn't hide the table entry")
+	}
+}
+
+func TestLSMWALTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	s := openStore(t, path, BackendLSM)
+	s.Put("a", &CacheEntry{Hash: 1})
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s.(*lsmStore).wal.Close()
+	s.(*lsmStore).closeTables()
+
+	f, err := os.OpenFile(filepath.Join(path, lsmWALName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`0123 {"op":"put","key":"x"`)
+	f.Close()
+
+	// Records appended after the damage survive the next load
+	s = openStore(t, path, BackendLSM)
+	s.Put("b", &CacheEntry{Hash: 2})
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s.(*lsmStore).wal.Close()
+	s.(*lsmStore).closeTables()
+
+	s = openStore(t, path, BackendLSM)
+	defer s.Close()
+	want := map[string]uint64{"a": 1, "b": 2}
+	if got := storeContents(t, s); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+}
+
+func TestLSMTableIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	s := openStore(t, path, BackendLSM)
+	var keys []string
+	for i := 0; i < 10*lsmIndexInterval; i++ {
+		key := fmt.Sprintf("k%05d", i*2)
+		keys = append(keys, key)
+		s.Put(key, &CacheEntry{Hash: uint64(i)})
+	}
+	s.Close()
+
+	s = openStore(t, path, BackendLSM)
+	defer s.Close()
+	tables := s.(*lsmStore).tables
+	if len(tables) != 1 || len(tables[0].index) != 10 {
+		t.Fatalf("got %d tables, want 1 with a 10 block index", len(tables))
+	}
+	for i, key := range keys {
+		if e, ok := s.Get(key); !ok || e.Hash != uint64(i) {
+			t.Errorf("Get(%q) = %v, %v; want hash %d", key, e, ok, i)
+		}
+	}
+	// Before the first key, between keys of one block, at block boundaries and after the last key
+	for _, key := range []string{"a", "k00001", fmt.Sprintf("k%05d", 2*lsmIndexInterval-1), "k99999", "z"} {
+		if _, ok := s.Get(key); ok {
+			t.Errorf("Get(%q) found a missing key", key)
+		}
+	}
+}
+
+func TestLSMCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	want := map[string]uint64{}
+	for round := 0; round <= lsmMaxTables+1; round++ {
+		s := openStore(t, path, BackendLSM)
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("key%03d", round*10+i)
+			s.Put(key, &CacheEntry{Hash: uint64(round*1000 + i)})
+			want[key] = uint64(round*1000 + i)
+		}
+		key := fmt.Sprintf("key%03d", round*10)
+		s.Delete(key)
+		delete(want, key)
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := openStore(t, path, BackendLSM)
+	defer s.Close()
+	// The table that exceeded lsmMaxTables merged everything into one,
+	// the last round added another
+	if n := len(s.(*lsmStore).tables); n != 2 {
+		t.Errorf("%d tables after compaction, want 2", n)
+	}
+	ssts, _ := filepath.Glob(filepath.Join(path, "*.sst"))
+	if len(ssts) != 2 {
+		t.Errorf("%d table files on disk, want 2: %v", len(ssts), ssts)
+	}
+	got := storeContents(t, s)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("entries after compaction differ:\ngot  %v\nwant %v", got, want)
+	}
+	keys := make([]string, 0, len(got))
+	s.Iterate(func(key string, _ *CacheEntry) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if !sort.StringsAreSorted(keys) {
+		t.Error("Iterate is not in key order")
+	}
+}
+
+func TestLSMManifestRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	s := openStore(t, path, BackendLSM)
+	s.Put("a", &CacheEntry{Hash: 1})
+	s.Close()
+
+	// Leftovers of an interrupted flush or compaction are not in the MANIFEST
+	os.WriteFile(filepath.Join(path, "999999.sst"), []byte("partial"), 0644)
+	os.WriteFile(filepath.Join(path, lsmManifestName+".tmp"), []byte("{"), 0644)
+	s = openStore(t, path, BackendLSM)
+	if e, ok := s.Get("a"); !ok || e.Hash != 1 {
+		t.Errorf("Get(a) = %v, %v", e, ok)
+	}
+	s.Close()
+	for _, name := range []string{"999999.sst", lsmManifestName + ".tmp"} {
+		if _, err := os.Stat(filepath.Join(path, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", name, err)
+		}
+	}
+
+	t.Run("damaged table", func(t *testing.T) {
+		ssts, _ := filepath.Glob(filepath.Join(path, "*.sst"))
+		if len(ssts) != 1 {
+			t.Fatalf("want one table, got %v", ssts)
+		}
+		data, _ := os.ReadFile(ssts[0])
+		damaged := append([]byte{}, data...)
+		damaged[len(damaged)-lsmFooterSize-1] ^= 0xff // Last index byte
+		os.WriteFile(ssts[0], damaged, 0644)
+		defer os.WriteFile(ssts[0], data, 0644)
+		if _, err := OpenLSMStore(path); !errors.Is(err, ErrCacheCorrupt) {
+			t.Errorf("OpenLSMStore() error = %v, want ErrCacheCorrupt", err)
+		}
+	})
+
+	t.Run("damaged manifest", func(t *testing.T) {
+		os.WriteFile(filepath.Join(path, lsmManifestName), []byte(`{"tables":[`), 0644)
+		_, err := OpenLSMStore(path)
+		if !errors.Is(err, ErrCacheCorrupt) || !strings.Contains(err.Error(), lsmManifestName) {
+			t.Errorf("OpenLSMStore() error = %v, want ErrCacheCorrupt naming the MANIFEST", err)
+		}
+	})
+}
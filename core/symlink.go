@@ -0,0 +1,135 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// SymlinkMode selects how symbolic links in the source are handled.
+type SymlinkMode int
+
+const (
+	SymlinksFollow   SymlinkMode = iota // Copy what links point to, descending into linked directories
+	SymlinksPreserve                    // Recreate links in the destination
+	SymlinksSkip                        // Ignore links
+	SymlinksError                       // Fail the run when a link is found
+)
+
+var symlinkModeNames = []string{"follow", "preserve", "skip", "error"}
+
+// ParseSymlinkMode parses a --symlinks value.
+func ParseSymlinkMode(s string) (SymlinkMode, error) {
+	for i, name := range symlinkModeNames {
+		if strings.EqualFold(s, name) {
+			return SymlinkMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown --symlinks mode %q (want preserve, follow, skip or error)", s)
+}
+
+func (m SymlinkMode) String() string {
+	if m >= 0 && int(m) < len(symlinkModeNames) {
+		return symlinkModeNames[m]
+	}
+	return fmt.Sprintf("SymlinkMode(%d)", int(m))
+}
+
+// linkTarget reads the target of the source link at relPath. An absolute
+// target inside the source tree would point back into the source from the
+// destination, so it is rewritten relative to the link.
+func (e *Engine) linkTarget(relPath string) (string, error) {
+	target, err := os.Readlink(filepath.Join(e.opts.Src, relPath))
+	if err != nil || !filepath.IsAbs(target) {
+		return target, err
+	}
+	absSrc, err := filepath.Abs(e.opts.Src)
+	if err != nil {
+		return target, nil
+	}
+	roots := []string{absSrc}
+	if real, err := filepath.EvalSymlinks(absSrc); err == nil && real != absSrc {
+		roots = append(roots, real)
+	}
+	for _, root := range roots {
+		if inTree(root, target) {
+			linkDir := filepath.Dir(filepath.Join(root, relPath))
+			if rel, err := filepath.Rel(linkDir, filepath.Clean(target)); err == nil {
+				return rel, nil
+			}
+		}
+	}
+	return target, nil
+}
+
+// LinkTarget returns the target Run gives the destination link of the source
+// link at relPath with Symlinks set to preserve.
+func (e *Engine) LinkTarget(relPath string) (string, error) {
+	return e.linkTarget(relPath)
+}
+
+// inTree reports whether path is root or below it.
+func inTree(root, path string) bool {
+	root, path = filepath.Clean(root), filepath.Clean(path)
+	return path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// copyLink recreates the source link at relPath in the destination. A link
+// whose target matches the cache entry, or the existing destination link
+// when running without cache, is skipped.
+func (e *Engine) copyLink(relPath, dstPath string, srcInfo os.FileInfo) (int64, bool, int64, error) {
+	cache := e.opts.Cache
+	srcPath := filepath.Join(e.opts.Src, relPath)
+	target, err := e.linkTarget(relPath)
+	if err != nil {
+		return 0, false, 0, fmt.Errorf("failed to read link %s: %w", srcPath, err)
+	}
+	size := int64(len(target))
+
+	unchanged := false
+	if dstInfo, err := os.Lstat(dstPath); err == nil && dstInfo.Mode()&os.ModeSymlink != 0 {
+		if cache != nil {
+			cache.RLock()
+			entry, ok := cache.IsUpToDate(relPath)
+			cache.RUnlock()
+			unchanged = ok && entry.LinkTarget == target
+		} else {
+			existing, err := os.Readlink(dstPath)
+			unchanged = err == nil && existing == target
+		}
+	}
+	if unchanged {
+		e.emit(Event{Kind: EventFileSkipped, Path: relPath, Size: size})
+		return size, false, 0, nil
+	}
+
+	e.emit(Event{Kind: EventFileStarted, Path: relPath, Size: size})
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return 0, false, 0, fmt.Errorf("failed to create directory %s: %w", filepath.Dir(dstPath), err)
+	}
+	// Like files, links are created under a temp name and renamed into place
+	tmpPath := tempName(dstPath)
+	if err := os.Symlink(target, tmpPath); err != nil {
+		return 0, false, 0, fmt.Errorf("failed to create link %s: %w", dstPath, err)
+	}
+	if err := ReplaceFile(tmpPath, dstPath); err != nil {
+		os.Remove(tmpPath)
+		return 0, false, 0, fmt.Errorf("failed to replace destination file %s: %w", dstPath, err)
+	}
+
+	hash := xxhash.Sum64String(target)
+	if cache != nil {
+		cache.Lock()
+		cache.UpdateLink(relPath, StatMeta(srcPath, srcInfo), target, time.Now().Unix())
+		cache.Unlock()
+		if e.opts.Verbose >= 3 {
+			e.logf("[%s] [CACHE] Recorded link: %s -> %s\n", timestamp(), relPath, target)
+		}
+	}
+	e.emit(Event{Kind: EventFileCopied, Path: relPath, Size: size, Hash: hash})
+	return size, true, 0, nil
+}
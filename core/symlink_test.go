@@ -0,0 +1,120 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseSymlinkMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    SymlinkMode
+		wantErr bool
+	}{
+		{"follow", SymlinksFollow, false},
+		{"Preserve", SymlinksPreserve, false},
+		{"SKIP", SymlinksSkip, false},
+		{"error", SymlinksError, false},
+		{"keep", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSymlinkMode(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseSymlinkMode(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+		if err == nil && !strings.EqualFold(got.String(), tt.in) {
+			t.Errorf("String() = %q, want %q", got, tt.in)
+		}
+	}
+}
+
+func TestInTreeAndLoops(t *testing.T) {
+	root := filepath.FromSlash("/src/a")
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/src/a", true},
+		{"/src/a/", true},
+		{"/src/a/b/c", true},
+		{"/src/ab", false},
+		{"/src", false},
+		{"/other", false},
+	}
+	for _, tt := range tests {
+		if got := inTree(root, filepath.FromSlash(tt.path)); got != tt.want {
+			t.Errorf("inTree(%q, %q) = %v, want %v", root, tt.path, got, tt.want)
+		}
+	}
+	if !inTree(filepath.FromSlash("/"), filepath.FromSlash("/x")) {
+		t.Error("inTree() doesn't see /x below /")
+	}
+
+	chain := []string{filepath.FromSlash("/src"), filepath.FromSlash("/src/a"), filepath.FromSlash("/src/a/b")}
+	for target, want := range map[string]bool{
+		"/src/a":   true,  // Link to a directory being walked
+		"/":        true,  // Link to an ancestor of the walk
+		"/src/a/c": false, // Sibling of the current directory
+		"/data":    false,
+	} {
+		if got := loops(filepath.FromSlash(target), chain); got != want {
+			t.Errorf("loops(%q) = %v, want %v", target, got, want)
+		}
+	}
+}
+
+func TestEngineSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symbolic links needs privileges on Windows")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeTree(t, src, map[string]string{"file": "content", "dir/inner": "inner"})
+	os.Symlink("file", filepath.Join(src, "rel-link"))
+	os.Symlink(filepath.Join(src, "dir", "inner"), filepath.Join(src, "abs-link"))
+	os.Symlink("dir", filepath.Join(src, "dir-link"))
+	os.Symlink("..", filepath.Join(src, "dir", "loop"))
+
+	tests := []struct {
+		mode  SymlinkMode
+		files map[string]string
+		links map[string]string // Destination links and their targets
+	}{
+		{SymlinksFollow, map[string]string{
+			"file": "content", "dir/inner": "inner", "rel-link": "content", "abs-link": "inner", "dir-link/inner": "inner",
+		}, nil},
+		{SymlinksPreserve, map[string]string{"file": "content", "dir/inner": "inner"}, map[string]string{
+			"rel-link": "file", "abs-link": filepath.Join("dir", "inner"), "dir-link": "dir", "dir/loop": "..",
+		}},
+		{SymlinksSkip, map[string]string{"file": "content", "dir/inner": "inner"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			dst := filepath.Join(dir, "dst-"+tt.mode.String())
+			opts := Options{Src: src, Dst: dst, Cache: newCache(t, filepath.Join(dir, tt.mode.String()+".json")), Symlinks: tt.mode}
+			runEngine(t, opts)
+			sameTree(t, dst, tt.files)
+			for rel, want := range tt.links {
+				if got, err := os.Readlink(filepath.Join(dst, filepath.FromSlash(rel))); err != nil || got != want {
+					t.Errorf("link %s -> %q, %v; want %q", rel, got, err, want)
+				}
+			}
+			if res, _ := runEngine(t, opts); res.Copied != 0 {
+				t.Errorf("second run copied %d files", res.Copied)
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		opts := Options{Src: src, Dst: filepath.Join(dir, "dst-error"), Symlinks: SymlinksError}
+		_, err := NewEngine(opts).Run(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "symbolic link") {
+			t.Errorf("Run() error = %v, want the link reported", err)
+		}
+	})
+}
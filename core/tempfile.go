@@ -0,0 +1,103 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Destination files are written to a hidden temp file next to the target
+// and renamed over it once complete, so readers never see a partial file.
+// Temp names are ".cache_copy-<name>.<random>.tmp", with <name> shortened
+// where needed to stay within tempMaxName bytes.
+const (
+	tempPrefix  = ".cache_copy-"
+	tempSuffix  = ".tmp"
+	tempMaxName = 255 // NAME_MAX of common file systems
+)
+
+// IsTempName reports whether a file name is a destination temp file.
+func IsTempName(name string) bool {
+	return strings.HasPrefix(name, tempPrefix) && strings.HasSuffix(name, tempSuffix)
+}
+
+// tempName returns a fresh temp file name for writing dstPath.
+func tempName(dstPath string) string {
+	dir, base := filepath.Split(dstPath)
+	// The random part keeps a shortened name unique.
+	if max := tempMaxName - len(tempPrefix) - len(".01234567") - len(tempSuffix); len(base) > max {
+		for max > 0 && !utf8.RuneStart(base[max]) {
+			max--
+		}
+		base = base[:max]
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s%s.%08x%s", tempPrefix, base, rand.Uint32(), tempSuffix))
+}
+
+// createTemp creates a new temp file for writing dstPath in the same
+// directory, picking another name if one is taken.
+func createTemp(dstPath string) (*os.File, error) {
+	var f *os.File
+	var err error
+	for i := 0; i < 10; i++ {
+		f, err = os.OpenFile(tempName(dstPath), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	return f, err
+}
+
+// CreateTemp creates a new temp file for writing dstPath, retrying as the
+// policy allows. A create that hangs past the deadline of ctx is abandoned
+// and its file removed once it completes.
+func (p RetryPolicy) CreateTemp(ctx context.Context, dstPath string) (*os.File, error) {
+	var f *os.File
+	err := p.Do(ctx, func() (err error) {
+		f, err = interruptibleOpen(ctx, func() (*os.File, error) { return createTemp(dstPath) },
+			func(f *os.File) { os.Remove(f.Name()) })
+		return err
+	})
+	return f, err
+}
+
+// ReplaceFile renames a completed temp file over dstPath. Where Windows
+// refuses to replace the target (e.g. a read-only file) the target is
+// removed first; any other error is returned with the target left as it is.
+func ReplaceFile(tmpPath, dstPath string) error {
+	err := os.Rename(tmpPath, dstPath)
+	if err == nil || !replaceRefused(err) {
+		return err
+	}
+	if _, statErr := os.Lstat(dstPath); statErr != nil {
+		return err
+	}
+	if rmErr := os.Remove(dstPath); rmErr != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dstPath)
+}
+
+// RemoveStaleTemps deletes temp files and links left in dir by an
+// interrupted run and returns how many were removed.
+func RemoveStaleTemps(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		if (entry.Type().IsRegular() || entry.Type()&fs.ModeSymlink != 0) && IsTempName(entry.Name()) {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestIsTempName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{filepath.Base(tempName(filepath.Join("dir", "file.txt"))), true},
+		{".cache_copy-file.txt.0123abcd.tmp", true},
+		{".cache_copy-x.tmp", true},
+		{"file.txt", false},
+		{"cache_copy-file.txt.tmp", false},
+		{".cache_copy-file.txt", false},
+		{"report.tmp", false},
+	}
+	for _, tt := range tests {
+		if got := IsTempName(tt.name); got != tt.want {
+			t.Errorf("IsTempName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if a, b := tempName("f"), tempName("f"); a == b {
+		t.Errorf("tempName() returned %q twice", a)
+	}
+}
+
+func TestTempNameLength(t *testing.T) {
+	tests := []struct {
+		name string
+		base string
+	}{
+		{"short", "file.txt"},
+		{"at the limit", strings.Repeat("a", 230)},
+		{"244 bytes", strings.Repeat("a", 240) + ".txt"},
+		{"255 bytes", strings.Repeat("b", 255)},
+		{"multibyte", strings.Repeat("é", 127)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filepath.Base(tempName(filepath.Join("dir", tt.base)))
+			if len(got) > tempMaxName {
+				t.Errorf("tempName() is %d bytes long: %s", len(got), got)
+			}
+			if !IsTempName(got) || !utf8.ValidString(got) {
+				t.Errorf("tempName() = %q, not a valid temp name", got)
+			}
+			if len(tt.base)+25 <= tempMaxName && !strings.Contains(got, tt.base) {
+				t.Errorf("tempName() = %q shortened a name that fits", got)
+			}
+		})
+	}
+}
+
+func TestRemoveStaleTemps(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		".cache_copy-a.00000001.tmp": "partial",
+		".cache_copy-b.00000002.tmp": "partial",
+		"a":                          "kept",
+		"notes.tmp":                  "kept",
+	})
+	os.Symlink("a", filepath.Join(dir, ".cache_copy-l.00000003.tmp"))
+	os.Mkdir(filepath.Join(dir, ".cache_copy-dir.tmp"), 0755)
+
+	n, err := RemoveStaleTemps(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("RemoveStaleTemps() removed %d files, want 3", n)
+	}
+	entries, _ := os.ReadDir(dir)
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	if len(left) != 3 {
+		t.Errorf("left %v, want the directory and the two other files", left)
+	}
+}
+
+func TestReplaceFile(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	for _, existing := range []bool{false, true} {
+		if existing {
+			os.WriteFile(dst, []byte("old"), 0444)
+		}
+		tmp := tempName(dst)
+		os.WriteFile(tmp, []byte("new"), 0644)
+		if err := ReplaceFile(tmp, dst); err != nil {
+			t.Fatalf("ReplaceFile() with existing target %v: %v", existing, err)
+		}
+		if data, _ := os.ReadFile(dst); string(data) != "new" {
+			t.Errorf("target = %q after ReplaceFile()", data)
+		}
+		if Exists(tmp) {
+			t.Error("temp file still exists")
+		}
+		os.Remove(dst)
+	}
+}
+
+func TestReplaceFileError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows replaces a refused target by removing it")
+	}
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	os.Mkdir(dst, 0755)
+	tmp := tempName(dst)
+	os.WriteFile(tmp, []byte("new"), 0644)
+	if err := ReplaceFile(tmp, dst); err == nil {
+		t.Fatal("ReplaceFile() over a directory succeeded")
+	}
+	if info, err := os.Stat(dst); err != nil || !info.IsDir() {
+		t.Errorf("target directory was not kept: %v", err)
+	}
+	if !Exists(tmp) {
+		t.Error("temp file was removed")
+	}
+}
+
+func TestEngineLongNames(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	name := strings.Repeat("n", 240) + ".txt"
+	writeTree(t, src, map[string]string{name: "long", "sub/" + name: "long"})
+
+	runEngine(t, Options{Src: src, Dst: dst, Cache: newCache(t, filepath.Join(dir, "cache.json"))})
+	sameTree(t, dst, map[string]string{name: "long", "sub/" + name: "long"})
+}
+
+func TestEngineRemovesStaleTemps(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	writeTree(t, src, map[string]string{"sub/a": "a"})
+	writeTree(t, dst, map[string]string{"sub/.cache_copy-a.12345678.tmp": "interrupted"})
+
+	runEngine(t, Options{Src: src, Dst: dst, Cache: newCache(t, filepath.Join(dir, "cache.json"))})
+	sameTree(t, dst, map[string]string{"sub/a": "a"})
+}
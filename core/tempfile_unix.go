@@ -0,0 +1,10 @@
+//go:build !windows
+
+package core
+
+// replaceRefused reports whether a rename failed because the platform won't
+// replace the existing target. rename(2) replaces any file it is allowed to,
+// so its errors are final.
+func replaceRefused(err error) bool {
+	return false
+}
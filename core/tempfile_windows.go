@@ -0,0 +1,17 @@
+//go:build windows
+
+package core
+
+import (
+	"errors"
+	"syscall"
+)
+
+// replaceRefused reports whether a rename failed because Windows won't
+// replace the existing target: ERROR_ACCESS_DENIED for a read-only file,
+// ERROR_ALREADY_EXISTS and ERROR_FILE_EXISTS otherwise.
+func replaceRefused(err error) bool {
+	return errors.Is(err, syscall.ERROR_ACCESS_DENIED) ||
+		errors.Is(err, syscall.ERROR_ALREADY_EXISTS) ||
+		errors.Is(err, syscall.Errno(80))
+}
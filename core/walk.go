@@ -0,0 +1,176 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// walkSource lists the directories and files below the source, relative to
+// it, handling symbolic links according to Options.Symlinks. Paths left out
+// by Options.Filter or an ignore file are skipped, excluded directories
+// without being read, and so are files outside the filter's limits.
+// Directories come before their contents; with include patterns or limits
+// only those holding a file are listed, so they aren't recreated empty. In
+// follow mode a directory link is descended unless it points at a directory
+// that is already being walked, which would loop. An unreadable directory
+// ends the walk, or with skipUnreadable is logged and left out.
+func (e *Engine) walkSource(ctx context.Context, skipUnreadable bool) (dirs, files []string, err error) {
+	src := e.opts.Src
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !info.IsDir() {
+		return nil, []string{"."}, nil
+	}
+	real, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	if real, err = filepath.Abs(real); err != nil {
+		return nil, nil, err
+	}
+
+	var walkDir func(dir, rel string, chain []string) error
+	walkDir = func(dir, rel string, chain []string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if skipUnreadable && rel != "." {
+				e.logf("[%s] [ERROR] Skipping unreadable directory %s: %v\n", timestamp(), dir, err)
+				return nil
+			}
+			return err
+		}
+		dirs = append(dirs, rel)
+		for _, entry := range entries {
+			name := entry.Name()
+			path := filepath.Join(dir, name)
+			relPath := filepath.Join(rel, name)
+			if rel == "." && name == ManifestDir && entry.IsDir() {
+				continue
+			}
+			isDir := entry.IsDir()
+			var info os.FileInfo
+			if entry.Type()&fs.ModeSymlink != 0 && e.opts.Symlinks == SymlinksFollow {
+				if fi, err := os.Stat(path); err == nil {
+					info, isDir = fi, fi.IsDir()
+				}
+			}
+			if e.filtered(relPath, isDir) {
+				if e.opts.Verbose >= 2 {
+					e.logf("[%s] [VERBOSE] Excluded by filter: %s\n", timestamp(), path)
+				}
+				continue
+			}
+			if !isDir && e.opts.Filter.hasLimits() {
+				if info == nil {
+					info, _ = entry.Info()
+				}
+				if e.opts.Filter.outsideLimits(info) {
+					if e.opts.Verbose >= 2 {
+						e.logf("[%s] [VERBOSE] Outside the size or age limits: %s\n", timestamp(), path)
+					}
+					continue
+				}
+			}
+
+			if entry.Type()&fs.ModeSymlink != 0 {
+				switch e.opts.Symlinks {
+				case SymlinksSkip:
+					if e.opts.Verbose >= 2 {
+						e.logf("[%s] [VERBOSE] Skipping symlink: %s\n", timestamp(), path)
+					}
+					continue
+				case SymlinksError:
+					return fmt.Errorf("symbolic link %s found (--symlinks=error)", path)
+				case SymlinksPreserve:
+					files = append(files, relPath)
+					continue
+				}
+				// Follow: files are copied like regular ones, a broken link
+				// is reported when the worker fails to stat it
+				info, err := os.Stat(path)
+				if err != nil || !info.IsDir() {
+					files = append(files, relPath)
+					continue
+				}
+				target, err := filepath.EvalSymlinks(path)
+				if err == nil {
+					target, err = filepath.Abs(target)
+				}
+				if err != nil {
+					e.logf("[%s] [WARN] Failed to resolve symlink %s: %v\n", timestamp(), path, err)
+					continue
+				}
+				if loops(target, chain) {
+					e.logf("[%s] [WARN] Not following symlink %s: it points to %s, which contains it\n", timestamp(), path, target)
+					continue
+				}
+				if err := walkDir(path, relPath, append(chain, target)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if entry.IsDir() {
+				if err := walkDir(path, relPath, append(chain, filepath.Join(chain[len(chain)-1], name))); err != nil {
+					return err
+				}
+				continue
+			}
+			if IsTempName(name) { // Incomplete copy by another run
+				continue
+			}
+			files = append(files, relPath)
+		}
+		return nil
+	}
+	err = walkDir(src, ".", []string{real})
+	if e.opts.Filter.prunesDirs() {
+		dirs = dirsWithFiles(dirs, files)
+	}
+	return dirs, files, err
+}
+
+// SourceFiles lists the files below the source, relative to it, that Run
+// would copy: the same Filter, ignore files and Symlinks handling apply.
+// Unlike Run, an unreadable directory is logged and skipped.
+func (e *Engine) SourceFiles(ctx context.Context) ([]string, error) {
+	_, files, err := e.walkSource(ctx, true)
+	return files, err
+}
+
+// dirsWithFiles returns the directories of dirs, in their order, that hold
+// one of files at any depth. The root is always kept.
+func dirsWithFiles(dirs, files []string) []string {
+	used := map[string]bool{".": true}
+	for _, relPath := range files {
+		for dir := filepath.Dir(relPath); !used[dir]; dir = filepath.Dir(dir) {
+			used[dir] = true
+		}
+	}
+	kept := dirs[:0]
+	for _, dir := range dirs {
+		if used[dir] {
+			kept = append(kept, dir)
+		}
+	}
+	return kept
+}
+
+// loops reports whether descending into target would revisit a directory
+// of the current chain: target is one of them or an ancestor of one.
+func loops(target string, chain []string) bool {
+	for _, dir := range chain {
+		if inTree(target, dir) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"cache_copy/core"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gdamore/tcell/v2"
@@ -24,254 +29,187 @@ func timestamp() string {
 
 type LoggerFunc func(format string, args ...interface{})
 type ProgressFunc func(copiedBytes, totalBytes int64)
-type FatalFunc func(format string, args ...interface{})
-
-func runCopyWorkers(
-	fileList []string,
-	src, rootDst string,
-	cache *core.GlobalCache,
-	bufSize int,
-	noCache bool,
-	validate bool, // Add this parameter
-	verbose int,
-	workers int,
-	totalBytes int64,
-	logger LoggerFunc,
-	progress ProgressFunc,
-	fatal FatalFunc,
-) {
-	var copiedBytes int64
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-	fileChan := make(chan string, len(fileList))
-
-	for i := 0; i < workers; i++ {
-		wg.Add(1)
-		go func() {
-			defer func() {
-				cache.SaveCache()
-				wg.Done()
-			}()
-			buf := make([]byte, bufSize)
-			lastProgressUpdate := time.Now()
-			for relPath := range fileChan {
-				srcPath := filepath.Join(src, relPath)
-				dstPath := filepath.Join(rootDst, relPath)
-
-				srcInfo, err := os.Stat(srcPath)
-				if err != nil {
-					logger("[%s] [ERROR] Failed to stat %s: %v\n", timestamp(), srcPath, err)
-					continue
-				}
 
-				shouldCopy := true
-				var hash uint64
-
-				// Check cache to determine if file needs to be copied
-				if !noCache && !validate {
-					cache.RLock()
-					entry, ok := cache.IsUpToDate(relPath)
-					cache.RUnlock()
-					if ok && entry.Size == srcInfo.Size() {
-						hash, err = core.FileHash(srcPath)
-						if err == nil && entry.Hash == hash {
-							if dstInfo, err := os.Stat(dstPath); err == nil && dstInfo.Mode().IsRegular() {
-								shouldCopy = false
-							}
-							if verbose >= 3 {
-								logger("Checking file: %s\n", relPath)
-								logger("Cache entry exists: %v\n", ok)
-								if ok {
-									logger("Cache size=%d, current size=%d\n", entry.Size, srcInfo.Size())
-									logger("Cache hash=%d, current hash=%d\n", entry.Hash, hash)
-								}
-								_, statErr := os.Stat(dstPath)
-								logger("Destination exists: %v\n", statErr == nil)
-							}
-						}
-					}
-				} else if validate {
-					// VALIDATION MODE - Start validation logging
-					if verbose >= 2 {
-						logger("[%s] [VALIDATE] Starting validation for: %s\n", timestamp(), relPath)
-					}
+// eventPrinter turns engine events into the log lines and progress updates
+// of the terminal and TUI modes.
+func eventPrinter(src string, verbose int, logger LoggerFunc, progress ProgressFunc) func(core.Event) {
+	return func(ev core.Event) {
+		switch ev.Kind {
+		case core.EventLog:
+			logger("%s", ev.Message)
+		case core.EventFileStarted:
+			srcPath := filepath.Join(src, ev.Path)
+			if verbose >= 2 {
+				logger("[%s] [VERBOSE] Copying file: %s (%.2f MB)\n", timestamp(), srcPath, float64(ev.Size)/float64(1<<20))
+			} else if verbose == 1 && ev.Size > 1000*1024*1024 {
+				logger("[%s] [VERBOSE] Copying large file: %s (%.2f MB)\n", timestamp(), srcPath, float64(ev.Size)/float64(1<<20))
+			}
+		case core.EventFileSkipped:
+			srcPath := filepath.Join(src, ev.Path)
+			if verbose >= 2 {
+				logger("[%s] [VERBOSE] Skipping file (cached): %s (%.2f MB)\n", timestamp(), srcPath, float64(ev.Size)/float64(1<<20))
+			} else if verbose == 1 && ev.Size > 1000*1024*1024 {
+				logger("[%s] [VERBOSE] Skipping large file (cached): %s (%.2f MB)\n", timestamp(), srcPath, float64(ev.Size)/float64(1<<20))
+			}
+		case core.EventFileFailed:
+			var fe *core.FileError
+			if errors.As(ev.Err, &fe) && fe.Kind == core.FailureVanished {
+				logger("[%s] [WARN] Source file vanished: %s\n", timestamp(), filepath.Join(src, ev.Path))
+			} else {
+				logger("[%s] [ERROR] %v\n", timestamp(), ev.Err)
+			}
+		case core.EventProgress:
+			progress(ev.Bytes, ev.TotalBytes)
+		}
+	}
+}
 
-					// Check if destination file exists
-					if dstInfo, err := os.Stat(dstPath); err == nil && dstInfo.Mode().IsRegular() {
-						// Check size first (fast)
-						if srcInfo.Size() == dstInfo.Size() {
-							if verbose >= 3 {
-								logger("[%s] [VALIDATE] Size match - calculating hashes for: %s\n", timestamp(), relPath)
-							}
-
-							// Calculate both hashes (slower)
-							srcHash, srcErr := core.FileHash(srcPath)
-							dstHash, dstErr := core.FileHash(dstPath)
-
-							if srcErr == nil && dstErr == nil && srcHash == dstHash {
-								shouldCopy = false
-								if verbose >= 2 {
-									logger("[%s] [VALIDATE] SUCCESS - File validated: %s (size: %d, hash: %d)\n", timestamp(), relPath, srcInfo.Size(), srcHash)
-								} else if verbose == 1 {
-									logger("[%s] [VALIDATE] SUCCESS - %s\n", timestamp(), relPath)
-								}
-
-								// Update cache after successful validation
-								if !noCache {
-									cache.Lock()
-									cache.Update(relPath, srcInfo.Size(), srcHash, time.Now().Unix())
-									cache.Unlock()
-									if verbose >= 3 {
-										logger("[%s] [CACHE] Updated after validation: %s\n", timestamp(), relPath)
-									}
-								}
-							} else {
-								// Hash mismatch
-								if srcErr != nil {
-									logger("[%s] [VALIDATE] ERROR - Cannot calculate source hash for %s: %v\n", timestamp(), relPath, srcErr)
-								} else if dstErr != nil {
-									logger("[%s] [VALIDATE] ERROR - Cannot calculate destination hash for %s: %v\n", timestamp(), relPath, dstErr)
-								} else {
-									logger("[%s] [VALIDATE] MISMATCH - Hash differs for %s\n", timestamp(), relPath)
-									logger("[%s] [VALIDATE]   Source hash: %d\n", timestamp(), srcHash)
-									logger("[%s] [VALIDATE]   Destination hash: %d\n", timestamp(), dstHash)
-								}
-							}
-						} else {
-							// Size mismatch
-							logger("[%s] [VALIDATE] MISMATCH - Size differs for %s\n", timestamp(), relPath)
-							logger("[%s] [VALIDATE]   Source size: %d bytes\n", timestamp(), srcInfo.Size())
-							logger("[%s] [VALIDATE]   Destination size: %d bytes\n", timestamp(), dstInfo.Size())
-						}
-					} else {
-						// Destination missing or not a regular file
-						if verbose >= 2 {
-							logger("[%s] [VALIDATE] MISMATCH - Destination file missing: %s\n", timestamp(), relPath)
-						}
-					}
-				}
+// rateMeter estimates the copy rate from successive progress samples. The
+// rate is smoothed so the rate and ETA shown next to the progress bar don't
+// jump with every file.
+type rateMeter struct {
+	last      time.Time
+	lastBytes int64
+	rate      float64 // Bytes per second
+}
 
-				// Print verbose output for file operations
-				if shouldCopy {
-					if verbose >= 2 {
-						logger("[%s] [VERBOSE] Copying file: %s (%.2f MB)\n", timestamp(), srcPath, float64(srcInfo.Size())/float64(1<<20))
-					} else if verbose == 1 && srcInfo.Size() > 1000*1024*1024 {
-						logger("[%s] [VERBOSE] Copying large file: %s (%.2f MB)\n", timestamp(), srcPath, float64(srcInfo.Size())/float64(1<<20))
-					}
-				} else {
-					if verbose >= 2 {
-						logger("[%s] [VERBOSE] Skipping file (cached): %s (%.2f MB)\n", timestamp(), srcPath, float64(srcInfo.Size())/float64(1<<20))
-					} else if verbose == 1 && srcInfo.Size() > 1000*1024*1024 {
-						logger("[%s] [VERBOSE] Skipping large file (cached): %s (%.2f MB)\n", timestamp(), srcPath, float64(srcInfo.Size())/float64(1<<20))
-					}
-				}
+// status adds a sample and returns the current rate and the estimated time
+// left to process total bytes.
+func (m *rateMeter) status(copied, total int64) string {
+	now := time.Now()
+	if !m.last.IsZero() {
+		if dt := now.Sub(m.last).Seconds(); dt > 0 {
+			current := float64(copied-m.lastBytes) / dt
+			if m.rate == 0 {
+				m.rate = current
+			} else {
+				m.rate = 0.3*current + 0.7*m.rate
+			}
+		}
+	}
+	m.last, m.lastBytes = now, copied
 
-				// Copy or skip the file, update progress
-				if shouldCopy {
-					if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
-						cache.SaveCache()
-						fatal("[%s] [ERROR] Failed to create directory %s: %v\n", timestamp(), filepath.Dir(dstPath), err)
-						return
-					}
-					// Delete the destination file if it exists
-					if _, err := os.Stat(dstPath); err == nil {
-						if rmErr := os.Remove(dstPath); rmErr != nil {
-							cache.SaveCache()
-							fatal("[%s] [ERROR] Failed to remove old destination file %s: %v\n", timestamp(), dstPath, rmErr)
-							return
-						}
-					}
-					in, err := core.OpenWithRetry(srcPath, 5)
-					if err != nil {
-						cache.SaveCache()
-						fatal("[%s] [ERROR] Failed to open source file %s: %v\n", timestamp(), srcPath, err)
-						return
-					}
-					outFile, err := core.CreateWithRetry(dstPath, 5)
-					if err != nil {
-						in.Close()
-						cache.SaveCache()
-						fatal("[%s] [ERROR] Failed to create destination file %s: %v\n", timestamp(), dstPath, err)
-						return
-					}
-					_, err = io.CopyBuffer(outFile, in, buf)
-
-					retries := 3
-					var closeErr error
-					for i := 0; i < retries; i++ {
-						closeErr = outFile.Sync()
-						if closeErr == nil {
-							break
-						}
-						if i == retries-1 {
-							cache.SaveCache()
-							fatal("[%s] [ERROR] Error syncing destination file %s: %v\n", timestamp(), dstPath, closeErr)
-							return
-						}
-						time.Sleep(500 * time.Millisecond)
-					}
-					closeErr = outFile.Close()
-					if closeErr != nil {
-						cache.SaveCache()
-						fatal("[%s] [ERROR] Error closing destination file %s: %v\n", timestamp(), dstPath, closeErr)
-						return
-					}
-					closeErr = in.Close()
-					if closeErr != nil {
-						cache.SaveCache()
-						fatal("[%s] [ERROR] Error closing source file %s: %v\n", timestamp(), srcPath, closeErr)
-						return
-					}
+	eta := "--"
+	if copied >= total && total > 0 {
+		eta = "0s"
+	} else if m.rate > 0 {
+		eta = time.Duration(float64(total-copied) / m.rate * float64(time.Second)).Round(time.Second).String()
+	}
+	return fmt.Sprintf("%.2f MB/s | ETA %s", m.rate/(1024*1024), eta)
+}
 
-					if err != nil {
-						cache.SaveCache()
-						fatal("[%s] [ERROR] Failed to copy %s to %s: %v\n", timestamp(), srcPath, dstPath, err)
-						return
-					}
-					// After successful copy, when updating cache:
-					if !noCache {
-						hash, _ = core.FileHash(srcPath)
-						cache.Lock()
-						_, existed := cache.IsUpToDate(relPath)
-						cache.Update(relPath, srcInfo.Size(), hash, time.Now().Unix())
-						cache.Unlock()
-
-						if verbose >= 3 {
-							if existed {
-								logger("[%s] [CACHE] Updated cache entry: %s (size=%d, hash=%d)\n", timestamp(), relPath, srcInfo.Size(), hash)
-							} else {
-								logger("[%s] [CACHE] Added new cache entry: %s (size=%d, hash=%d)\n", timestamp(), relPath, srcInfo.Size(), hash)
-							}
-						}
-						cache.SaveCache()
-					}
-				}
+// Exit codes of a copy, following rsync where it has an equivalent.
+const (
+	exitOK       = 0  // All files were copied or are up to date
+	exitUsage    = 1  // Invalid arguments or options
+	exitSelect   = 3  // The cache can't be used, e.g. it is locked by another run
+	exitFatal    = 11 // The run was aborted by an error
+	exitSignal   = 20 // Interrupted by Ctrl-C, SIGINT or SIGTERM
+	exitPartial  = 23 // Some files could not be copied
+	exitVanished = 24 // Some source files vanished during the run, all others were copied
+)
 
-				mu.Lock()
-				copiedBytes += srcInfo.Size()
-				now := time.Now()
-				if now.Sub(lastProgressUpdate) > 100*time.Millisecond || copiedBytes == totalBytes {
-					lastProgressUpdate = now
-					progress(copiedBytes, totalBytes)
-				}
-				mu.Unlock()
-			}
-		}()
+// exitCode returns the exit code for the result of a run.
+func exitCode(res core.Result, err error) int {
+	var fe *core.FileError
+	if errors.Is(err, core.ErrStopped) || errors.Is(err, context.Canceled) {
+		return exitSignal
+	} else if errors.As(err, &fe) && fe.Kind != core.FailureNoSpace {
+		return exitPartial // Stopped by --stop-on-error
+	} else if err != nil {
+		return exitFatal
+	}
+	for _, f := range res.Failures {
+		if f.Kind != core.FailureVanished {
+			return exitPartial
+		}
 	}
+	if len(res.Failures) > 0 {
+		return exitVanished
+	}
+	return exitOK
+}
 
-	for _, relPath := range fileList {
-		fileChan <- relPath
+// interruptHandler returns the reaction to Ctrl-C, SIGINT and SIGTERM: the
+// first one stops the engine gracefully, a second one calls force.
+func interruptHandler(engine *core.Engine, logger LoggerFunc, force func()) func() {
+	var count atomic.Int32
+	return func() {
+		if count.Add(1) > 1 {
+			force()
+			return
+		}
+		logger("[%s] [WARN] Interrupted, finishing the files in progress and saving the cache (interrupt again to exit immediately)\n", timestamp())
+		engine.Stop()
+	}
+}
+
+// notifyInterrupts calls fn for every SIGINT and SIGTERM the process receives.
+func notifyInterrupts(fn func()) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for range sigs {
+			fn()
+		}
+	}()
+}
+
+// stringList is a flag that may be given several times, collecting its values.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// printStopped tells how far a stopped run got.
+func printStopped(out io.Writer, res core.Result) {
+	fmt.Fprintf(out, "[%s] [WARN] Copy stopped after %d of %d files, run the same command again to resume\n",
+		timestamp(), res.Copied+res.Skipped+res.Failed, res.Files)
+}
+
+// maxListedFailures limits how many files of each kind the failure summary lists.
+const maxListedFailures = 20
+
+// printFailureSummary lists the files that failed, grouped by kind of failure.
+func printFailureSummary(out io.Writer, failures []*core.FileError) {
+	if len(failures) == 0 {
+		return
+	}
+	byKind := map[core.FailureKind][]*core.FileError{}
+	var kinds []core.FailureKind
+	for _, f := range failures {
+		if _, ok := byKind[f.Kind]; !ok {
+			kinds = append(kinds, f.Kind)
+		}
+		byKind[f.Kind] = append(byKind[f.Kind], f)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i] < kinds[j] })
+
+	fmt.Fprintf(out, "[%s] [ERROR] %d file(s) could not be copied:\n", timestamp(), len(failures))
+	for _, kind := range kinds {
+		list := byKind[kind]
+		fmt.Fprintf(out, "[%s] [ERROR]   %s: %d\n", timestamp(), kind, len(list))
+		for i, f := range list {
+			if i == maxListedFailures {
+				fmt.Fprintf(out, "[%s] [ERROR]     ... and %d more\n", timestamp(), len(list)-i)
+				break
+			}
+			fmt.Fprintf(out, "[%s] [ERROR]     %v\n", timestamp(), f.Err)
+		}
 	}
-	close(fileChan)
-	wg.Wait()
-	cache.SaveCache()
 }
 
 func main() {
 	// CAPTURE ORIGINAL COMMAND FIRST
 	originalCommand := strings.Join(os.Args, " ")
 
-	os.MkdirAll(".cache_cache_copy", os.ModePerm)
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		os.Exit(runCacheCommand(os.Args[2:]))
+	}
 
 	// Step 1: Find src and dst in os.Args
 	args := os.Args[1:]
@@ -300,15 +238,44 @@ func main() {
 	clearCache := flag.Bool("clear-cache", false, "Delete the cache.json file before starting copy")
 	mirror := flag.Bool("mirror", false, "Mirror source to destination: delete extra files in the destination that are not in the source")
 	noCache := flag.Bool("no-cache", false, "Disable cache: always copy all files")
-	maxCacheAge := flag.Int("max-cache-age", 90, "Maximum age (in days) for cache entries (default 90)")
+	maxCacheAge := flag.Int("max-cache-age", 90, "Maximum age (in days) since a cache entry was last copied or verified, 0 to keep all (default 90)")
 	verbose := flag.Int("verbose", 0, "Set verbosity level (0=quiet, 1=print large file operations >500MB, 2=print all file operations)")
 	logPath := flag.String("log-path", "", "Path to log file (all stdout will also be written here)")
 	bufferSizeStr := flag.String("buffer-size", "4MB", "Buffer size for file copy (e.g. 4MB, 256KB, 1048576)")
 	noTUI := flag.Bool("no-tui", false, "Disable TUI and use classic terminal output (default: TUI enabled)")
 	validate := flag.Bool("validate", false, "Validate files by comparing size and hash between source and destination (slower but 100% accurate)")
 	autoClean := flag.Bool("auto-clean", true, "Automatically clean stale cache entries on every run (default: true)")
+	manifest := flag.Bool("manifest", false, "Keep a manifest of copied files in the destination (.cache_copy/manifest) to resume from on any machine")
+	cacheDirFlag := flag.String("cache-dir", "", "Directory holding cache files (default: $CACHE_COPY_DIR, then the user cache directory)")
+	cacheBackend := flag.String("cache-backend", core.BackendJSON, "Cache storage backend: json (in-memory) or lsm (on-disk, for very large trees)")
+	strict := flag.Bool("strict", false, "Always hash source files when checking the cache instead of trusting size, mtime and inode")
+	verifyCopy := flag.Bool("verify-copy", false, "Read back every copied file and compare its hash with the source")
+	chunkThresholdStr := flag.String("chunk-threshold", "1GB", "Copy files of at least this size in parallel chunks, 0 to disable")
+	chunkSizeStr := flag.String("chunk-size", "64MB", "Size of the chunks of large files copied in parallel")
+	retries := flag.Int("retries", 1, "Number of times files that failed are retried after all others")
+	retryAttempts := flag.Int("retry-attempts", 3, "Tries of each file operation (open, create, sync) that fails with a retryable error")
+	retryDelay := flag.Duration("retry-delay", 200*time.Millisecond, "Wait before the first retry of a file operation, doubled for each further one")
+	retryMaxDelay := flag.Duration("retry-max-delay", 5*time.Second, "Longest wait between retries")
+	retryErrors := flag.String("retry-errors", "transient", "Errors that are retried: transient, all, none, or a comma separated list of error names")
+	fileTimeout := flag.Duration("file-timeout", 0, "Give up on a file that takes longer than this to copy, 0 for no limit")
+	stopOnError := flag.Bool("stop-on-error", false, "Stop at the first file that can't be copied instead of continuing")
+	copyMethodFlag := flag.String("copy-method", "auto", "How file data is copied: auto, reflink, copy_file_range, sendfile or buffered")
+	sparse := flag.Bool("sparse", true, "Copy only the data of sparse files and keep their holes (Linux, default: true)")
+	hardLinks := flag.Bool("hard-links", false, "Recreate hard links between source files in the destination instead of copying each")
+	symlinksFlag := flag.String("symlinks", "follow", "Symbolic link handling: preserve, follow, skip or error")
+	preserveFlag := flag.String("preserve", "", "Preserve source metadata: comma separated list of times, mode, owner, xattr, acl, or all")
+	var includes, excludes stringList
+	flag.Var(&includes, "include", "Copy only files matching this glob (repeatable)")
+	flag.Var(&excludes, "exclude", "Leave out paths matching this glob (repeatable)")
+	filterFrom := flag.String("filter-from", "", "Read exclude patterns in gitignore syntax from this file")
+	minSizeStr := flag.String("min-size", "", "Leave out files smaller than this (e.g. 10KB)")
+	maxSizeStr := flag.String("max-size", "", "Leave out files larger than this (e.g. 2GB)")
+	newerThan := flag.String("newer-than", "", "Copy only files modified within this duration (e.g. 7d, 12h) or since this date (e.g. 2024-05-31)")
+	olderThan := flag.String("older-than", "", "Copy only files modified more than this duration ago or before this date")
+	maxDepth := flag.Int("max-depth", 0, "Descend at most this many directory levels below the source, 0 for no limit")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `Usage: cache_copy [src] [dst] [options]
+       cache_copy cache <list|show|stats|prune|rm|export|import|verify|rebuild> [options]
 
 [src] and [dst] are required.
 
@@ -341,7 +308,9 @@ FLAGS:
 		Disable cache: always copy all files (ignores existing cache, slower but always accurate)
   
   -max-cache-age int
-		Maximum age (in days) for cache entries. Entries older than this are removed (default: 90)
+		Maximum age (in days) for cache entries, measured from when the file was last copied
+		or its source last hashed and verified. Entries older than this are removed (default: 90)
+		Use 0 to keep entries regardless of age
   
   -verbose int
 		Set verbosity level: 0=quiet, 1=large files >1GB, 2=all files, 3=cache debug (default: 0)
@@ -353,6 +322,13 @@ FLAGS:
 		Buffer size for file copy operations (default: "4MB")
 		Examples: 4MB, 256KB, 1048576, 8MB
   
+  -chunk-threshold string
+		Files of at least this size are split into chunks copied by several workers at once
+		(default: "1GB"). Use 0 to always copy a file with a single worker
+  
+  -chunk-size string
+		Size of the chunks of files above --chunk-threshold (default: "64MB")
+  
   -no-tui
 		Disable TUI and use classic terminal output (disables fancy progress display)
   
@@ -363,6 +339,126 @@ FLAGS:
   -auto-clean
 		Automatically clean stale cache entries on every run (default: true)
 		Use --auto-clean=false to disable automatic cache cleaning
+  
+  -manifest
+		Keep a manifest of copied files (relative paths, sizes, hashes) in the destination
+		at .cache_copy/manifest. A run without a cache for this destination, e.g. on another
+		machine or mount point, resumes from it instead of recopying everything
+		(verify with "cache_copy cache verify <dst>")
+  
+  -cache-dir string
+		Directory holding cache files (default: $CACHE_COPY_DIR, then the user cache directory)
+  
+  -cache-backend string
+		Cache storage backend (default: "json")
+		json: entries kept in memory, stored as a JSON file plus journal
+		lsm:  entries kept on disk in a .db directory, for trees with tens of millions of files
+  
+  -strict
+		Always hash source files when checking the cache (slower, reads every cached file)
+		By default a file whose size, mtime, ctime and inode match the cache is skipped unread
+  
+  -verify-copy
+		Read every copied file back from the destination and compare its hash with the source
+		(default: false). Copied files are always hashed while copying, so this is one extra read
+  
+  -preserve string
+		Preserve source metadata on copied files and directories (default: none)
+		Comma separated list of: times, mode, owner, xattr, acl, or all
+		owner needs root; xattr and acl are Linux only. Directory times are applied after their contents
+  
+  -include pattern
+		Copy only files matching this glob, or inside a directory matching it (repeatable)
+		Without --include all files are copied. With it, directories holding no copied file are
+		not created in the destination
+  
+  -exclude pattern
+		Leave out files and directories matching this glob (repeatable). Excluded directories are
+		not descended. Patterns use gitignore syntax: * and ? match within a name, ** matches any
+		number of directories, a pattern without / matches a name at any depth, one with / is
+		relative to the source root, a trailing / matches only directories and !pattern re-includes
+  
+  -filter-from string
+		Read exclude patterns from this file, one per line in gitignore syntax (# starts a comment)
+		.cachecopyignore files in the source tree are read the same way and apply to the directory
+		holding them. --exclude overrides .cachecopyignore files, which override --filter-from.
+		Filtered out paths are never deleted by --mirror
+  
+  -min-size string
+		Leave out files smaller than this, e.g. 10KB (default: no limit)
+  
+  -max-size string
+		Leave out files larger than this, e.g. 2GB (default: no limit)
+  
+  -newer-than string
+		Copy only files modified within this duration (e.g. 7d, 36h, 1d12h) or since this date
+		(e.g. 2024-05-31, "2024-05-31 18:30", or RFC 3339 such as 2024-05-31T18:30:00Z)
+  
+  -older-than string
+		Copy only files modified more than this duration ago or before this date, same formats
+		Size and age limits apply to files, not directories; directories holding no copied file
+		are not created. --mirror keeps destination files outside the limits
+  
+  -max-depth int
+		Copy only files at most this many levels below the source (1 = files directly in it),
+		directories at the last level are not descended (default: 0, no limit)
+  
+  -symlinks string
+		How symbolic links in the source are handled (default: "follow")
+		follow:   copy the files links point to and descend into linked directories (loops are detected)
+		preserve: recreate links in the destination; absolute links into the source are made relative
+		skip:     ignore links
+		error:    stop with an error when a link is found
+  
+  -hard-links
+		Files that are hard links to the same source file are copied once and hard linked
+		in the destination (default: false). Link groups are kept intact on later runs
+  
+  -sparse
+		Copy only the data extents of sparse files (VM images, preallocated buffers) and keep
+		their holes unallocated in the destination (Linux, default: true). Use --sparse=false to disable
+  
+  -copy-method string
+		How file data is copied (default: "auto")
+		auto:            reflink where it works, else buffered; copy_file_range and sendfile only
+		                 with --no-cache, where the copied files don't have to be hashed
+		reflink:         share the source data blocks (btrfs, XFS; source and destination on one file system)
+		copy_file_range: copy inside the kernel, server side on NFS and SMB mounts that support it
+		sendfile:        copy inside the kernel
+		buffered:        read and write through --buffer-size
+		Methods other than auto and buffered are Linux only; a forced method fails files it can't copy
+  
+  -retries int
+		Files that fail are retried this many times after all other files (default: 1)
+		A file that still fails is listed in the failure summary and the copy goes on
+  
+  -retry-attempts int
+		Tries of each file operation (open, create, sync) that fails with a retryable error
+		before the file counts as failed (default: 3). Use 1 to disable
+  
+  -retry-delay duration
+		Wait before the first retry of a file operation, doubled for each further one and
+		varied by up to 20%% (default: 200ms). Deferred retry passes wait the same way
+  
+  -retry-max-delay duration
+		Longest wait between retries (default: 5s)
+  
+  -retry-errors string
+		Errors that are retried (default: "transient")
+		transient: errors of busy or briefly unreachable file systems
+		           (Linux: EINTR, EAGAIN, EIO, EBUSY, ETIMEDOUT, ESTALE, ECONNRESET, EHOSTDOWN;
+		           Windows: SHARING_VIOLATION, LOCK_VIOLATION, BAD_NETPATH, UNEXP_NET_ERR,
+		           NETNAME_DELETED, SEM_TIMEOUT, IO_DEVICE)
+		all, none, or a comma separated list of error names, e.g. EIO,ESTALE
+  
+  -file-timeout duration
+		Give up on a file that takes longer than this to copy, e.g. 10m (default: 0, no limit)
+		It is retried in the deferred passes like any other failed file. Opening, syncing, closing
+		and renaming that hang on a stalled network mount are abandoned at the timeout as well
+  
+  -stop-on-error
+		Stop at the first file that can't be copied instead of continuing (default: false)
+		A full destination always stops the copy
 
 EXAMPLES:
   cache_copy /source/folder /destination/folder
@@ -371,179 +467,258 @@ EXAMPLES:
   cache_copy /source /dest --validate --no-cache --verbose 3
   cache_copy /source /dest --clear-cache --mirror --log-path copy.log
   cache_copy /source /dest --auto-clean=false --verbose 1
+  cache_copy /source /dest --strict --verify-copy
+  cache_copy /source /dest --cache-backend lsm
+  cache_copy /source /mnt/usb/dest --manifest
+  cache_copy /source /dest --preserve=times,mode --symlinks=preserve --hard-links
+  cache_copy /source /dest --exclude "*.tmp" --exclude "build/" --include "src/**/*.go"
+  cache_copy /source /dest --mirror --filter-from ignore.txt
+  cache_copy /captures /dest --newer-than 7d --max-size 2GB
+  cache_copy /source /mnt/nas/dest --retry-attempts 5 --retry-delay 1s --file-timeout 30m --retries 3
+
+EXIT CODES (as in rsync):
+  0   All files were copied or are up to date
+  1   Invalid arguments or options
+  3   The cache can't be used, e.g. it is locked by another run
+  11  The copy was aborted by an error, e.g. the destination is full
+  20  Interrupted by Ctrl-C, SIGINT or SIGTERM
+  23  Some files could not be copied (see the failure summary at the end)
+  24  Some source files vanished during the copy, all others were copied
 
 CACHE BEHAVIOR:
-  - Cache files are stored in .cache_cache_copy/ directory
+  - Cache files are stored in the directory given by --cache-dir, else $CACHE_COPY_DIR,
+    else the user cache directory ($XDG_CACHE_HOME/cache_copy or ~/.cache/cache_copy on Linux,
+    %%LocalAppData%%\cache_copy on Windows)
+  - Caches found in a .cache_cache_copy/ directory of the working directory are moved there automatically
+  - A .lock file next to each cache prevents two runs from using the same cache at once
+  - The .cache_copy/ directory in the destination root (see --manifest) is never copied or mirrored away
   - Each source/destination pair gets its own unique cache file
-  - Cache entries track file size, hash, and modification time
+  - Cache keys are relative paths with forward slashes in Unicode NFC form, so a cache (or an export,
+    see "cache import -rebase") can move between the Windows and Linux builds
+  - Changes are appended to a .journal file next to the cache file and folded back into it periodically
+  - Cache files are replaced atomically and carry a checksum; a corrupted cache file is detected
+    on load and the previous good generation (.prev) is used instead
+  - A cache file written by a newer version of cache_copy is refused and left untouched
+  - Cache entries track file size, hash, the source mtime, ctime and inode,
+    and when the file was last copied and last verified
+  - Files whose size, mtime, ctime and inode are unchanged are skipped without being read
+    (use --strict to hash them anyway)
+  - Copied files are hashed as they are copied, the source is not read a second time for the cache
+    (except with reflink, copy_file_range and sendfile, where the source is hashed after the copy)
+  - Files copied in chunks get a digest of their chunk hashes; the chunk size is stored with it
+  - Files are written to a hidden .cache_copy-<name>.<random>.tmp file next to the target and renamed
+    over it when complete; temp files left by an interrupted run are removed on the next run
+  - Ctrl-C (or SIGTERM) stops handing out files, lets the files in progress finish and saves the
+    cache; running the same command again resumes with the remaining files. A second Ctrl-C exits
+    immediately, abandoning the files in progress
   - Use --clear-cache to start fresh and delete the entire cache file
   - Use --validate to bypass cache and verify actual file content
+  - Use "cache_copy cache" to list, inspect, prune, export and import caches
+    and to verify a destination against its manifest or rebuild a cache from a populated destination
   - Stale cache entries are automatically cleaned by default (disable with --auto-clean=false)
 
 PERFORMANCE TIPS:
   - Increase --workers for many small files (default is usually good)
   - Increase --buffer-size for large files (4MB-8MB recommended)
+  - Files above --chunk-threshold are copied by several workers, so a few huge files finish sooner
   - Use --no-tui for scripting or when TUI causes issues
   - Use --validate only when you need 100%% verification (slower)
 
 `)
 	}
-	flag.Parse()
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
 
 	if src == "" || dst == "" {
 		flag.Usage()
-		return
+		os.Exit(exitUsage)
 	}
 
 	// PRINT THE ORIGINAL COMMAND AS ENTERED
 	fmt.Fprintf(os.Stderr, "[%s] [INFO] Command: %s\n", timestamp(), originalCommand)
 
-	// After parsing src and dst:
-	srcClean := filepath.Clean(src)
-	copyContents := false
+	// Determine rootDst from the src path behavior
+	rootDst := core.DestinationRoot(src, dst)
 
-	// Detect OS-specific separator
-	if (runtime.GOOS == "windows" && strings.HasSuffix(src, `\`)) ||
-		(runtime.GOOS != "windows" && strings.HasSuffix(src, `/`)) {
-		copyContents = true
+	// Now use src and dst variables instead of flag.Arg(0), flag.Arg(1)
+	cacheDir, err := core.ResolveCacheDir(*cacheDirFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] Invalid cache directory: %v\n", timestamp(), err)
+		os.Exit(exitUsage)
 	}
+	cachePath := core.StorePath(core.LocalCacheFile(cacheDir, src, rootDst), *cacheBackend)
+	fmt.Fprintf(os.Stderr, "[%s] [INFO] Using cache file: %s\n", timestamp(), cachePath)
 
-	// Determine rootDst and file list
-	var rootDst string
-	if copyContents {
-		rootDst = dst
-	} else {
-		srcBase := filepath.Base(srcClean)
-		rootDst = filepath.Join(dst, srcBase)
+	cacheLock, err := core.LockCache(cachePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] Cannot use cache %s: %v\n", timestamp(), cachePath, err)
+		os.Exit(exitSelect)
+	}
+	defer cacheLock.Unlock()
+	// os.Exit skips deferred calls, release the lock first
+	exit := func(code int) {
+		cacheLock.Unlock()
+		os.Exit(code)
 	}
 
-	// Use rootDst as your destination root in the rest of your logic
-	// When gathering fileList, use srcClean as the source root
-
-	// Now use src and dst variables instead of flag.Arg(0), flag.Arg(1)
-	cachePath := core.LocalCacheFile(src, rootDst)
-	fmt.Fprintf(os.Stderr, "[%s] [INFO] Using cache file: %s\n", timestamp(), cachePath)
+	if moved, err := core.MigrateLegacyCache(cachePath); err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [WARN] Failed to move cache from %s: %v\n", timestamp(), core.LegacyCacheDir, err)
+	} else if moved {
+		fmt.Fprintf(os.Stderr, "[%s] [INFO] Moved existing cache from %s to %s\n", timestamp(), core.LegacyCacheDir, cacheDir)
+	}
 
 	// Optionally clear the cache file before starting
 	if *clearCache {
-		if err := os.Remove(cachePath); err == nil {
+		if err := core.RemoveCacheFiles(cachePath); err == nil {
 			fmt.Fprintf(os.Stderr, "[%s] [INFO] Cache deleted: %s\n", timestamp(), cachePath)
 		} else if !os.IsNotExist(err) {
 			fmt.Fprintf(os.Stderr, "[%s] [ERROR] Failed to delete cache: %v\n", timestamp(), err)
-			return
+			exit(exitSelect)
 		}
 	}
 
-	cache := core.NewGlobalCache(cachePath)
-
-	// Conditionally clean stale cache entries based on --auto-clean flag
-	if *autoClean {
-		cache.Lock()
-		staleCacheKeys := []string{}
-		for _, relPath := range cache.Keys() {
-			srcPath := filepath.Join(src, relPath)
-			if _, err := os.Stat(srcPath); os.IsNotExist(err) {
-				staleCacheKeys = append(staleCacheKeys, relPath)
-			}
-		}
-		for _, staleKey := range staleCacheKeys {
-			if *verbose >= 3 {
-				fmt.Fprintf(os.Stderr, "[CACHE] Removing stale entry: %s\n", staleKey)
-			}
-			cache.Remove(staleKey)
-		}
-		cache.Unlock()
-
-		if len(staleCacheKeys) > 0 {
-			if *verbose >= 1 {
-				fmt.Fprintf(os.Stderr, "[%s] [INFO] Auto-cleaned %d stale cache entries\n", timestamp(), len(staleCacheKeys))
-			}
-			cache.SaveCache()
-		}
+	cache, err := core.OpenGlobalCache(cachePath, *cacheBackend)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] Failed to open cache %s: %v\n", timestamp(), cachePath, err)
+		exit(exitSelect)
 	}
-
-	// Optionally mirror (delete extra files in destination)
-	if *mirror {
-		if err := os.MkdirAll(rootDst, os.ModePerm); err != nil {
+	if info, _ := core.ReadCacheInfo(cachePath); info.KeyFormat < core.KeyFormatPortable {
+		if moved := cache.NormalizeKeys(); moved > 0 {
+			fmt.Fprintf(os.Stderr, "[%s] [INFO] Converted %d cache keys to the portable format\n", timestamp(), moved)
 			cache.SaveCache()
-			fmt.Fprintf(os.Stderr, "[%s] [ERROR] Failed to create root destination directory %s: %v\n", timestamp(), rootDst, err)
-			return
-		}
-		err := deleteExtraFiles(src, rootDst, cache)
-		if err != nil {
-			cache.SaveCache()
-			fmt.Fprintf(os.Stderr, "[%s] [ERROR] Error deleting extra files: %v\n", timestamp(), err)
-			return
 		}
-		cache.SaveCache()
+	}
+	absSrc, _ := filepath.Abs(src)
+	absDst, _ := filepath.Abs(rootDst)
+	if err := core.WriteCacheInfo(cachePath, core.CacheInfo{Src: absSrc, Dst: absDst, Backend: *cacheBackend, LastUsed: time.Now().Unix(), KeyFormat: core.KeyFormatPortable}); err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [WARN] Failed to write cache info for %s: %v\n", timestamp(), cachePath, err)
 	}
 
-	// Remove old cache entries
-	now := time.Now().Unix()
-	maxAgeSeconds := int64(*maxCacheAge) * 24 * 60 * 60
-	cache.Lock()
-	for _, key := range cache.Keys() {
-		entry, ok := cache.IsUpToDate(key)
-		if ok && entry.ModTime > 0 && now-entry.ModTime > maxAgeSeconds {
-			cache.Remove(key)
+	bufSize, err := core.ParseSize(*bufferSizeStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] Invalid buffer size: %v\n", timestamp(), err)
+		cache.Close()
+		exit(exitUsage)
+	}
+	chunkThreshold, err := core.ParseSize(*chunkThresholdStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] Invalid chunk threshold: %v\n", timestamp(), err)
+		cache.Close()
+		exit(exitUsage)
+	}
+	chunkSize, err := core.ParseSize(*chunkSizeStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] Invalid chunk size: %v\n", timestamp(), err)
+		cache.Close()
+		exit(exitUsage)
+	}
+	preserve, err := core.ParsePreserve(*preserveFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] %v\n", timestamp(), err)
+		cache.Close()
+		exit(exitUsage)
+	}
+	symlinks, err := core.ParseSymlinkMode(*symlinksFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] %v\n", timestamp(), err)
+		cache.Close()
+		exit(exitUsage)
+	}
+	copyMethod, err := core.ParseCopyMethod(*copyMethodFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] %v\n", timestamp(), err)
+		cache.Close()
+		exit(exitUsage)
+	}
+	retryable, err := core.ParseRetryErrors(*retryErrors)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] %v\n", timestamp(), err)
+		cache.Close()
+		exit(exitUsage)
+	}
+	filter, err := core.NewFilter(includes, excludes)
+	if err == nil && *filterFrom != "" {
+		if err = filter.AddFile(*filterFrom); err != nil {
+			err = fmt.Errorf("failed to read filter file: %w", err)
 		}
 	}
-	cache.Unlock()
-	cache.SaveCache()
-
-	// If all cache entries are old, delete the cache file
-	allOld := true
-	cache.Lock()
-	for _, key := range cache.Keys() {
-		entry, ok := cache.IsUpToDate(key)
-		if ok && entry.ModTime > 0 && now-entry.ModTime <= maxAgeSeconds {
-			allOld = false
-			break
+	if err == nil && *minSizeStr != "" {
+		var n int
+		if n, err = core.ParseSize(*minSizeStr); err != nil {
+			err = fmt.Errorf("invalid minimum size: %w", err)
 		}
+		filter.MinSize = int64(n)
 	}
-	cache.Unlock()
-	if allOld && len(cache.Keys()) > 0 {
-		fmt.Fprintf(os.Stderr, "[%s] [INFO] All cache entries older than %d days, deleting cache file: %s\n", timestamp(), *maxCacheAge, cachePath)
-		os.Remove(cachePath)
+	if err == nil && *maxSizeStr != "" {
+		var n int
+		if n, err = core.ParseSize(*maxSizeStr); err != nil {
+			err = fmt.Errorf("invalid maximum size: %w", err)
+		}
+		filter.MaxSize = int64(n)
 	}
-
-	// Gather all directories and files (relative paths) from the source directory
-	dirs := []string{}
-	fileList := []string{}
-	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	if err == nil && *newerThan != "" {
+		if filter.NewerThan, err = core.ParseTimeLimit(*newerThan, time.Now()); err != nil {
+			err = fmt.Errorf("invalid --newer-than: %w", err)
 		}
-		relPath, _ := filepath.Rel(src, path)
-		if info.IsDir() {
-			dirs = append(dirs, relPath)
-		} else {
-			fileList = append(fileList, relPath)
+	}
+	if err == nil && *olderThan != "" {
+		if filter.OlderThan, err = core.ParseTimeLimit(*olderThan, time.Now()); err != nil {
+			err = fmt.Errorf("invalid --older-than: %w", err)
 		}
-		return nil
-	})
+	}
+	if err == nil {
+		filter.MaxDepth = *maxDepth
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "[%s] [ERROR] Error gathering file list: %v\n", timestamp(), err)
-		cache.SaveCache()
-		return
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] %v\n", timestamp(), err)
+		cache.Close()
+		exit(exitUsage)
 	}
-
-	// Calculate total bytes to copy for progress bar
-	var totalBytes int64
-	for _, relPath := range fileList {
-		srcPath := filepath.Join(src, relPath)
-		info, err := os.Stat(srcPath)
-		if err == nil {
-			totalBytes += info.Size()
-		}
+	retry := core.DefaultRetryPolicy()
+	retry.Attempts = max(*retryAttempts, 1)
+	retry.Delay = *retryDelay
+	retry.MaxDelay = *retryMaxDelay
+	retry.Retryable = retryable
+	opts := core.Options{
+		Src:            src,
+		Dst:            rootDst,
+		Cache:          cache,
+		Workers:        *workers,
+		BufferSize:     bufSize,
+		Validate:       *validate,
+		Strict:         *strict,
+		VerifyCopy:     *verifyCopy,
+		Mirror:         *mirror,
+		AutoClean:      *autoClean,
+		MaxCacheAge:    time.Duration(*maxCacheAge) * 24 * time.Hour,
+		Manifest:       *manifest,
+		Preserve:       preserve,
+		Symlinks:       symlinks,
+		HardLinks:      *hardLinks,
+		Sparse:         *sparse,
+		CopyMethod:     copyMethod,
+		Retry:          retry,
+		Retries:        *retries,
+		FileTimeout:    *fileTimeout,
+		StopOnError:    *stopOnError,
+		Filter:         filter,
+		ChunkThreshold: int64(chunkThreshold),
+		ChunkSize:      int64(chunkSize),
+		Verbose:        *verbose,
+	}
+	if *noCache {
+		opts.Cache = nil
 	}
 
-	// Ensure all destination directories exist
-	for _, relDir := range dirs {
-		dstDir := filepath.Join(rootDst, relDir)
-		if err := os.MkdirAll(dstDir, os.ModePerm); err != nil {
-			fmt.Fprintf(os.Stderr, "[%s] [ERROR] Failed to create directory %s: %v\n", timestamp(), dstDir, err)
-		}
+	var copiedBytes, totalBytes atomic.Int64
+	progress := func(copied, total int64) {
+		copiedBytes.Store(copied)
+		totalBytes.Store(total)
 	}
 
 	// --- Classic terminal mode (no TUI) ---
@@ -558,13 +733,6 @@ PERFORMANCE TIPS:
 			}
 		}
 
-		bufSize, err := core.ParseSize(*bufferSizeStr)
-		if err != nil {
-			fmt.Fprintf(out, "[%s] [ERROR] Invalid buffer size: %v\n", timestamp(), err)
-			cache.SaveCache()
-			return
-		}
-
 		totalBuffer := int64(*workers) * int64(bufSize)
 		if totalBuffer > 2*1024*1024*1024 {
 			fmt.Fprintf(out, "[%s] [WARN] Total buffer allocation is %.2f GB (%d workers × %s)\n",
@@ -582,56 +750,67 @@ PERFORMANCE TIPS:
 			}
 		}
 
-		var copiedBytes int64
 		startTime := time.Now()
 		done := make(chan struct{})
 
-		progress := func(copied, total int64) {
-			copiedBytes = copied
-		}
-
 		logger := func(format string, args ...interface{}) {
+			msg := fmt.Sprintf(format, args...)
 			fmt.Print("\n")
-			fmt.Fprintf(out, format, args...)
-			if len(format) == 0 || format[len(format)-1] != '\n' {
+			fmt.Fprint(out, msg)
+			if !strings.HasSuffix(msg, "\n") {
 				fmt.Println()
 			}
 		}
 
-		fatal := func(format string, args ...interface{}) {
-			cache.SaveCache()
-			fmt.Fprintf(out, format, args...)
-			os.Exit(1)
-		}
-
 		go func() {
+			var meter rateMeter
 			for {
 				select {
 				case <-done:
 					return
 				default:
 					elapsed := time.Since(startTime).Round(time.Second)
-					fmt.Printf("\rTotal: %.2f MB / %.2f MB %s | %s",
-						float64(copiedBytes)/(1024*1024), float64(totalBytes)/(1024*1024),
-						core.RenderProgressBar(copiedBytes, totalBytes, 40),
-						elapsed)
+					copied, total := copiedBytes.Load(), totalBytes.Load()
+					// Padded so a shorter line fully covers the previous one
+					fmt.Printf("\rTotal: %.2f MB / %.2f MB %s | %s | %s    ",
+						float64(copied)/(1024*1024), float64(total)/(1024*1024),
+						core.RenderProgressBar(copied, total, 40),
+						meter.status(copied, total), elapsed)
 					time.Sleep(500 * time.Millisecond)
 				}
 			}
 		}()
 
-		runCopyWorkers(fileList, src, rootDst, cache, bufSize, *noCache, *validate, *verbose, *workers, totalBytes, logger, progress, fatal)
+		opts.OnEvent = eventPrinter(src, *verbose, logger, progress)
+		engine := core.NewEngine(opts)
+		notifyInterrupts(interruptHandler(engine, logger, func() {
+			fmt.Fprintf(out, "\n[%s] [WARN] Interrupted again, exiting without waiting for the files in progress\n", timestamp())
+			exit(exitSignal)
+		}))
+		res, err := engine.Run(context.Background())
 		close(done)
 		fmt.Println() // Move to a new line after the last progress bar
+		cache.Close()
+		printFailureSummary(out, res.Failures)
+		if errors.Is(err, core.ErrStopped) {
+			printStopped(out, res)
+			exit(exitSignal)
+		} else if err != nil {
+			fmt.Fprintf(out, "[%s] [ERROR] Copy aborted: %v\n", timestamp(), err)
+			exit(exitCode(res, err))
+		}
 
 		// ADD THIS VALIDATION COMPLETION MESSAGE FOR NO-TUI MODE:
-		if *validate {
+		if *validate && res.Failed == 0 {
 			fmt.Fprintf(out, "[%s] [VALIDATE] Validation completed successfully for all files\n", timestamp())
 		}
 
-		fmt.Fprintf(out, "[%s] [INFO] Copy process completed.\n", timestamp())
-		cache.SaveCache()
-		return
+		if res.Failed > 0 {
+			fmt.Fprintf(out, "[%s] [INFO] Copy process completed with %d failed file(s).\n", timestamp(), res.Failed)
+		} else {
+			fmt.Fprintf(out, "[%s] [INFO] Copy process completed.\n", timestamp())
+		}
+		exit(exitCode(res, nil))
 	}
 
 	// --- TUI Mode ---
@@ -669,14 +848,6 @@ PERFORMANCE TIPS:
 		}
 	}()
 
-	bufSize, err := core.ParseSize(*bufferSizeStr)
-	if err != nil {
-		fmt.Fprintf(logView, "[%s] [ERROR] Invalid buffer size: %v\n", timestamp(), err)
-		cache.SaveCache()
-		app.Stop()
-		return
-	}
-
 	totalBuffer := int64(*workers) * int64(bufSize)
 	if totalBuffer > 2*1024*1024*1024 {
 		fmt.Fprintf(logView, "[%s] [WARN] Total buffer allocation is %.2f GB (%d workers × %s)\n",
@@ -705,31 +876,27 @@ PERFORMANCE TIPS:
 		}
 	}
 
-	// --- NEW: Use a shared variable for copied bytes and a goroutine for progress bar ---
-	var copiedBytes int64
 	startTime := time.Now()
 	done := make(chan struct{})
 
-	// Progress callback: only update copiedBytes
-	progress := func(copied, total int64) {
-		copiedBytes = copied
-	}
-
 	// Progress bar updater goroutine: updates UI every 0.5s
 	go func() {
+		var meter rateMeter
 		for {
 			select {
 			case <-done:
 				return
 			default:
 				elapsed := time.Since(startTime).Round(time.Second)
+				copied, total := copiedBytes.Load(), totalBytes.Load()
+				status := meter.status(copied, total)
 				app.QueueUpdateDraw(func() {
 					progressView.Clear()
-					fmt.Fprintf(progressView, "Total: %.2f MB / %.2f MB %s | %s",
-						float64(copiedBytes)/(1024*1024), float64(totalBytes)/(1024*1024),
-						core.RenderProgressBar(copiedBytes, totalBytes, 40),
-						elapsed)
-					if copiedBytes == totalBytes {
+					fmt.Fprintf(progressView, "Total: %.2f MB / %.2f MB %s | %s | %s",
+						float64(copied)/(1024*1024), float64(total)/(1024*1024),
+						core.RenderProgressBar(copied, total, 40),
+						status, elapsed)
+					if copied == total {
 						fmt.Fprintln(progressView)
 					}
 				})
@@ -745,24 +912,45 @@ PERFORMANCE TIPS:
 		})
 	}
 
-	fatal := func(format string, args ...interface{}) {
-		cache.SaveCache()
-		app.QueueUpdateDraw(func() {
-			fmt.Fprintf(logView, format, args...)
-			logView.ScrollToEnd() // Always scroll to bottom
-			app.Stop()
-		})
-	}
+	opts.OnEvent = eventPrinter(src, *verbose, logger, progress)
+	engine := core.NewEngine(opts)
+	// The terminal is in raw mode, Ctrl-C arrives as a key
+	onInterrupt := interruptHandler(engine, logger, func() {
+		app.Stop()
+		fmt.Fprintf(os.Stderr, "[%s] [WARN] Interrupted again, exiting without waiting for the files in progress\n", timestamp())
+		exit(exitSignal)
+	})
+	notifyInterrupts(onInterrupt)
+	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyCtrlC {
+			onInterrupt()
+			return nil
+		}
+		return event
+	})
 
+	var res core.Result
+	var runErr error
 	go func() {
-		runCopyWorkers(fileList, src, rootDst, cache, bufSize, *noCache, *validate, *verbose, *workers, totalBytes, logger, progress, fatal)
+		res, runErr = engine.Run(context.Background())
 		close(done)
-		cache.SaveCache()
+		cache.Close()
+		if runErr != nil {
+			app.QueueUpdateDraw(func() {
+				app.Stop()
+			})
+			return
+		}
 		app.QueueUpdateDraw(func() {
-			if *validate {
+			printFailureSummary(out, res.Failures)
+			if *validate && res.Failed == 0 {
 				fmt.Fprintf(out, "[%s] [VALIDATE] Validation completed successfully for all files\n", timestamp())
 			}
-			fmt.Fprintf(logView, "[%s] [INFO] Copy process completed. Press any key to exit.\n", timestamp())
+			if res.Failed > 0 {
+				fmt.Fprintf(logView, "[%s] [INFO] Copy process completed with %d failed file(s). Press any key to exit.\n", timestamp(), res.Failed)
+			} else {
+				fmt.Fprintf(logView, "[%s] [INFO] Copy process completed. Press any key to exit.\n", timestamp())
+			}
 			logView.ScrollToEnd() // Scroll to bottom for final messages
 			app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 				app.Stop()
@@ -775,48 +963,12 @@ PERFORMANCE TIPS:
 		cache.SaveCache()
 		panic(err)
 	}
-}
-
-// deleteExtraFiles removes files and directories from the destination that do not exist in the source.
-// It also removes corresponding entries from the cache.
-func deleteExtraFiles(srcDir, dstDir string, cache *core.GlobalCache) error {
-	var deletedDirs = make(map[string]bool)
-	err := filepath.Walk(dstDir, func(dstPath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !core.Exists(dstPath) {
-			return nil
-		}
-		relPath, _ := filepath.Rel(dstDir, dstPath)
-		srcPath := filepath.Join(srcDir, relPath)
-		_, err = os.Stat(srcPath)
-		if os.IsNotExist(err) {
-			if info.IsDir() {
-				fmt.Printf("[%s] [INFO] Marking directory for deletion: %s\n", timestamp(), dstPath)
-				deletedDirs[dstPath] = true
-			} else {
-				fmt.Printf("[%s] [INFO] Deleting extra file: %s\n", timestamp(), dstPath)
-				err := os.Remove(dstPath)
-				if err != nil {
-					return fmt.Errorf("[%s] [ERROR] failed to delete file %s: %v", timestamp(), dstPath, err)
-				}
-			}
-		}
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-	for dir := range deletedDirs {
-		err := os.RemoveAll(dir)
-		if err != nil {
-			return fmt.Errorf("[%s] [ERROR] failed to delete directory %s: %v", timestamp(), dir, err)
-		}
-		cache.Lock()
-		cache.Remove(dir)
-		cache.Unlock()
-		cache.SaveCache()
+	if errors.Is(runErr, core.ErrStopped) {
+		printFailureSummary(os.Stderr, res.Failures)
+		printStopped(os.Stderr, res)
+	} else if runErr != nil {
+		printFailureSummary(os.Stderr, res.Failures)
+		fmt.Fprintf(os.Stderr, "[%s] [ERROR] Copy aborted: %v\n", timestamp(), runErr)
 	}
-	return nil
+	exit(exitCode(res, runErr))
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"cache_copy/core"
+)
+
+func TestRateMeter(t *testing.T) {
+	var m rateMeter
+	if s := m.status(0, 100); !strings.HasSuffix(s, "ETA --") {
+		t.Errorf("first sample: %q, want no ETA yet", s)
+	}
+	m.last, m.lastBytes = time.Now().Add(-time.Second), 0
+	if s := m.status(1<<20, 3<<20); !strings.HasPrefix(s, "1.00 MB/s") || !strings.HasSuffix(s, "ETA 2s") {
+		t.Errorf("1 MB in a second: %q, want 1.00 MB/s and 2s left", s)
+	}
+	// A single fast sample moves the rate only part of the way
+	m.last = time.Now().Add(-time.Second)
+	if s := m.status(m.lastBytes+3<<20, 10<<20); !strings.HasPrefix(s, "1.60 MB/s") {
+		t.Errorf("smoothed rate: %q, want 1.60 MB/s", s)
+	}
+	if s := m.status(10<<20, 10<<20); !strings.HasSuffix(s, "ETA 0s") {
+		t.Errorf("done: %q, want ETA 0s", s)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	vanished := &core.FileError{Path: "a", Kind: core.FailureVanished, Err: errors.New("gone")}
+	denied := &core.FileError{Path: "b", Kind: core.FailurePermission, Err: errors.New("denied")}
+	full := &core.FileError{Path: "c", Kind: core.FailureNoSpace, Err: errors.New("full")}
+	tests := []struct {
+		name     string
+		failures []*core.FileError
+		err      error
+		want     int
+	}{
+		{"success", nil, nil, exitOK},
+		{"vanished only", []*core.FileError{vanished}, nil, exitVanished},
+		{"vanished and failed", []*core.FileError{vanished, denied}, nil, exitPartial},
+		{"stop on error", []*core.FileError{denied}, denied, exitPartial},
+		{"destination full", []*core.FileError{full}, full, exitFatal},
+		{"stopped", nil, core.ErrStopped, exitSignal},
+		{"cancelled", nil, fmt.Errorf("walk: %w", context.Canceled), exitSignal},
+		{"fatal", nil, errors.New("error gathering file list"), exitFatal},
+	}
+	for _, tt := range tests {
+		if got := exitCode(core.Result{Failures: tt.failures}, tt.err); got != tt.want {
+			t.Errorf("%s: exitCode() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}